@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/server"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "MANGAGETTER_"
+
+var (
+	configFlag      = flag.String("config", "", "Path to a yaml config file, keys are the names of these flags")
+	printConfigFlag = flag.Bool("print-config", false, "Print the effective config with secrets redacted and exit")
+)
+
+// commandFlags run a one-off command instead of configuring the server, they can only be given as flags
+var commandFlags = map[string]bool{
+	"config":        true,
+	"print-config":  true,
+	"add-user":      true,
+	"user-password": true,
+	"user-role":     true,
+	"user-admin":    true,
+	"disable-user":  true,
+	"enable-user":   true,
+}
+
+// secretFlags are redacted by print-config
+var secretFlags = map[string]bool{
+	"secret":             true,
+	"oidc-client-secret": true,
+}
+
+// envName returns the environment variable of a flag, like MANGAGETTER_DISK_CACHE_PATH for disk-cache-path
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig applies the config file and environment variables to the flags. The flags were already parsed,
+// so flags given on the command line are set again afterward to win over both.
+// Precedence is defaults < config file < environment < command line, every invalid value is returned
+func loadConfig() []error {
+	explicit := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	var errs []error
+	path := *configFlag
+	if path == "" {
+		path = os.Getenv(envName("config"))
+	}
+	if path != "" {
+		errs = append(errs, loadConfigFile(path)...)
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandFlags[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		err := setFlag(f, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+		}
+	})
+
+	for name, value := range explicit {
+		_ = flag.Set(name, value)
+	}
+	return errs
+}
+
+func loadConfigFile(path string) []error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	var values map[string]any
+	err = yaml.Unmarshal(content, &values)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %w", path, err)}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var errs []error
+	for _, key := range keys {
+		value := values[key]
+		f := flag.Lookup(key)
+		if f == nil || commandFlags[key] {
+			errs = append(errs, fmt.Errorf("%s: unknown key %q", path, key))
+			continue
+		}
+
+		var text string
+		switch v := value.(type) {
+		case nil:
+		case []any:
+			// Lists like trusted-proxies are comma separated on the command line
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			text = strings.Join(items, ",")
+		case map[string]any:
+			errs = append(errs, fmt.Errorf("%s: %s has to be a value, not a map", path, key))
+			continue
+		default:
+			text = fmt.Sprint(v)
+		}
+
+		err = setFlag(f, text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, key, err))
+		}
+	}
+	return errs
+}
+
+// setFlag sets f to value, keeping the old value if value is invalid
+func setFlag(f *flag.Flag, value string) error {
+	old := f.Value.String()
+	err := f.Value.Set(value)
+	if err != nil {
+		_ = f.Value.Set(old)
+		return fmt.Errorf("invalid value %q", value)
+	}
+	return nil
+}
+
+// parsedConfig holds the flags that need more parsing than the flag package does
+type parsedConfig struct {
+	UpdateInterval     time.Duration
+	UpdateHostInterval time.Duration
+	UpdateMaxBackoff   time.Duration
+	UpdateMaxInterval  time.Duration
+	DiskCacheAge       time.Duration
+	ShutdownTimeout    time.Duration
+	UserRole           database.Role
+	DefaultRole        database.Role
+	TrustedProxies     []netip.Prefix
+}
+
+// validateConfig checks every flag and returns all problems at once instead of stopping at the first
+func validateConfig() (parsedConfig, []error) {
+	var config parsedConfig
+	var errs []error
+	var err error
+	invalid := func(name string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+
+	if *portFlag < 1 || *portFlag > 65535 {
+		invalid("port", fmt.Errorf("%d is not a port", *portFlag))
+	}
+	if *maxAgeFlag < 1 {
+		invalid("age", errors.New("has to be at least one second"))
+	}
+	if *cacheSizeFlag < 0 {
+		invalid("cache", errors.New("can not be negative"))
+	}
+	if *diskCacheSizeFlag < 0 {
+		invalid("disk-cache-size", errors.New("can not be negative"))
+	}
+	if *updateWorkersFlag < 1 {
+		invalid("update-workers", errors.New("needs at least one worker"))
+	}
+	if *downloadersFlag < 1 {
+		invalid("downloaders", errors.New("needs at least one downloader"))
+	}
+	if (*certFlag == "") != (*keyFlag == "") {
+		invalid("cert", errors.New("cert and key have to be set together"))
+	}
+
+	config.UpdateInterval, err = time.ParseDuration(*updateIntervalFlag)
+	if err != nil {
+		invalid("update", err)
+	}
+	config.UpdateHostInterval, err = time.ParseDuration(*updateHostFlag)
+	if err == nil && config.UpdateHostInterval < 0 {
+		err = errors.New("can not be negative")
+	}
+	if err != nil {
+		invalid("update-host-interval", err)
+	}
+	config.UpdateMaxBackoff, err = time.ParseDuration(*updateBackoffFlag)
+	if err == nil && config.UpdateMaxBackoff <= 0 {
+		err = errors.New("has to be positive")
+	}
+	if err != nil {
+		invalid("update-max-backoff", err)
+	}
+	config.UpdateMaxInterval, err = time.ParseDuration(*updateMaxFlag)
+	if err == nil && config.UpdateMaxInterval <= 0 {
+		err = errors.New("has to be positive")
+	}
+	if err != nil {
+		invalid("update-max-interval", err)
+	}
+	config.DiskCacheAge, err = time.ParseDuration(*diskCacheAgeFlag)
+	if err != nil {
+		invalid("disk-cache-age", err)
+	}
+	config.ShutdownTimeout, err = time.ParseDuration(*shutdownFlag)
+	if err == nil && config.ShutdownTimeout <= 0 {
+		err = errors.New("has to be positive")
+	}
+	if err != nil {
+		invalid("shutdown-timeout", err)
+	}
+	config.UserRole, err = database.ParseRole(*userRoleFlag)
+	if err != nil {
+		invalid("user-role", err)
+	}
+	config.DefaultRole, err = database.ParseRole(*defaultRoleFlag)
+	if err != nil {
+		invalid("default-role", err)
+	}
+	config.TrustedProxies, err = server.ParseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		invalid("trusted-proxies", err)
+	}
+
+	if *proxyHeaderFlag != "" && *trustedProxiesFlag == "" {
+		invalid("trusted-proxies", errors.New("proxy-header needs trusted-proxies, otherwise anyone could set it"))
+	}
+	if *proxyHeaderFlag != "" && *oidcIssuerFlag != "" {
+		invalid("oidc-issuer", errors.New("proxy-header and oidc-issuer can not be used together"))
+	}
+	if *oidcIssuerFlag != "" && *oidcClientIdFlag == "" {
+		invalid("oidc-client-id", errors.New("oidc-issuer needs oidc-client-id"))
+	}
+	return config, errs
+}
+
+// printConfig writes the effective config as yaml, which can be used as config file again
+func printConfig(w io.Writer) error {
+	values := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandFlags[f.Name] {
+			return
+		}
+		var value any = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		if secretFlags[f.Name] && f.Value.String() != "" {
+			value = "<redacted>"
+		}
+		values[f.Name] = value
+	})
+
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(values)
+}
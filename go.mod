@@ -4,14 +4,15 @@ go 1.22
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.22
-	golang.org/x/text v0.14.0
+	github.com/rs/zerolog v1.33.0
+	golang.org/x/crypto v0.23.0
+	golang.org/x/text v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/rs/zerolog v1.33.0 // indirect
-	go.uber.org/multierr v1.10.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
 )
 
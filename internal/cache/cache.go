@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Cache is a memory bounded LRU cache for images.
+// Pinned entries are never evicted, so the cache can temporarily grow above its budget
+// if everything in it is pinned
+type Cache struct {
+	mutex   sync.Mutex
+	budget  int64
+	size    int64
+	entries map[string]*list.Element
+	// lru has the most recently used entry at the front
+	lru *list.List
+	// pins counts the pins per key, keys can be pinned before they are added
+	pins map[string]int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type entry struct {
+	key  string
+	data []byte
+}
+
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Pinned    int
+	Size      int64
+	Budget    int64
+}
+
+// New creates a Cache holding at most budget bytes of unpinned images, a budget of 0 never evicts
+func New(budget int64) *Cache {
+	return &Cache{
+		budget:  budget,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pins:    make(map[string]int),
+	}
+}
+
+// Key returns a collision free cache key for the image at url, the file extension is kept
+func Key(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	ext := path.Ext(strings.SplitN(url, "?", 2)[0])
+	return hex.EncodeToString(sum[:16]) + ext
+}
+
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*entry).data, true
+}
+
+// Contains reports whether key is cached without counting as a hit or miss
+func (c *Cache) Contains(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+func (c *Cache) Add(key string, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*entry)
+		c.size += int64(len(data)) - int64(len(e.data))
+		e.data = data
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.lru.PushFront(&entry{key: key, data: data})
+		c.size += int64(len(data))
+	}
+	c.evict()
+}
+
+func (c *Cache) Remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Pin protects keys from eviction until they are unpinned as often as they were pinned
+func (c *Cache) Pin(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range keys {
+		c.pins[key]++
+	}
+}
+
+func (c *Cache) Unpin(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range keys {
+		if c.pins[key] <= 1 {
+			delete(c.pins, key)
+		} else {
+			c.pins[key]--
+		}
+	}
+	c.evict()
+}
+
+func (c *Cache) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Keys pinned before they are added, like images that are still being prefetched, are not in the cache yet
+	pinned := 0
+	for key := range c.pins {
+		if _, ok := c.entries[key]; ok {
+			pinned++
+		}
+	}
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.entries),
+		Pinned:    pinned,
+		Size:      c.size,
+		Budget:    c.budget,
+	}
+}
+
+// evict removes the least recently used unpinned entries until the cache fits its budget,
+// the caller has to hold the mutex
+func (c *Cache) evict() {
+	if c.budget <= 0 {
+		return
+	}
+	elem := c.lru.Back()
+	for c.size > c.budget && elem != nil {
+		prev := elem.Prev()
+		if c.pins[elem.Value.(*entry).key] == 0 {
+			c.remove(elem)
+			c.evictions++
+		}
+		elem = prev
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	e := elem.Value.(*entry)
+	c.lru.Remove(elem)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.data))
+}
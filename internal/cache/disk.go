@@ -0,0 +1,261 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// Disk is a persistent, content addressed image cache.
+// Files are stored by the sha256 of their content, the database maps image keys to those files
+type Disk struct {
+	Path    string
+	MaxSize int64
+	MaxAge  time.Duration
+
+	db    *database.Manager
+	mutex sync.Mutex
+	size  int64
+}
+
+type MangaUsage struct {
+	MangaId int
+	Entries int
+	Size    int64
+}
+
+func NewDisk(path string, maxSize int64, maxAge time.Duration, db *database.Manager) (*Disk, error) {
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Disk{
+		Path:    path,
+		MaxSize: maxSize,
+		MaxAge:  maxAge,
+		db:      db,
+	}
+
+	var size *int64
+	err = db.Db.Model(&database.CacheEntry{}).Select("SUM(size)").Scan(&size).Error
+	if err != nil {
+		return nil, err
+	}
+	if size != nil {
+		d.size = *size
+	}
+	return d, nil
+}
+
+func (d *Disk) Get(key string) ([]byte, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var entry database.CacheEntry
+	result := d.db.Db.First(&entry, "key = ?", key)
+	if result.Error != nil {
+		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			log.Error().Err(result.Error).Str("Key", key).Msg("Could not look up disk cache")
+		}
+		return nil, false
+	}
+
+	if d.expired(entry) {
+		d.remove([]database.CacheEntry{entry})
+		return nil, false
+	}
+
+	buf, err := os.ReadFile(d.file(entry.Hash))
+	if err != nil {
+		log.Warn().Err(err).Str("Key", key).Msg("Disk cache file is missing")
+		d.remove([]database.CacheEntry{entry})
+		return nil, false
+	}
+
+	d.db.Db.Model(&entry).Update("access_unix", time.Now().Unix())
+	return buf, true
+}
+
+func (d *Disk) Put(key string, mangaId int, data []byte) error {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	path := d.file(hash)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		tmp := path + ".tmp"
+		err = os.WriteFile(tmp, data, 0o644)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	var old database.CacheEntry
+	if d.db.Db.First(&old, "key = ?", key).Error == nil {
+		d.size -= old.Size
+	}
+
+	entry := database.NewCacheEntry(key, hash, mangaId, int64(len(data)), time.Now().Unix())
+	err := d.db.Db.Save(&entry).Error
+	if err != nil {
+		return err
+	}
+	d.size += entry.Size
+
+	if old.Hash != "" && old.Hash != hash {
+		d.removeUnreferenced(old.Hash)
+	}
+	d.shrink()
+	return nil
+}
+
+// Cleanup removes expired entries and shrinks the cache to MaxSize
+func (d *Disk) Cleanup() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.MaxAge > 0 {
+		var expired []database.CacheEntry
+		err := d.db.Db.Where("access_unix < ?", time.Now().Add(-d.MaxAge).Unix()).Find(&expired).Error
+		if err != nil {
+			return err
+		}
+		d.remove(expired)
+	}
+	d.shrink()
+	return nil
+}
+
+func (d *Disk) PurgeManga(mangaId int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var entries []database.CacheEntry
+	err := d.db.Db.Where("manga_id = ?", mangaId).Find(&entries).Error
+	if err != nil {
+		return err
+	}
+	d.remove(entries)
+	return nil
+}
+
+// Remove deletes the entries of keys, keys that are not cached are ignored
+func (d *Disk) Remove(keys []string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var entries []database.CacheEntry
+	err := d.db.Db.Where("key IN ?", keys).Find(&entries).Error
+	if err != nil {
+		return err
+	}
+	d.remove(entries)
+	return nil
+}
+
+func (d *Disk) Purge() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var entries []database.CacheEntry
+	err := d.db.Db.Find(&entries).Error
+	if err != nil {
+		return err
+	}
+	d.remove(entries)
+	return nil
+}
+
+func (d *Disk) Size() int64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.size
+}
+
+func (d *Disk) Usage() ([]MangaUsage, error) {
+	var usage []MangaUsage
+	err := d.db.Db.Model(&database.CacheEntry{}).
+		Select("manga_id, COUNT(*) AS entries, SUM(size) AS size").
+		Group("manga_id").
+		Order("size desc").
+		Scan(&usage).Error
+	return usage, err
+}
+
+func (d *Disk) expired(entry database.CacheEntry) bool {
+	return d.MaxAge > 0 && time.Since(time.Unix(entry.AccessUnix, 0)) > d.MaxAge
+}
+
+// shrink removes the least recently used entries until the cache fits MaxSize, the caller has to hold the mutex
+func (d *Disk) shrink() {
+	for d.MaxSize > 0 && d.size > d.MaxSize {
+		var oldest []database.CacheEntry
+		err := d.db.Db.Order("access_unix asc").Limit(64).Find(&oldest).Error
+		if err != nil || len(oldest) == 0 {
+			if err != nil {
+				log.Error().Err(err).Msg("Could not shrink disk cache")
+			}
+			return
+		}
+
+		var free int64
+		i := 0
+		for i < len(oldest) && d.size-free > d.MaxSize {
+			free += oldest[i].Size
+			i++
+		}
+		before := d.size
+		d.remove(oldest[:i])
+		if d.size == before {
+			return
+		}
+	}
+}
+
+// remove deletes entries and all files no other entry references, the caller has to hold the mutex
+func (d *Disk) remove(entries []database.CacheEntry) {
+	for _, entry := range entries {
+		err := d.db.Db.Delete(&entry).Error
+		if err != nil {
+			log.Error().Err(err).Str("Key", entry.Key).Msg("Could not remove disk cache entry")
+			continue
+		}
+		d.size -= entry.Size
+		d.removeUnreferenced(entry.Hash)
+	}
+}
+
+func (d *Disk) removeUnreferenced(hash string) {
+	var count int64
+	d.db.Db.Model(&database.CacheEntry{}).Where("hash = ?", hash).Count(&count)
+	if count > 0 {
+		return
+	}
+	err := os.Remove(d.file(hash))
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("Hash", hash).Msg("Could not remove disk cache file")
+	}
+}
+
+func (d *Disk) file(hash string) string {
+	return filepath.Join(d.Path, hash[:2], hash)
+}
@@ -0,0 +1,87 @@
+package cbz
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ComicInfo is the subset of the ComicRack ComicInfo.xml schema mangaGetter knows about
+type ComicInfo struct {
+	XMLName   xml.Name `xml:"ComicInfo"`
+	XmlnsXsi  string   `xml:"xmlns:xsi,attr"`
+	XmlnsXsd  string   `xml:"xmlns:xsd,attr"`
+	Title     string   `xml:"Title,omitempty"`
+	Series    string   `xml:"Series"`
+	Number    string   `xml:"Number,omitempty"`
+	Volume    string   `xml:"Volume,omitempty"`
+	Web       string   `xml:"Web,omitempty"`
+	PageCount int      `xml:"PageCount"`
+	Manga     string   `xml:"Manga"`
+}
+
+func NewComicInfo(series string, number string, web string, pageCount int) ComicInfo {
+	return ComicInfo{
+		XmlnsXsi:  "http://www.w3.org/2001/XMLSchema-instance",
+		XmlnsXsd:  "http://www.w3.org/2001/XMLSchema",
+		Series:    series,
+		Number:    number,
+		Web:       web,
+		PageCount: pageCount,
+		Manga:     "Yes",
+	}
+}
+
+type Page struct {
+	// Name is only used for its extension, pages are stored in the order they are given
+	Name string
+	Data []byte
+}
+
+// Write writes a CBZ archive containing all pages and a ComicInfo.xml to w
+func Write(w io.Writer, info ComicInfo, pages []Page) error {
+	zw := zip.NewWriter(w)
+
+	width := len(fmt.Sprint(len(pages)))
+	if width < 3 {
+		width = 3
+	}
+	for i, page := range pages {
+		ext := path.Ext(strings.SplitN(page.Name, "?", 2)[0])
+		if ext == "" {
+			ext = ".jpg"
+		}
+		// Images are already compressed, storing them saves time and barely any space
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("%0*d%s", width, i+1, ext),
+			Method: zip.Store,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(page.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := zw.Create("ComicInfo.xml")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	err = enc.Encode(info)
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
@@ -0,0 +1,46 @@
+package database
+
+type AuthEventType string
+
+const (
+	AuthSuccess AuthEventType = "success"
+	AuthFailure AuthEventType = "failure"
+	AuthLockout AuthEventType = "lockout"
+	AuthLogout  AuthEventType = "logout"
+)
+
+// AuthEvent is an entry of the audit log of logins and logouts
+type AuthEvent struct {
+	Id       int   `gorm:"primary_key;AUTO_INCREMENT"`
+	TimeUnix int64 `gorm:"index"`
+	Type     AuthEventType
+	// UserId is 0 if Name is not a known user
+	UserId    int
+	Name      string
+	Address   string
+	UserAgent string
+	Detail    string
+}
+
+func NewAuthEvent(eventType AuthEventType, userId int, name string, address string, userAgent string, detail string, timeUnix int64) AuthEvent {
+	return AuthEvent{
+		TimeUnix:  timeUnix,
+		Type:      eventType,
+		UserId:    userId,
+		Name:      name,
+		Address:   address,
+		UserAgent: userAgent,
+		Detail:    detail,
+	}
+}
+
+func (dbMgr *Manager) AddAuthEvent(event *AuthEvent) error {
+	return dbMgr.Db.Create(event).Error
+}
+
+// AuthEvents returns limit events starting at offset, the newest first
+func (dbMgr *Manager) AuthEvents(offset int, limit int) ([]AuthEvent, error) {
+	var events []AuthEvent
+	err := dbMgr.Db.Order("time_unix DESC, id DESC").Offset(offset).Limit(limit).Find(&events).Error
+	return events, err
+}
@@ -0,0 +1,23 @@
+package database
+
+// CacheEntry indexes one image in the on disk cache, Key is the cache key of the image url
+// and Hash the sha256 of its content, which is also the name of the file
+type CacheEntry struct {
+	Key         string `gorm:"PRIMARY_KEY"`
+	Hash        string `gorm:"index"`
+	MangaId     int    `gorm:"index"`
+	Size        int64
+	CreatedUnix int64
+	AccessUnix  int64
+}
+
+func NewCacheEntry(key string, hash string, mangaId int, size int64, timeStampUnix int64) CacheEntry {
+	return CacheEntry{
+		Key:         key,
+		Hash:        hash,
+		MangaId:     mangaId,
+		Size:        size,
+		CreatedUnix: timeStampUnix,
+		AccessUnix:  timeStampUnix,
+	}
+}
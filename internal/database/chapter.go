@@ -1,17 +1,32 @@
 package database
 
+import "strconv"
+
 type Chapter struct {
-	Id            int `gorm:"primary_key;AUTO_INCREMENT"`
-	Url           string
-	Name          string
-	Number        string
-	TimeStampUnix int64
-	MangaId       int
+	Id int `gorm:"primary_key;AUTO_INCREMENT"`
+	// ProviderId is the id of the chapter at the provider of its manga
+	ProviderId int `gorm:"uniqueIndex:idx_chapter_provider"`
+	Url        string
+	Name       string
+	Number     string
+	MangaId    int `gorm:"uniqueIndex:idx_chapter_provider"`
+	Title      string
+	Volume     string
+	Scanlator  string
+	UploadUnix int64
+	// DiscoveredUnix is when an update found the chapter, 0 if it was known since the manga was added
+	DiscoveredUnix int64
+
+	// The progress belongs to a user, it is stored in UserChapter and filled by Manager.LoadUserState
+	TimeStampUnix int64 `gorm:"-"`
+	Read          bool  `gorm:"-"`
+	ReadUnix      int64 `gorm:"-"`
+	Page          int   `gorm:"-"` // Index of the last viewed image
 }
 
-func NewChapter(id int, mangaId int, url string, name string, number string, timeStampUnix int64) Chapter {
+func NewChapter(providerId int, mangaId int, url string, name string, number string, timeStampUnix int64) Chapter {
 	return Chapter{
-		Id:            id,
+		ProviderId:    providerId,
 		Url:           url,
 		Name:          name,
 		Number:        number,
@@ -19,3 +34,19 @@ func NewChapter(id int, mangaId int, url string, name string, number string, tim
 		MangaId:       mangaId,
 	}
 }
+
+// ChapterByProviderId finds the chapter of mangaId with the id providerId at the provider of the manga
+func (dbMgr *Manager) ChapterByProviderId(mangaId int, providerId int) (*Chapter, error) {
+	var chapter Chapter
+	err := dbMgr.Db.Where("manga_id = ? AND provider_id = ?", mangaId, providerId).First(&chapter).Error
+	if err != nil {
+		return nil, err
+	}
+	return &chapter, nil
+}
+
+// NumberValue parses Number, chapters like "12.5" are supported
+func (c *Chapter) NumberValue() (float64, bool) {
+	n, err := strconv.ParseFloat(c.Number, 64)
+	return n, err == nil
+}
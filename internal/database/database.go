@@ -70,6 +70,29 @@ func (dbMgr *Manager) Delete(mangaId int) {
 }
 
 func (dbMgr *Manager) createDatabaseIfNotExists() error {
-	err := dbMgr.Db.AutoMigrate(&Manga{}, &Chapter{}, &Setting{})
-	return err
+	err := dbMgr.migrateProviderIds()
+	if err != nil {
+		return err
+	}
+	return dbMgr.Db.AutoMigrate(&Manga{}, &Chapter{}, &Setting{}, &UserSetting{}, &CacheEntry{}, &User{}, &Session{}, &UserManga{}, &UserChapter{}, &AuthEvent{}, &ApiToken{}, &UserIdentity{}, &UpdateRun{}, &UpdateResult{}, &AutoDownload{}, &Webhook{})
+}
+
+// migrateProviderIds fills the provider ids of mangas and chapters saved when they were stored with the id of their
+// provider, those ids stay their ids. It runs before AutoMigrate creates the unique indexes on the new columns
+func (dbMgr *Manager) migrateProviderIds() error {
+	migrator := dbMgr.Db.Migrator()
+	for _, table := range []string{"mangas", "chapters"} {
+		if !migrator.HasTable(table) || migrator.HasColumn(table, "provider_id") {
+			continue
+		}
+		err := dbMgr.Db.Exec("ALTER TABLE " + table + " ADD COLUMN provider_id integer").Error
+		if err != nil {
+			return err
+		}
+		err = dbMgr.Db.Exec("UPDATE " + table + " SET provider_id = id").Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,96 @@
+package database
+
+import "fmt"
+
+type DownloadTarget string
+
+const (
+	// DownloadCbz writes chapters into CBZ files in the download directory
+	DownloadCbz DownloadTarget = "cbz"
+	// DownloadCache stores the images of chapters in the disk cache
+	DownloadCache DownloadTarget = "cache"
+)
+
+// ParseDownloadTarget reads the target of an auto download rule, empty turns auto downloads off
+func ParseDownloadTarget(name string) (DownloadTarget, error) {
+	switch target := DownloadTarget(name); target {
+	case "", DownloadCbz, DownloadCache:
+		return target, nil
+	}
+	return "", fmt.Errorf("unknown download target %q", name)
+}
+
+// AutoDownload is a chapter that was downloaded because of the auto download rule of its manga,
+// it is kept until the retention policy of the manga deletes it again
+type AutoDownload struct {
+	ChapterId   int `gorm:"primaryKey;autoIncrement:false"`
+	MangaId     int `gorm:"index"`
+	Number      string
+	Target      DownloadTarget
+	CreatedUnix int64
+	// Path is the CBZ file of DownloadCbz, Keys are the newline separated disk cache keys of DownloadCache
+	Path string
+	Keys string
+}
+
+// NumberValue parses Number like Chapter.NumberValue, so downloads sort like their chapters
+func (d *AutoDownload) NumberValue() (float64, bool) {
+	chapter := Chapter{Number: d.Number}
+	return chapter.NumberValue()
+}
+
+func (dbMgr *Manager) SaveAutoDownload(download *AutoDownload) error {
+	return dbMgr.Db.Save(download).Error
+}
+
+func (dbMgr *Manager) DeleteAutoDownload(chapterId int) error {
+	return dbMgr.Db.Delete(&AutoDownload{}, chapterId).Error
+}
+
+// AutoDownloads returns the chapters of the manga that were downloaded automatically
+func (dbMgr *Manager) AutoDownloads(mangaId int) ([]AutoDownload, error) {
+	var downloads []AutoDownload
+	err := dbMgr.Db.Where("manga_id = ?", mangaId).Find(&downloads).Error
+	return downloads, err
+}
+
+// RetainedMangas returns the mangas with a retention policy and automatically downloaded chapters
+func (dbMgr *Manager) RetainedMangas() ([]*Manga, error) {
+	var mangas []*Manga
+	err := dbMgr.Db.Where("keep_unread > 0 OR delete_read_after > 0").
+		Where("id IN (?)", dbMgr.Db.Model(&AutoDownload{}).Select("manga_id")).
+		Find(&mangas).Error
+	return mangas, err
+}
+
+// ReadByAll returns when the chapters of the manga were read by the last user with the manga in their library,
+// by chapter id. Chapters that any of them has not read yet are left out
+func (dbMgr *Manager) ReadByAll(mangaId int) (map[int]int64, error) {
+	readers := dbMgr.Db.Model(&UserManga{}).Select("user_id").Where("manga_id = ?", mangaId)
+
+	var users int64
+	err := dbMgr.Db.Model(&UserManga{}).Where("manga_id = ?", mangaId).Count(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ChapterId int
+		Readers   int64
+		ReadUnix  int64
+	}
+	err = dbMgr.Db.Model(&UserChapter{}).Select("chapter_id, COUNT(*) AS readers, MAX(read_unix) AS read_unix").
+		Where("manga_id = ? AND read = ? AND user_id IN (?)", mangaId, true, readers).
+		Group("chapter_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	read := make(map[int]int64, len(rows))
+	for _, row := range rows {
+		if users > 0 && row.Readers == users {
+			read[row.ChapterId] = row.ReadUnix
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserIdentity links the subject of an OpenID Connect issuer to a local user
+type UserIdentity struct {
+	Id          int    `gorm:"primary_key;AUTO_INCREMENT"`
+	UserId      int    `gorm:"index"`
+	Issuer      string `gorm:"uniqueIndex:idx_identity_subject"`
+	Subject     string `gorm:"uniqueIndex:idx_identity_subject"`
+	CreatedUnix int64
+}
+
+// IdentityUser returns the user linked to subject of issuer, gorm.ErrRecordNotFound if there is none
+func (dbMgr *Manager) IdentityUser(issuer string, subject string) (*User, error) {
+	var identity UserIdentity
+	err := dbMgr.Db.Where("issuer = ? AND subject = ?", issuer, subject).First(&identity).Error
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	err = dbMgr.Db.First(&user, identity.UserId).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateIdentityUser creates a user with role and without a password for subject of issuer. If name is already taken
+// a number is appended, so nobody can take over an existing account by choosing its name at the issuer
+func (dbMgr *Manager) CreateIdentityUser(issuer string, subject string, name string, role Role) (*User, error) {
+	if name == "" {
+		return nil, errors.New("user name can not be empty")
+	}
+	var user User
+	err := dbMgr.Db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().Unix()
+		candidate := name
+		for i := 2; ; i++ {
+			var count int64
+			err := tx.Model(&User{}).Where("name = ?", candidate).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				break
+			}
+			candidate = name + strconv.Itoa(i)
+		}
+
+		user = NewUser(candidate, role, now)
+		err := tx.Create(&user).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&UserIdentity{UserId: user.Id, Issuer: issuer, Subject: subject, CreatedUnix: now}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,273 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserManga puts a Manga into the library of a user
+type UserManga struct {
+	UserId        int `gorm:"primaryKey;autoIncrement:false"`
+	MangaId       int `gorm:"primaryKey;autoIncrement:false"`
+	Enabled       bool
+	TimeStampUnix int64
+}
+
+// UserChapter is the progress of a user in a Chapter
+type UserChapter struct {
+	UserId        int `gorm:"primaryKey;autoIncrement:false"`
+	ChapterId     int `gorm:"primaryKey;autoIncrement:false"`
+	MangaId       int `gorm:"index"`
+	TimeStampUnix int64
+	Read          bool
+	ReadUnix      int64
+	Page          int
+}
+
+// Library returns the mangas in the library of the user with their chapters and the users progress,
+// conditions can filter on user_mangas, for example "user_mangas.enabled = ?", true
+func (dbMgr *Manager) Library(userId int, conditions ...any) ([]*Manga, error) {
+	db := dbMgr.Db.Preload("Chapters").
+		Joins("JOIN user_mangas ON user_mangas.manga_id = mangas.id AND user_mangas.user_id = ?", userId)
+	if len(conditions) > 0 {
+		db = db.Where(conditions[0], conditions[1:]...)
+	}
+
+	var mangas []*Manga
+	err := db.Find(&mangas).Error
+	if err != nil {
+		return nil, err
+	}
+	return mangas, dbMgr.LoadUserState(userId, mangas...)
+}
+
+// LibraryManga returns a single manga of the library of the user, gorm.ErrRecordNotFound if it is not in it
+func (dbMgr *Manager) LibraryManga(userId int, mangaId int) (*Manga, error) {
+	mangas, err := dbMgr.Library(userId, "mangas.id = ?", mangaId)
+	if err != nil {
+		return nil, err
+	}
+	if len(mangas) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return mangas[0], nil
+}
+
+// LibraryChapter returns a chapter of a manga in the library of the user with the users progress,
+// gorm.ErrRecordNotFound if the manga is not in it
+func (dbMgr *Manager) LibraryChapter(userId int, chapterId int) (*Chapter, error) {
+	var chapter Chapter
+	err := dbMgr.Db.Joins("JOIN user_mangas ON user_mangas.manga_id = chapters.manga_id AND user_mangas.user_id = ?", userId).
+		First(&chapter, "chapters.id = ?", chapterId).Error
+	if err != nil {
+		return nil, err
+	}
+	return &chapter, dbMgr.LoadChapterState(userId, &chapter)
+}
+
+// LoadUserState fills the per user fields of the mangas and their preloaded chapters
+func (dbMgr *Manager) LoadUserState(userId int, mangas ...*Manga) error {
+	if len(mangas) == 0 {
+		return nil
+	}
+	ids := make([]int, len(mangas))
+	for i, manga := range mangas {
+		ids[i] = manga.Id
+	}
+
+	var userMangas []UserManga
+	err := dbMgr.Db.Where("user_id = ? AND manga_id IN ?", userId, ids).Find(&userMangas).Error
+	if err != nil {
+		return err
+	}
+	var userChapters []UserChapter
+	err = dbMgr.Db.Where("user_id = ? AND manga_id IN ?", userId, ids).Find(&userChapters).Error
+	if err != nil {
+		return err
+	}
+
+	mangaState := make(map[int]UserManga, len(userMangas))
+	for _, um := range userMangas {
+		mangaState[um.MangaId] = um
+	}
+	chapterState := make(map[int]UserChapter, len(userChapters))
+	for _, uc := range userChapters {
+		chapterState[uc.ChapterId] = uc
+	}
+
+	for _, manga := range mangas {
+		um := mangaState[manga.Id]
+		manga.Enabled = um.Enabled
+		manga.TimeStampUnix = um.TimeStampUnix
+		for i := range manga.Chapters {
+			chapter := &manga.Chapters[i]
+			uc := chapterState[chapter.Id]
+			chapter.TimeStampUnix = uc.TimeStampUnix
+			chapter.Read = uc.Read
+			chapter.ReadUnix = uc.ReadUnix
+			chapter.Page = uc.Page
+		}
+	}
+	return nil
+}
+
+// LoadChapterState fills the per user fields of a single chapter
+func (dbMgr *Manager) LoadChapterState(userId int, chapter *Chapter) error {
+	var uc UserChapter
+	err := dbMgr.Db.Where("user_id = ? AND chapter_id = ?", userId, chapter.Id).Limit(1).Find(&uc).Error
+	chapter.TimeStampUnix = uc.TimeStampUnix
+	chapter.Read = uc.Read
+	chapter.ReadUnix = uc.ReadUnix
+	chapter.Page = uc.Page
+	return err
+}
+
+// SaveUserManga stores Enabled and TimeStampUnix of manga for the user, adding it to the library if necessary
+func (dbMgr *Manager) SaveUserManga(userId int, manga *Manga) error {
+	return dbMgr.Db.Save(&UserManga{
+		UserId:        userId,
+		MangaId:       manga.Id,
+		Enabled:       manga.Enabled,
+		TimeStampUnix: manga.TimeStampUnix,
+	}).Error
+}
+
+// SaveUserChapter stores the progress fields of chapter for the user
+func (dbMgr *Manager) SaveUserChapter(userId int, chapter *Chapter) error {
+	return dbMgr.Db.Save(&UserChapter{
+		UserId:        userId,
+		ChapterId:     chapter.Id,
+		MangaId:       chapter.MangaId,
+		TimeStampUnix: chapter.TimeStampUnix,
+		Read:          chapter.Read,
+		ReadUnix:      chapter.ReadUnix,
+		Page:          chapter.Page,
+	}).Error
+}
+
+// AddToLibrary adds the manga to the library of the user, nothing changes if it already is in it
+func (dbMgr *Manager) AddToLibrary(userId int, mangaId int) error {
+	return dbMgr.Db.Clauses(clause.OnConflict{DoNothing: true}).Create(&UserManga{
+		UserId:        userId,
+		MangaId:       mangaId,
+		Enabled:       true,
+		TimeStampUnix: time.Now().Unix(),
+	}).Error
+}
+
+// InLibrary returns which of the mangaIds are in the library of the user
+func (dbMgr *Manager) InLibrary(userId int, mangaIds ...int) ([]int, error) {
+	var ids []int
+	if len(mangaIds) == 0 {
+		return ids, nil
+	}
+	err := dbMgr.Db.Model(&UserManga{}).Where("user_id = ? AND manga_id IN ?", userId, mangaIds).Pluck("manga_id", &ids).Error
+	return ids, err
+}
+
+// RemoveFromLibrary forgets the manga and the progress of the user,
+// the manga itself is deleted once it is in no library anymore. Its automatically downloaded chapters are deleted
+// with it and returned, so their files can be removed
+func (dbMgr *Manager) RemoveFromLibrary(userId int, mangaId int) ([]AutoDownload, error) {
+	var downloads []AutoDownload
+	err := dbMgr.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND manga_id = ?", userId, mangaId).Delete(&UserChapter{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ? AND manga_id = ?", userId, mangaId).Delete(&UserManga{}).Error
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		err = tx.Model(&UserManga{}).Where("manga_id = ?", mangaId).Count(&count).Error
+		if err != nil || count > 0 {
+			return err
+		}
+		err = tx.Where("manga_id = ?", mangaId).Find(&downloads).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("manga_id = ?", mangaId).Delete(&AutoDownload{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("manga_id = ?", mangaId).Delete(&Chapter{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&Manga{}, mangaId).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return downloads, nil
+}
+
+// UpdatableMangas returns the mangas that are enabled in at least one library and neither paused nor completed,
+// the ones that are due the longest first
+func (dbMgr *Manager) UpdatableMangas() ([]*Manga, error) {
+	var mangas []*Manga
+	err := dbMgr.Db.Where("id IN (?)", dbMgr.Db.Model(&UserManga{}).Select("manga_id").Where("enabled = ?", true)).
+		Where("update_paused = ? AND completed = ?", false, false).
+		Order("next_update_unix").Find(&mangas).Error
+	return mangas, err
+}
+
+// SaveUpdateSchedule stores the update settings and the next update of manga
+func (dbMgr *Manager) SaveUpdateSchedule(manga *Manga) error {
+	return dbMgr.Db.Model(manga).Select("update_interval", "update_paused", "completed", "next_update_unix").
+		Updates(manga).Error
+}
+
+// SaveNextUpdate stores when the updater checks mangaId again. A manga whose next update changed since the updater
+// loaded it with previous had its schedule changed meanwhile, it is left due so the new schedule applies
+func (dbMgr *Manager) SaveNextUpdate(mangaId int, previous int64, next int64) error {
+	return dbMgr.Db.Model(&Manga{}).Where("id = ? AND next_update_unix = ?", mangaId, previous).
+		Update("next_update_unix", next).Error
+}
+
+// SaveMangaUpdate stores the chapter list and thumbnail an update loaded for manga, without the settings that may
+// have been changed while it ran
+func (dbMgr *Manager) SaveMangaUpdate(manga *Manga) error {
+	return dbMgr.Db.Model(manga).Select("last_chapter_num", "chapter_count", "thumbnail").Updates(manga).Error
+}
+
+// SaveAutoDownloadRule stores where the chapters of manga are downloaded to and how long they are kept
+func (dbMgr *Manager) SaveAutoDownloadRule(manga *Manga) error {
+	return dbMgr.Db.Model(manga).Select("auto_download", "keep_unread", "delete_read_after").Updates(manga).Error
+}
+
+// MigrateLibrary moves the progress stored on mangas and chapters before there were users into the library of userId
+func (dbMgr *Manager) MigrateLibrary(userId int) error {
+	migrator := dbMgr.Db.Migrator()
+	if !migrator.HasColumn("mangas", "enabled") {
+		return nil
+	}
+
+	var count int64
+	err := dbMgr.Db.Model(&UserManga{}).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+
+	progress := "COALESCE(time_stamp_unix, 0), 0, 0, 0"
+	touched := "COALESCE(time_stamp_unix, 0) > 0"
+	if migrator.HasColumn("chapters", "read") {
+		progress = "COALESCE(time_stamp_unix, 0), COALESCE(read, 0), COALESCE(read_unix, 0), COALESCE(page, 0)"
+		touched += " OR read = 1 OR page > 0"
+	}
+
+	return dbMgr.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO user_mangas (user_id, manga_id, enabled, time_stamp_unix)
+			SELECT ?, id, COALESCE(enabled, 1), COALESCE(time_stamp_unix, 0) FROM mangas`, userId).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(`INSERT INTO user_chapters (user_id, chapter_id, manga_id, time_stamp_unix, read, read_unix, page)
+			SELECT ?, id, manga_id, `+progress+` FROM chapters WHERE `+touched, userId).Error
+	})
+}
@@ -1,24 +1,68 @@
 package database
 
+import "strconv"
+
 type Manga struct {
-	Id             int `gorm:"primary_key;AUTO_INCREMENT"`
+	Id       int    `gorm:"primary_key;AUTO_INCREMENT"`
+	Provider string `gorm:"uniqueIndex:idx_manga_provider"` // Name of the provider.Provider
+	// ProviderId is the id of the title at its provider, ids of different providers can be the same
+	ProviderId     int `gorm:"uniqueIndex:idx_manga_provider"`
 	Title          string
-	TimeStampUnix  int64
 	Thumbnail      []byte
 	LastChapterNum string
+	ChapterCount   int // Number of chapters the provider listed on the last update
 	Chapters       []Chapter
-	Enabled        bool
+
+	// UpdateInterval in seconds replaces the interval learned from the releases, 0 to learn it
+	UpdateInterval int64
+	// UpdatePaused and Completed mangas are left out by the updater, they can still be refreshed by hand
+	UpdatePaused bool
+	Completed    bool
+	// NextUpdateUnix is when the updater checks the manga again
+	NextUpdateUnix int64 `gorm:"index"`
+
+	// AutoDownload is where chapters found by the updater are downloaded to, empty to not download them
+	AutoDownload DownloadTarget
+	// KeepUnread is how many of the newest unread downloaded chapters are kept, 0 keeps all
+	KeepUnread int
+	// DeleteReadAfter in seconds deletes downloaded chapters everyone has read, 0 keeps them
+	DeleteReadAfter int64
 	//`gorm:"foreignkey:MangaID"`
+
+	// TimeStampUnix and Enabled belong to a user, they are stored in UserManga and filled by Manager.LoadUserState
+	TimeStampUnix int64 `gorm:"-"`
+	Enabled       bool  `gorm:"-"`
 }
 
-func NewManga(id int, title string, timeStampUnix int64) Manga {
+func NewManga(providerId int, provider string, title string, timeStampUnix int64) Manga {
 	return Manga{
-		Id:             id,
+		Provider:       provider,
+		ProviderId:     providerId,
 		Title:          title,
 		TimeStampUnix:  timeStampUnix,
 		LastChapterNum: "",
-    Enabled: true,
+		Enabled:        true,
+	}
+}
+
+// MangaByProviderId finds the manga with the id providerId at provider
+func (dbMgr *Manager) MangaByProviderId(provider string, providerId int) (*Manga, error) {
+	var manga Manga
+	err := dbMgr.Db.Where("provider = ? AND provider_id = ?", provider, providerId).First(&manga).Error
+	if err != nil {
+		return nil, err
 	}
+	return &manga, nil
+}
+
+// SetMissingProvider gives the mangas saved before providers were tracked the provider they were read from
+func (dbMgr *Manager) SetMissingProvider(provider string) error {
+	return dbMgr.Db.Model(&Manga{}).Where("provider = ? OR provider IS NULL", "").Update("provider", provider).Error
+}
+
+// SubUrl is the url of the title at its provider
+func (m *Manga) SubUrl() string {
+	return "/title/" + strconv.Itoa(m.ProviderId)
 }
 
 // GetLatestChapter TODO: Cache this somehow
@@ -26,9 +70,19 @@ func (m *Manga) GetLatestChapter() (*Chapter, bool) {
 	highest := int64(0)
 	index := 0
 	for i, chapter := range m.Chapters {
-		if chapter.MangaId == m.Id && highest < chapter.TimeStampUnix {
+		if chapter.MangaId != m.Id {
+			continue
+		}
+		if highest < chapter.TimeStampUnix {
 			highest = chapter.TimeStampUnix
 			index = i
+		} else if highest == chapter.TimeStampUnix && highest != 0 {
+			// Chapters opened within the same second, the higher one was most likely read last
+			a, _ := m.Chapters[index].NumberValue()
+			b, _ := chapter.NumberValue()
+			if b > a {
+				index = i
+			}
 		}
 	}
 
@@ -47,3 +101,34 @@ func (m *Manga) GetLatestChapter() (*Chapter, bool) {
 	//	return &chapter, true, nil
 	//}
 }
+
+// GetFirstChapter returns the chapter with the lowest number, it is used for mangas that were never opened
+func (m *Manga) GetFirstChapter() (*Chapter, bool) {
+	index := -1
+	lowest := 0.0
+	for i, chapter := range m.Chapters {
+		n, ok := chapter.NumberValue()
+		if chapter.MangaId != m.Id || !ok {
+			continue
+		}
+		if index < 0 || n < lowest {
+			index = i
+			lowest = n
+		}
+	}
+	if index < 0 {
+		return nil, false
+	}
+	return &m.Chapters[index], true
+}
+
+// UnreadCount returns the number of known chapters that are not marked as read
+func (m *Manga) UnreadCount() int {
+	count := 0
+	for _, chapter := range m.Chapters {
+		if chapter.MangaId == m.Id && !chapter.Read {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,81 @@
+package database
+
+// Session is a logged in browser, Id is the sha256 of the token in the session cookie,
+// so the tokens themselves are never stored
+type Session struct {
+	Id     string `gorm:"PRIMARY_KEY"`
+	UserId int    `gorm:"index"`
+	// Label names the device, it defaults to the browser and os from the UserAgent
+	Label        string
+	Address      string
+	UserAgent    string
+	CreatedUnix  int64
+	LastSeenUnix int64
+	// ExpiresUnix moves forward with LastSeenUnix, so only unused sessions expire
+	ExpiresUnix int64
+}
+
+func NewSession(id string, userId int, label string, address string, userAgent string, createdUnix int64, expiresUnix int64) Session {
+	return Session{
+		Id:           id,
+		UserId:       userId,
+		Label:        label,
+		Address:      address,
+		UserAgent:    userAgent,
+		CreatedUnix:  createdUnix,
+		LastSeenUnix: createdUnix,
+		ExpiresUnix:  expiresUnix,
+	}
+}
+
+func (dbMgr *Manager) CreateSession(session *Session) error {
+	return dbMgr.Db.Create(session).Error
+}
+
+// SessionUser returns the session with id and its user, gorm.ErrRecordNotFound if the session expired
+// or the user is disabled
+func (dbMgr *Manager) SessionUser(id string, nowUnix int64) (*User, *Session, error) {
+	var session Session
+	err := dbMgr.Db.Where("id = ? AND expires_unix > ?", id, nowUnix).First(&session).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var user User
+	err = dbMgr.Db.Where("id = ? AND disabled = ?", session.UserId, false).First(&user).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, &session, nil
+}
+
+// TouchSession records that the session was used and extends it
+func (dbMgr *Manager) TouchSession(session *Session, address string, lastSeenUnix int64, expiresUnix int64) error {
+	session.Address = address
+	session.LastSeenUnix = lastSeenUnix
+	session.ExpiresUnix = expiresUnix
+	return dbMgr.Db.Model(session).Select("address", "last_seen_unix", "expires_unix").Updates(session).Error
+}
+
+// UserSessions returns the sessions of the user that did not expire, the most recently used first
+func (dbMgr *Manager) UserSessions(userId int, nowUnix int64) ([]Session, error) {
+	var sessions []Session
+	err := dbMgr.Db.Where("user_id = ? AND expires_unix > ?", userId, nowUnix).Order("last_seen_unix DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+func (dbMgr *Manager) DeleteSession(id string) error {
+	return dbMgr.Db.Delete(&Session{}, "id = ?", id).Error
+}
+
+// DeleteUserSession deletes the session with id only if it belongs to the user
+func (dbMgr *Manager) DeleteUserSession(userId int, id string) error {
+	return dbMgr.Db.Delete(&Session{}, "id = ? AND user_id = ?", id, userId).Error
+}
+
+func (dbMgr *Manager) DeleteUserSessions(userId int) error {
+	return dbMgr.Db.Delete(&Session{}, "user_id = ?", userId).Error
+}
+
+func (dbMgr *Manager) DeleteExpiredSessions(nowUnix int64) error {
+	return dbMgr.Db.Delete(&Session{}, "expires_unix <= ?", nowUnix).Error
+}
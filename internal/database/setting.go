@@ -1,5 +1,10 @@
 package database
 
+import "slices"
+
+// viewSettings only change how the menu of a user is shown, so every user chooses them for themselves
+var viewSettings = []string{"order", "filter"}
+
 type Setting struct {
 	Name    string `gorm:"PRIMARY_KEY"`
 	Value   string
@@ -14,6 +19,30 @@ func NewSetting(name string, defaultValue string) Setting {
 	}
 }
 
+// UserSetting is the value a user chose for a view setting, it replaces the shared value for them
+type UserSetting struct {
+	UserId int    `gorm:"primaryKey;autoIncrement:false"`
+	Name   string `gorm:"primaryKey"`
+	Value  string
+}
+
+// IsViewSetting returns if every user sets name for themselves instead of sharing it
+func IsViewSetting(name string) bool {
+	return slices.Contains(viewSettings, name)
+}
+
+// UserSettings returns the view settings the user chose
+func (dbMgr *Manager) UserSettings(userId int) ([]UserSetting, error) {
+	var settings []UserSetting
+	err := dbMgr.Db.Where("user_id = ?", userId).Find(&settings).Error
+	return settings, err
+}
+
+// SaveUserSetting stores the value of the view setting name for the user
+func (dbMgr *Manager) SaveUserSetting(userId int, name string, value string) error {
+	return dbMgr.Db.Save(&UserSetting{UserId: userId, Name: name, Value: value}).Error
+}
+
 //func initSettings(settings *DbTable[string, Setting]) {
 //	addSettingIfNotExists("theme", "white", settings)
 //	addSettingIfNotExists("order", "title", settings)
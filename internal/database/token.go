@@ -0,0 +1,58 @@
+package database
+
+// ApiToken lets scripts use the api without logging in, Hash is the sha256 of the token, which is only shown once
+type ApiToken struct {
+	Id          int `gorm:"primary_key;AUTO_INCREMENT"`
+	UserId      int `gorm:"index"`
+	Name        string
+	Hash        string `gorm:"uniqueIndex"`
+	ReadOnly    bool
+	CreatedUnix int64
+	// LastUsedUnix is 0 if the token was never used
+	LastUsedUnix int64
+}
+
+func NewApiToken(userId int, name string, hash string, readOnly bool, createdUnix int64) ApiToken {
+	return ApiToken{
+		UserId:      userId,
+		Name:        name,
+		Hash:        hash,
+		ReadOnly:    readOnly,
+		CreatedUnix: createdUnix,
+	}
+}
+
+func (dbMgr *Manager) CreateApiToken(token *ApiToken) error {
+	return dbMgr.Db.Create(token).Error
+}
+
+// TokenUser returns the token with hash and its user, gorm.ErrRecordNotFound if there is none or the user is disabled
+func (dbMgr *Manager) TokenUser(hash string) (*User, *ApiToken, error) {
+	var token ApiToken
+	err := dbMgr.Db.Where("hash = ?", hash).First(&token).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var user User
+	err = dbMgr.Db.Where("id = ? AND disabled = ?", token.UserId, false).First(&user).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, &token, nil
+}
+
+func (dbMgr *Manager) TouchApiToken(token *ApiToken, lastUsedUnix int64) error {
+	token.LastUsedUnix = lastUsedUnix
+	return dbMgr.Db.Model(token).Update("last_used_unix", lastUsedUnix).Error
+}
+
+func (dbMgr *Manager) UserApiTokens(userId int) ([]ApiToken, error) {
+	var tokens []ApiToken
+	err := dbMgr.Db.Where("user_id = ?", userId).Order("created_unix DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+// DeleteUserApiToken deletes the token with id only if it belongs to the user
+func (dbMgr *Manager) DeleteUserApiToken(userId int, id int) error {
+	return dbMgr.Db.Delete(&ApiToken{}, "id = ? AND user_id = ?", id, userId).Error
+}
@@ -0,0 +1,126 @@
+package database
+
+type UpdateTrigger string
+
+const (
+	// UpdateScheduled runs every update interval
+	UpdateScheduled UpdateTrigger = "scheduled"
+	// UpdateManual was started by a user
+	UpdateManual UpdateTrigger = "manual"
+)
+
+// UpdateRun is one update of all enabled mangas
+type UpdateRun struct {
+	Id           int   `gorm:"primary_key;AUTO_INCREMENT"`
+	StartedUnix  int64 `gorm:"index"`
+	FinishedUnix int64
+	Trigger      UpdateTrigger
+	Mangas       int
+	Updated      int
+	Failed       int
+	Skipped      int
+	Cancelled    bool
+}
+
+// UpdateResult is the update of a single manga, RunId is 0 if it was refreshed on its own
+type UpdateResult struct {
+	Id          int   `gorm:"primary_key;AUTO_INCREMENT"`
+	RunId       int   `gorm:"index"`
+	MangaId     int   `gorm:"index"`
+	TimeUnix    int64 `gorm:"index"`
+	DurationMs  int64
+	NewChapters int
+	// Error is empty if the update succeeded
+	Error string
+}
+
+// ReleasedChapter is a chapter found by an update together with the title and provider of its manga
+type ReleasedChapter struct {
+	Chapter
+	MangaTitle    string
+	MangaProvider string
+}
+
+func (dbMgr *Manager) AddUpdateRun(run *UpdateRun) error {
+	return dbMgr.Db.Create(run).Error
+}
+
+func (dbMgr *Manager) SaveUpdateRun(run *UpdateRun) error {
+	return dbMgr.Db.Save(run).Error
+}
+
+func (dbMgr *Manager) AddUpdateResult(result *UpdateResult) error {
+	return dbMgr.Db.Create(result).Error
+}
+
+// UpdateRuns returns the last limit runs, the newest first
+func (dbMgr *Manager) UpdateRuns(limit int) ([]UpdateRun, error) {
+	var runs []UpdateRun
+	err := dbMgr.Db.Order("started_unix DESC, id DESC").Limit(limit).Find(&runs).Error
+	return runs, err
+}
+
+// UpdateResults returns the last limit results of the manga, the newest first
+func (dbMgr *Manager) UpdateResults(mangaId int, limit int) ([]UpdateResult, error) {
+	var results []UpdateResult
+	err := dbMgr.Db.Where("manga_id = ?", mangaId).Order("time_unix DESC, id DESC").Limit(limit).Find(&results).Error
+	return results, err
+}
+
+// LatestUpdateResults returns the newest result of every manga in the library of the user by manga id
+func (dbMgr *Manager) LatestUpdateResults(userId int) (map[int]UpdateResult, error) {
+	var results []UpdateResult
+	err := dbMgr.Db.Where("id IN (?)", dbMgr.Db.Model(&UpdateResult{}).Select("MAX(id)").Group("manga_id")).
+		Where("manga_id IN (?)", dbMgr.Db.Model(&UserManga{}).Select("manga_id").Where("user_id = ?", userId)).
+		Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[int]UpdateResult, len(results))
+	for _, result := range results {
+		latest[result.MangaId] = result
+	}
+	return latest, nil
+}
+
+// ReleasedChapters returns the last limit chapters updates found for mangas in the library of the user, the newest first
+func (dbMgr *Manager) ReleasedChapters(userId int, limit int) ([]ReleasedChapter, error) {
+	var chapters []ReleasedChapter
+	err := dbMgr.Db.Model(&Chapter{}).Select("chapters.*, mangas.title AS manga_title, mangas.provider AS manga_provider").
+		Joins("JOIN mangas ON mangas.id = chapters.manga_id").
+		Joins("JOIN user_mangas ON user_mangas.manga_id = chapters.manga_id AND user_mangas.user_id = ?", userId).
+		Where("chapters.discovered_unix > 0").
+		Order("chapters.discovered_unix DESC, chapters.id DESC").Limit(limit).Find(&chapters).Error
+	return chapters, err
+}
+
+// CountReleasedSince counts the chapters found for mangas in the library of the user after sinceUnix
+func (dbMgr *Manager) CountReleasedSince(userId int, sinceUnix int64) (int64, error) {
+	var count int64
+	err := dbMgr.Db.Model(&Chapter{}).
+		Joins("JOIN user_mangas ON user_mangas.manga_id = chapters.manga_id AND user_mangas.user_id = ?", userId).
+		Where("chapters.discovered_unix > ?", sinceUnix).Count(&count).Error
+	return count, err
+}
+
+// UpdatesSeen returns when the user last looked at the released chapters, 0 if never
+func (dbMgr *Manager) UpdatesSeen(userId int) (int64, error) {
+	var user User
+	err := dbMgr.Db.Select("updates_seen_unix").First(&user, userId).Error
+	return user.UpdatesSeenUnix, err
+}
+
+// SetUpdatesSeen remembers when the user last looked at the released chapters
+func (dbMgr *Manager) SetUpdatesSeen(userId int, seenUnix int64) error {
+	return dbMgr.Db.Model(&User{}).Where("id = ?", userId).Update("updates_seen_unix", seenUnix).Error
+}
+
+// PruneUpdates deletes runs and results older than beforeUnix
+func (dbMgr *Manager) PruneUpdates(beforeUnix int64) error {
+	err := dbMgr.Db.Where("time_unix < ?", beforeUnix).Delete(&UpdateResult{}).Error
+	if err != nil {
+		return err
+	}
+	return dbMgr.Db.Where("started_unix < ?", beforeUnix).Delete(&UpdateRun{}).Error
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role decides what a user may do, every role may do everything the roles below it may
+type Role string
+
+const (
+	// RoleGuest can read, keep their own progress and choose how their menu is shown
+	RoleGuest Role = "guest"
+	// RoleReader can also change their library and download chapters
+	RoleReader Role = "reader"
+	// RoleAdmin can also change the shared settings, manage users and the cache
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists every role, highest first
+var Roles = []Role{RoleAdmin, RoleReader, RoleGuest}
+
+func ParseRole(name string) (Role, error) {
+	for _, role := range Roles {
+		if string(role) == name {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("unknown role %q", name)
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleAdmin:
+		return 2
+	case RoleReader:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type User struct {
+	Id   int    `gorm:"primary_key;AUTO_INCREMENT"`
+	Name string `gorm:"uniqueIndex"`
+	// PasswordHash is a bcrypt hash, users without one can not log in
+	PasswordHash string
+	Role         Role `gorm:"default:reader"`
+	Disabled     bool
+	CreatedUnix  int64
+	// UpdatesSeenUnix is when the user last looked at the released chapters
+	UpdatesSeenUnix int64
+}
+
+func NewUser(name string, role Role, createdUnix int64) User {
+	return User{
+		Name:        name,
+		Role:        role,
+		CreatedUnix: createdUnix,
+	}
+}
+
+// Can reports whether the user has role or a higher one
+func (u *User) Can(role Role) bool {
+	return u.Role.rank() >= role.rank()
+}
+
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+func (dbMgr *Manager) Users() ([]User, error) {
+	var users []User
+	err := dbMgr.Db.Order("name").Find(&users).Error
+	return users, err
+}
+
+func (dbMgr *Manager) UserByName(name string) (*User, error) {
+	var user User
+	err := dbMgr.Db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser adds a user, an empty password creates a user that can not log in
+func (dbMgr *Manager) CreateUser(name string, password string, role Role) (*User, error) {
+	if name == "" {
+		return nil, errors.New("user name can not be empty")
+	}
+	user := NewUser(name, role, time.Now().Unix())
+	if password != "" {
+		err := user.SetPassword(password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &user, dbMgr.Db.Create(&user).Error
+}
+
+func (dbMgr *Manager) SetUserPassword(userId int, password string) error {
+	var user User
+	err := user.SetPassword(password)
+	if err != nil {
+		return err
+	}
+	return dbMgr.Db.Model(&User{}).Where("id = ?", userId).Update("password_hash", user.PasswordHash).Error
+}
+
+// SetUserDisabled disables or enables a user, disabling also ends all of their sessions
+func (dbMgr *Manager) SetUserDisabled(userId int, disabled bool) error {
+	err := dbMgr.Db.Model(&User{}).Where("id = ?", userId).Update("disabled", disabled).Error
+	if err != nil || !disabled {
+		return err
+	}
+	return dbMgr.DeleteUserSessions(userId)
+}
+
+func (dbMgr *Manager) SetUserRole(userId int, role Role) error {
+	return dbMgr.Db.Model(&User{}).Where("id = ?", userId).Update("role", role).Error
+}
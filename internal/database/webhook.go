@@ -0,0 +1,73 @@
+package database
+
+import "fmt"
+
+// WebhookStyle decides the body a webhook is sent
+type WebhookStyle string
+
+const (
+	// WebhookJson sends the plain payload
+	WebhookJson    WebhookStyle = "json"
+	WebhookDiscord WebhookStyle = "discord"
+	WebhookSlack   WebhookStyle = "slack"
+	WebhookNtfy    WebhookStyle = "ntfy"
+	WebhookGotify  WebhookStyle = "gotify"
+)
+
+// WebhookStyles lists every style, the plain one first
+var WebhookStyles = []WebhookStyle{WebhookJson, WebhookDiscord, WebhookSlack, WebhookNtfy, WebhookGotify}
+
+func ParseWebhookStyle(name string) (WebhookStyle, error) {
+	for _, style := range WebhookStyles {
+		if string(style) == name {
+			return style, nil
+		}
+	}
+	return "", fmt.Errorf("unknown webhook style %q", name)
+}
+
+// Webhook is told about the chapters updates find
+type Webhook struct {
+	Id    int `gorm:"primary_key;AUTO_INCREMENT"`
+	Name  string
+	Url   string
+	Style WebhookStyle
+	// Template replaces the body of Style if it is not empty
+	Template    string
+	Disabled    bool
+	CreatedUnix int64
+	// LastUnix is when the webhook was last sent, LastError is empty if that succeeded
+	LastUnix   int64
+	LastStatus int
+	LastError  string
+}
+
+func (dbMgr *Manager) Webhooks() ([]Webhook, error) {
+	var hooks []Webhook
+	err := dbMgr.Db.Order("id").Find(&hooks).Error
+	return hooks, err
+}
+
+// EnabledWebhooks returns the webhooks new chapters are sent to
+func (dbMgr *Manager) EnabledWebhooks() ([]Webhook, error) {
+	var hooks []Webhook
+	err := dbMgr.Db.Where("disabled = ?", false).Order("id").Find(&hooks).Error
+	return hooks, err
+}
+
+func (dbMgr *Manager) AddWebhook(hook *Webhook) error {
+	return dbMgr.Db.Create(hook).Error
+}
+
+func (dbMgr *Manager) DeleteWebhook(id int) error {
+	return dbMgr.Db.Delete(&Webhook{}, id).Error
+}
+
+func (dbMgr *Manager) SetWebhookDisabled(id int, disabled bool) error {
+	return dbMgr.Db.Model(&Webhook{}).Where("id = ?", id).Update("disabled", disabled).Error
+}
+
+// SaveWebhookResult stores how the last send of hook went
+func (dbMgr *Manager) SaveWebhookResult(hook *Webhook) error {
+	return dbMgr.Db.Model(hook).Select("last_unix", "last_status", "last_error").Updates(hook).Error
+}
@@ -3,8 +3,10 @@ package provider
 import (
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,6 +16,14 @@ import (
 
 type Bato struct{}
 
+func (b *Bato) Name() string {
+	return "bato"
+}
+
+func (b *Bato) Host() string {
+	return "bato.to"
+}
+
 func (b *Bato) CleanUrlToSub(url string) string {
 	trimmed := strings.TrimPrefix(url, "https://bato.to/title")
 	trimmed = strings.Trim(trimmed, "/")
@@ -48,27 +58,7 @@ func (b *Bato) GetImageList(html string) ([]string, error) {
 }
 
 func (b *Bato) GetHtml(titleSubUrl string) (string, error) {
-	url := fmt.Sprintf("https://bato.to%s?load=2", titleSubUrl)
-	resp, err := http.Get(url)
-
-	// TODO: Testing for above 300 is dirty
-	if err != nil && resp.StatusCode > 300 {
-		return "", errors.New("could not get html")
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Error().Err(err).Msg("Could not close http body")
-		}
-	}(resp.Body)
-
-	all, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	h := string(all)
-
-	return h, nil
+	return fetchHtml(fmt.Sprintf("https://bato.to%s?load=2", titleSubUrl))
 }
 
 func (b *Bato) GetNext(html string) (subUrl string, err error) {
@@ -146,26 +136,164 @@ func (b *Bato) GetChapterList(subUrl string) (subUrls []string, err error) {
 	return subUrls, nil
 }
 
-func (b *Bato) GetThumbnail(subUrl string) (thumbnailUrl string, err error) {
-	url := fmt.Sprintf("https://bato.to/title/%s", subUrl)
-	resp, err := http.Get(url)
+var (
+	batoChapterLinkReg   = regexp.MustCompile(`<a href="(/title/[^"]*)"[^>]*>(.*?)</a>`)
+	batoChapterTitleReg  = regexp.MustCompile(`<span>\s*:\s*</span>(.*?)</span>`)
+	batoScanlatorReg     = regexp.MustCompile(`<a [^>]*href="/g/[^"]*"[^>]*>(.*?)</a>`)
+	batoUploadReg        = regexp.MustCompile(`<time [^>]*data-time="(\d+)"`)
+	batoChapterNumberReg = regexp.MustCompile(`(?i)(?:chapter|ch)[\s._]*(\d+(?:\.\d+)?)`)
+	batoVolumeReg        = regexp.MustCompile(`(?i)(?:volume|vol)[\s._]*(\d+(?:\.\d+)?)`)
+	tagReg               = regexp.MustCompile(`<[^>]*>`)
+)
+
+// GetChapterInfos reads the chapter rows of the title page, every row starts with the same div as in GetChapterList
+func (b *Bato) GetChapterInfos(subUrl string) ([]ChapterInfo, error) {
+	h, err := b.GetHtml(subUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := strings.Split(h, `<div class="space-x-1">`)
+	infos := make([]ChapterInfo, 0, len(rows))
+	for _, row := range rows[min(1, len(rows)):] {
+		link := batoChapterLinkReg.FindStringSubmatch(row)
+		if len(link) <= 2 {
+			continue
+		}
+		_, chapterId, err := b.GetTitleIdAndChapterId(link[1])
+		if err != nil {
+			continue
+		}
+
+		info := ChapterInfo{
+			Id:     chapterId,
+			SubUrl: link[1],
+		}
+		linkText := stripTags(link[2])
+		if m := batoChapterNumberReg.FindStringSubmatch(linkText); len(m) > 1 {
+			info.Number = m[1]
+		} else if m := batoChapterNumberReg.FindStringSubmatch(link[1]); len(m) > 1 {
+			info.Number = m[1]
+		} else {
+			_, chapter, _ := b.GetTitleAndChapter(link[1])
+			info.Number = strings.Replace(chapter, "ch_", "", 1)
+		}
+		if m := batoVolumeReg.FindStringSubmatch(linkText); len(m) > 1 {
+			info.Volume = m[1]
+		} else if m := batoVolumeReg.FindStringSubmatch(link[1]); len(m) > 1 {
+			info.Volume = m[1]
+		}
+		if m := batoChapterTitleReg.FindStringSubmatch(row); len(m) > 1 {
+			info.Title = stripTags(m[1])
+		}
+		if m := batoScanlatorReg.FindStringSubmatch(row); len(m) > 1 {
+			info.Scanlator = stripTags(m[1])
+		}
+		if m := batoUploadReg.FindStringSubmatch(row); len(m) > 1 {
+			if ms, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+				info.UploadUnix = ms / 1000
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func stripTags(s string) string {
+	return strings.TrimSpace(html.UnescapeString(tagReg.ReplaceAllString(s, "")))
+}
+
+var (
+	batoResultTitleReg  = regexp.MustCompile(`<h3[^>]*>(.*?)</h3>`)
+	batoResultLinkReg   = regexp.MustCompile(`href="(/title/(\d+)-[^"/]*)"`)
+	batoResultCoverReg  = regexp.MustCompile(`<img [^>]*src="([^"]*)"`)
+	batoResultLatestReg = regexp.MustCompile(`<a [^>]*href="(/title/\d+-[^"/]*/\d+-[^"]*)"[^>]*>(.*?)</a>`)
+)
+
+// Search uses the v3 search page, every result starts with the same bordered div
+func (b *Bato) Search(query SearchQuery) ([]SearchResult, error) {
+	values := url.Values{}
+	values.Set("word", query.Query)
+	if query.Page > 1 {
+		values.Set("page", strconv.Itoa(query.Page))
+	}
+	if len(query.Genres) > 0 {
+		values.Set("genres", strings.Join(query.Genres, ","))
+	}
+
+	h, err := fetchHtml("https://bato.to/v3x-search?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := strings.Split(h, `<div class="flex border-b border-b-base-200 pb-5">`)
+	results := make([]SearchResult, 0, len(chunks))
+	for _, chunk := range chunks[min(1, len(chunks)):] {
+		link := batoResultLinkReg.FindStringSubmatch(chunk)
+		if len(link) <= 2 {
+			continue
+		}
+		id, err := strconv.Atoi(link[2])
+		if err != nil {
+			continue
+		}
+
+		result := SearchResult{
+			Id:     id,
+			SubUrl: link[1],
+		}
+		if m := batoResultTitleReg.FindStringSubmatch(chunk); len(m) > 1 {
+			result.Title = stripTags(m[1])
+		}
+		if m := batoResultCoverReg.FindStringSubmatch(chunk); len(m) > 1 {
+			result.CoverUrl = html.UnescapeString(m[1])
+		}
+		if m := batoResultLatestReg.FindStringSubmatch(chunk); len(m) > 2 {
+			result.LatestSubUrl = m[1]
+			result.LatestChapter = stripTags(m[2])
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (b *Bato) Genres() []string {
+	return []string{
+		"action", "adventure", "comedy", "cooking", "drama", "fantasy", "gender_bender", "harem", "historical",
+		"horror", "isekai", "martial_arts", "mecha", "medical", "military", "music", "mystery", "psychological",
+		"reincarnation", "romance", "school_life", "sci_fi", "shoujo_ai", "shounen_ai", "slice_of_life", "sports",
+		"supernatural", "survival", "thriller", "time_travel", "tragedy", "yaoi", "yuri",
+	}
+}
 
-	// TODO: Testing for above 300 is dirty
-	if err != nil && resp.StatusCode > 300 {
-		return "", errors.New("could not get html")
+func fetchHtml(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			fmt.Printf("Could not close body because: %v\n", err)
+			log.Error().Err(err).Msg("Could not close http body")
 		}
 	}(resp.Body)
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("could not get html, status %s", resp.Status)
+	}
+
 	all, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
-	h := string(all)
+	return string(all), nil
+}
+
+func (b *Bato) GetThumbnail(subUrl string) (thumbnailUrl string, err error) {
+	h, err := fetchHtml(fmt.Sprintf("https://bato.to/title/%s", subUrl))
+	if err != nil {
+		return "", err
+	}
 
 	reg, err := regexp.Compile(`<img data-hk="0-1-0" .*? src="(.*?)["']`)
 	if err != nil {
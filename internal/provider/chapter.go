@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"strings"
+)
+
+// ChapterInfo describes a chapter as listed by a provider, fields the provider does not know are left empty
+type ChapterInfo struct {
+	Id         int
+	SubUrl     string
+	Number     string
+	Title      string
+	Volume     string
+	Scanlator  string
+	UploadUnix int64
+}
+
+// ChapterInfoLister is implemented by providers that know more about a chapter than its sub url
+type ChapterInfoLister interface {
+	// GetChapterInfos returns the chapters of the manga at subUrl in the same order as GetChapterList
+	GetChapterInfos(subUrl string) ([]ChapterInfo, error)
+}
+
+// GetChapterInfos lists all chapters of the manga at subUrl,
+// for providers without ChapterInfoLister the infos are derived from the sub urls
+func GetChapterInfos(p Provider, subUrl string) ([]ChapterInfo, error) {
+	if lister, ok := p.(ChapterInfoLister); ok {
+		return lister.GetChapterInfos(subUrl)
+	}
+
+	subUrls, err := p.GetChapterList(subUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ChapterInfo, 0, len(subUrls))
+	for _, sub := range subUrls {
+		_, chapterId, err := p.GetTitleIdAndChapterId(sub)
+		if err != nil {
+			continue
+		}
+		_, chapter, err := p.GetTitleAndChapter(sub)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, ChapterInfo{
+			Id:     chapterId,
+			SubUrl: sub,
+			Number: strings.Replace(chapter, "ch_", "", 1),
+		})
+	}
+	return infos, nil
+}
@@ -0,0 +1,596 @@
+package provider
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".webp", ".gif", ".avif"}
+
+var (
+	chapterNumberReg = regexp.MustCompile(`(?i)ch(?:apter)?\.?\s*(\d+(?:\.\d+)?)`)
+	volumeReg        = regexp.MustCompile(`(?i)\bv(?:ol(?:ume)?)?\.?\s*(\d+)`)
+	anyNumberReg     = regexp.MustCompile(`\d+(?:\.\d+)?`)
+	localImageReg    = regexp.MustCompile(`^local://(\d+)/(\d+)/`)
+)
+
+// Local serves a directory tree of mangas that are already on disk.
+// Every directory in Root is a manga, its chapters are CBZ/ZIP archives or directories of images,
+// sorted in natural order. A manga directory with only images in it is a single chapter.
+//
+// Sub urls look like the ones of Bato (/title/{id}-{name}/{id}-ch_{number}) where the ids are hashes of the paths,
+// the html of a chapter is a plain text listing of its images and neighbours
+type Local struct {
+	Root string
+
+	mutex  sync.Mutex
+	mangas map[int]*localManga
+}
+
+type localManga struct {
+	id       int
+	slug     string
+	dir      string
+	chapters []*localChapter
+}
+
+type localChapter struct {
+	id     int
+	number string
+	name   string
+	path   string
+	// archive is true for CBZ/ZIP files, otherwise path is a directory
+	archive bool
+}
+
+func NewLocal(root string) *Local {
+	return &Local{
+		Root:   root,
+		mangas: make(map[int]*localManga),
+	}
+}
+
+func (l *Local) Name() string {
+	return "local"
+}
+
+func (l *Local) Host() string {
+	return ""
+}
+
+func (l *Local) CleanUrlToSub(url string) string {
+	trimmed := strings.TrimPrefix(url, "/title")
+	trimmed = strings.Trim(trimmed, "/")
+	return trimmed
+}
+
+func (l *Local) GetImageList(html string) ([]string, error) {
+	images := make([]string, 0)
+	for _, line := range strings.Split(html, "\n") {
+		if img, ok := strings.CutPrefix(line, "image "); ok {
+			images = append(images, img)
+		}
+	}
+	if len(images) == 0 {
+		return nil, errors.New("no more content")
+	}
+	return images, nil
+}
+
+func (l *Local) GetHtml(titleSubUrl string) (string, error) {
+	manga, index, err := l.findChapter(titleSubUrl)
+	if err != nil {
+		return "", err
+	}
+	chapter := manga.chapters[index]
+
+	names, err := chapter.images()
+	if err != nil {
+		return "", err
+	}
+
+	sb := strings.Builder{}
+	if index > 0 {
+		fmt.Fprintf(&sb, "prev %s\n", manga.subUrl(manga.chapters[index-1]))
+	}
+	if index < len(manga.chapters)-1 {
+		fmt.Fprintf(&sb, "next %s\n", manga.subUrl(manga.chapters[index+1]))
+	}
+	for i, name := range names {
+		fmt.Fprintf(&sb, "image local://%d/%d/%s\n", chapter.id, i, filepath.Base(name))
+	}
+	return sb.String(), nil
+}
+
+func (l *Local) GetNext(html string) (subUrl string, err error) {
+	return findLine(html, "next "), nil
+}
+
+func (l *Local) GetPrev(html string) (subUrl string, err error) {
+	return findLine(html, "prev "), nil
+}
+
+func (l *Local) GetTitleAndChapter(url string) (title string, chapter string, err error) {
+	reg, err := regexp.Compile(`/title/\d*-(.*?)/\d*-(.*)`)
+	if err != nil {
+		return "", "", err
+	}
+
+	matches := reg.FindAllStringSubmatch(url, -1)
+	if len(matches) <= 0 {
+		return "", "", errors.New("no title or chapter found")
+	}
+
+	return matches[0][1], matches[0][2], nil
+}
+
+func (l *Local) GetTitleIdAndChapterId(url string) (titleId int, chapterId int, err error) {
+	reg, err := regexp.Compile(`/title/(\d*)-.*?/(\d*)-.*`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	matches := reg.FindAllStringSubmatch(url, -1)
+	if len(matches) <= 0 {
+		return 0, 0, errors.New("no title or chapter found")
+	}
+	t, err := strconv.Atoi(matches[0][1])
+	if err != nil {
+		return 0, 0, err
+	}
+	c, err := strconv.Atoi(matches[0][2])
+
+	return t, c, err
+}
+
+func (l *Local) GetThumbnail(mangaId string) (thumbnailUrl string, err error) {
+	id, err := strconv.Atoi(mangaId)
+	if err != nil {
+		return "", err
+	}
+	manga, err := l.manga(id, true)
+	if err != nil {
+		return "", err
+	}
+
+	chapter := manga.chapters[0]
+	names, err := chapter.images()
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", errors.New("could not find Thumbnail url")
+	}
+	return fmt.Sprintf("local://%d/0/%s", chapter.id, filepath.Base(names[0])), nil
+}
+
+func (l *Local) GetChapterList(subUrl string) (subUrls []string, err error) {
+	manga, err := l.rescanTitle(subUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	subUrls = make([]string, len(manga.chapters))
+	for i, chapter := range manga.chapters {
+		subUrls[i] = manga.subUrl(chapter)
+	}
+	return subUrls, nil
+}
+
+// GetChapterInfos uses the file names as chapter titles and their modification time as upload date
+func (l *Local) GetChapterInfos(subUrl string) ([]ChapterInfo, error) {
+	manga, err := l.rescanTitle(subUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ChapterInfo, len(manga.chapters))
+	for i, chapter := range manga.chapters {
+		infos[i] = ChapterInfo{
+			Id:     chapter.id,
+			SubUrl: manga.subUrl(chapter),
+			Number: chapter.number,
+			Title:  chapter.name,
+		}
+		if match := volumeReg.FindStringSubmatch(chapter.name); len(match) > 1 {
+			infos[i].Volume = trimNumber(match[1])
+		}
+		if stat, err := os.Stat(chapter.path); err == nil {
+			infos[i].UploadUnix = stat.ModTime().Unix()
+		}
+	}
+	return infos, nil
+}
+
+// Search matches the query against the folder names of the library, the library is rescanned for every first page
+func (l *Local) Search(query SearchQuery) ([]SearchResult, error) {
+	const pageSize = 20
+
+	l.mutex.Lock()
+	if query.Page <= 1 || len(l.mangas) == 0 {
+		err := l.scan()
+		if err != nil {
+			l.mutex.Unlock()
+			return nil, err
+		}
+	}
+	mangas := make([]*localManga, 0, len(l.mangas))
+	for _, manga := range l.mangas {
+		if strings.Contains(strings.ToLower(filepath.Base(manga.dir)), strings.ToLower(query.Query)) {
+			mangas = append(mangas, manga)
+		}
+	}
+	l.mutex.Unlock()
+
+	slices.SortFunc(mangas, func(a, b *localManga) int {
+		return naturalCompare(filepath.Base(a.dir), filepath.Base(b.dir))
+	})
+
+	start := (max(query.Page, 1) - 1) * pageSize
+	if start >= len(mangas) {
+		return []SearchResult{}, nil
+	}
+	mangas = mangas[start:min(start+pageSize, len(mangas))]
+
+	results := make([]SearchResult, len(mangas))
+	for i, manga := range mangas {
+		latest := manga.chapters[len(manga.chapters)-1]
+		results[i] = SearchResult{
+			Id:            manga.id,
+			Title:         filepath.Base(manga.dir),
+			SubUrl:        fmt.Sprintf("/title/%d-%s", manga.id, manga.slug),
+			LatestChapter: "Chapter " + latest.number,
+			LatestSubUrl:  manga.subUrl(latest),
+		}
+		if cover, err := l.GetThumbnail(strconv.Itoa(manga.id)); err == nil {
+			results[i].CoverUrl = cover
+		}
+	}
+	return results, nil
+}
+
+// Genres returns nothing, a library has no genres
+func (l *Local) Genres() []string {
+	return nil
+}
+
+// FetchImage reads an image url returned by GetImageList or GetThumbnail from disk
+func (l *Local) FetchImage(url string) ([]byte, error) {
+	match := localImageReg.FindStringSubmatch(url)
+	if len(match) <= 2 {
+		return nil, fmt.Errorf("invalid local image url %q", url)
+	}
+	chapterId, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.Atoi(match[2])
+	if err != nil {
+		return nil, err
+	}
+
+	chapter, err := l.chapter(chapterId)
+	if err != nil {
+		return nil, err
+	}
+	names, err := chapter.images()
+	if err != nil {
+		return nil, err
+	}
+	if index >= len(names) {
+		return nil, fmt.Errorf("chapter has no image %d", index)
+	}
+
+	if !chapter.archive {
+		return os.ReadFile(names[index])
+	}
+
+	zr, err := zip.OpenReader(chapter.path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, file := range zr.File {
+		if file.Name != names[index] {
+			continue
+		}
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	return nil, fmt.Errorf("archive has no image %q", names[index])
+}
+
+// rescanTitle returns the manga of a title sub url, the library is always rescanned so the updater sees newly added chapters
+func (l *Local) rescanTitle(subUrl string) (*localManga, error) {
+	reg, err := regexp.Compile(`/title/(\d*)`)
+	if err != nil {
+		return nil, err
+	}
+	match := reg.FindStringSubmatch(subUrl)
+	if len(match) <= 1 {
+		return nil, errors.New("no title found")
+	}
+	id, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, err
+	}
+	return l.manga(id, true)
+}
+
+func (l *Local) findChapter(subUrl string) (*localManga, int, error) {
+	titleId, chapterId, err := l.GetTitleIdAndChapterId(subUrl)
+	if err != nil {
+		return nil, 0, err
+	}
+	manga, err := l.manga(titleId, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	index := slices.IndexFunc(manga.chapters, func(c *localChapter) bool { return c.id == chapterId })
+	if index < 0 {
+		manga, err = l.manga(titleId, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		index = slices.IndexFunc(manga.chapters, func(c *localChapter) bool { return c.id == chapterId })
+	}
+	if index < 0 {
+		return nil, 0, fmt.Errorf("chapter %d not found", chapterId)
+	}
+	return manga, index, nil
+}
+
+func (l *Local) chapter(id int) (*localChapter, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.mangas) == 0 {
+		err := l.scan()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, manga := range l.mangas {
+		for _, chapter := range manga.chapters {
+			if chapter.id == id {
+				return chapter, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("chapter %d not found", id)
+}
+
+// manga returns the manga with id, rescan reads its chapters from disk again
+func (l *Local) manga(id int, rescan bool) (*localManga, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	manga, ok := l.mangas[id]
+	if !ok {
+		err := l.scan()
+		if err != nil {
+			return nil, err
+		}
+		manga, ok = l.mangas[id]
+		if !ok {
+			return nil, fmt.Errorf("manga %d not found", id)
+		}
+	} else if rescan {
+		chapters, err := scanChapters(manga.dir)
+		if err != nil {
+			return nil, err
+		}
+		// Replace instead of modifying, callers may still read the old chapters without holding the mutex
+		manga = &localManga{
+			id:       manga.id,
+			slug:     manga.slug,
+			dir:      manga.dir,
+			chapters: chapters,
+		}
+		l.mangas[id] = manga
+	}
+
+	if len(manga.chapters) == 0 {
+		return nil, fmt.Errorf("manga %d has no chapters", id)
+	}
+	return manga, nil
+}
+
+// scan reads all mangas in Root, the caller has to hold the mutex
+func (l *Local) scan() error {
+	entries, err := os.ReadDir(l.Root)
+	if err != nil {
+		return err
+	}
+
+	mangas := make(map[int]*localManga)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(l.Root, entry.Name())
+		chapters, err := scanChapters(dir)
+		if err != nil {
+			return err
+		}
+		if len(chapters) == 0 {
+			continue
+		}
+		id := hashId(entry.Name())
+		mangas[id] = &localManga{
+			id:       id,
+			slug:     slugify(entry.Name()),
+			dir:      dir,
+			chapters: chapters,
+		}
+	}
+	l.mangas = mangas
+	return nil
+}
+
+func scanChapters(dir string) ([]*localChapter, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	hasImages := false
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || ext == ".cbz" || ext == ".zip" {
+			names = append(names, entry.Name())
+		} else if slices.Contains(imageExtensions, ext) {
+			hasImages = true
+		}
+	}
+	slices.SortFunc(names, naturalCompare)
+
+	chapters := make([]*localChapter, 0, len(names))
+	for i, name := range names {
+		ext := strings.ToLower(filepath.Ext(name))
+		chapters = append(chapters, &localChapter{
+			id:      hashId(filepath.Join(filepath.Base(dir), name)),
+			number:  chapterNumber(strings.TrimSuffix(name, filepath.Ext(name)), i+1),
+			name:    strings.TrimSuffix(name, filepath.Ext(name)),
+			path:    filepath.Join(dir, name),
+			archive: ext == ".cbz" || ext == ".zip",
+		})
+	}
+
+	if len(chapters) == 0 && hasImages {
+		chapters = append(chapters, &localChapter{
+			id:     hashId(filepath.Base(dir) + "/"),
+			number: "1",
+			path:   dir,
+		})
+	}
+	return chapters, nil
+}
+
+// images returns the image names of the chapter in natural order,
+// full paths for directories and entry names for archives
+func (c *localChapter) images() ([]string, error) {
+	names := make([]string, 0)
+	if c.archive {
+		zr, err := zip.OpenReader(c.path)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.FileInfo().IsDir() && slices.Contains(imageExtensions, strings.ToLower(filepath.Ext(f.Name))) {
+				names = append(names, f.Name)
+			}
+		}
+	} else {
+		entries, err := os.ReadDir(c.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && slices.Contains(imageExtensions, strings.ToLower(filepath.Ext(entry.Name()))) {
+				names = append(names, filepath.Join(c.path, entry.Name()))
+			}
+		}
+	}
+	slices.SortFunc(names, naturalCompare)
+	return names, nil
+}
+
+func (m *localManga) subUrl(chapter *localChapter) string {
+	return fmt.Sprintf("/title/%d-%s/%d-ch_%s", m.id, m.slug, chapter.id, chapter.number)
+}
+
+func findLine(html string, prefix string) string {
+	for _, line := range strings.Split(html, "\n") {
+		if value, ok := strings.CutPrefix(line, prefix); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// chapterNumber guesses the chapter number from a file name, preferring numbers after "ch" or "chapter"
+func chapterNumber(name string, fallback int) string {
+	if match := chapterNumberReg.FindStringSubmatch(name); len(match) > 1 {
+		return trimNumber(match[1])
+	}
+	if all := anyNumberReg.FindAllString(name, -1); len(all) > 0 {
+		return trimNumber(all[len(all)-1])
+	}
+	return strconv.Itoa(fallback)
+}
+
+func trimNumber(number string) string {
+	trimmed := strings.TrimLeft(number, "0")
+	if trimmed == "" || strings.HasPrefix(trimmed, ".") {
+		trimmed = "0" + trimmed
+	}
+	return trimmed
+}
+
+func slugify(name string) string {
+	slug := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, name)
+	return strings.Trim(slug, "-")
+}
+
+func hashId(path string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(path))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+// naturalCompare compares strings like humans do, so "Chapter 2" comes before "Chapter 10"
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		ra, rb := rune(a[0]), rune(b[0])
+		if unicode.IsDigit(ra) && unicode.IsDigit(rb) {
+			na, restA := splitDigits(a)
+			nb, restB := splitDigits(b)
+			trimmedA, trimmedB := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(trimmedA) != len(trimmedB) {
+				return len(trimmedA) - len(trimmedB)
+			}
+			if c := strings.Compare(trimmedA, trimmedB); c != 0 {
+				return c
+			}
+			a, b = restA, restB
+			continue
+		}
+
+		la, lb := unicode.ToLower(ra), unicode.ToLower(rb)
+		if la != lb {
+			return int(la) - int(lb)
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,292 @@
+package provider
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int // sign of the result
+	}{
+		{"Chapter 2", "Chapter 10", -1},
+		{"Chapter 10", "Chapter 2", 1},
+		{"Chapter 02", "Chapter 2", 0},
+		{"chapter 3", "Chapter 3", 0},
+		{"Chapter 2", "Chapter 2.5", -1},
+		{"Chapter 2.5", "Chapter 3", -1},
+		{"Vol 1 Ch 9", "Vol 1 Ch 10", -1},
+		{"Vol 2 Ch 1", "Vol 1 Ch 10", 1},
+		{"a", "b", -1},
+		{"image", "image1", -1},
+		{"", "", 0},
+	}
+	for _, test := range tests {
+		got := naturalCompare(test.a, test.b)
+		if sign(got) != test.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want sign %d", test.a, test.b, got, test.want)
+		}
+	}
+
+	names := []string{"10.png", "1.png", "2.png", "cover.png", "02b.png"}
+	slices.SortFunc(names, naturalCompare)
+	want := []string{"1.png", "2.png", "02b.png", "10.png", "cover.png"}
+	if !slices.Equal(names, want) {
+		t.Errorf("sorted %v, want %v", names, want)
+	}
+}
+
+func TestChapterNumber(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback int
+		want     string
+	}{
+		{"Chapter 12", 1, "12"},
+		{"chapter_007", 1, "7"},
+		{"Ch.5.5", 1, "5.5"},
+		{"ch 0", 1, "0"},
+		{"Vol 3 Ch 20", 1, "20"},
+		{"Vol.2 Chapter 0.5", 1, "0.5"},
+		{"Series 2 - 045", 1, "45"},
+		{"Extra", 4, "4"},
+		{"CHAPTER 100", 1, "100"},
+	}
+	for _, test := range tests {
+		got := chapterNumber(test.name, test.fallback)
+		if got != test.want {
+			t.Errorf("chapterNumber(%q, %d) = %q, want %q", test.name, test.fallback, got, test.want)
+		}
+	}
+}
+
+func TestHashIdStable(t *testing.T) {
+	// The ids are stored in databases and urls, they must not change between versions
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"MyManga", 1241452605},
+		{"Other", 1849229205},
+		{"Series A/Chapter 2", 577592835},
+		{"Oneshot/", 1371640544},
+	}
+	for _, test := range tests {
+		got := hashId(test.path)
+		if got != test.want {
+			t.Errorf("hashId(%q) = %d, want %d", test.path, got, test.want)
+		}
+		if got < 0 {
+			t.Errorf("hashId(%q) = %d is negative", test.path, got)
+		}
+	}
+}
+
+func TestLocalLibrary(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, filepath.Join(root, "Series A", "Chapter 2"), map[string]string{
+		"10.png":    "a2-10",
+		"2.png":     "a2-2",
+		"notes.txt": "not an image",
+	})
+	writeCbz(t, filepath.Join(root, "Series A", "Chapter 10.cbz"), map[string]string{
+		"pages/02.jpg":  "a10-2",
+		"pages/01.jpg":  "a10-1",
+		"ComicInfo.xml": "<ComicInfo/>",
+	})
+	writeCbz(t, filepath.Join(root, "Series A", "Chapter 2.5.zip"), map[string]string{
+		"1.webp": "a25-1",
+	})
+	writeFiles(t, filepath.Join(root, "Oneshot"), map[string]string{
+		"page 1.png": "o-1",
+	})
+	writeFiles(t, filepath.Join(root, "Empty"), map[string]string{
+		"readme.txt": "no chapters",
+	})
+
+	l := NewLocal(root)
+
+	results, err := l.Search(SearchQuery{Page: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, result := range results {
+		titles = append(titles, result.Title)
+	}
+	if !slices.Equal(titles, []string{"Oneshot", "Series A"}) {
+		t.Fatalf("Search returned %v, want [Oneshot Series A]", titles)
+	}
+	series := results[1]
+	if series.Id != hashId("Series A") || series.SubUrl != "/title/"+strconv.Itoa(series.Id)+"-series-a" {
+		t.Errorf("Series A has id %d and url %q", series.Id, series.SubUrl)
+	}
+
+	t.Run("chapters", func(t *testing.T) {
+		infos, err := l.GetChapterInfos(series.SubUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			number string
+			title  string
+			id     int
+		}{
+			{"2", "Chapter 2", hashId("Series A/Chapter 2")},
+			{"2.5", "Chapter 2.5", hashId("Series A/Chapter 2.5.zip")},
+			{"10", "Chapter 10", hashId("Series A/Chapter 10.cbz")},
+		}
+		if len(infos) != len(tests) {
+			t.Fatalf("got %d chapters, want %d", len(infos), len(tests))
+		}
+		for i, test := range tests {
+			info := infos[i]
+			if info.Number != test.number || info.Title != test.title || info.Id != test.id {
+				t.Errorf("chapter %d is %+v, want number %q title %q id %d", i, info, test.number, test.title, test.id)
+			}
+			titleId, chapterId, err := l.GetTitleIdAndChapterId(info.SubUrl)
+			if err != nil || titleId != series.Id || chapterId != test.id {
+				t.Errorf("GetTitleIdAndChapterId(%q) = %d, %d, %v", info.SubUrl, titleId, chapterId, err)
+			}
+			title, chapter, err := l.GetTitleAndChapter(info.SubUrl)
+			if err != nil || title != "series-a" || chapter != "ch_"+test.number {
+				t.Errorf("GetTitleAndChapter(%q) = %q, %q, %v", info.SubUrl, title, chapter, err)
+			}
+		}
+	})
+
+	tests := []struct {
+		name   string
+		index  int
+		images []string
+		prev   bool
+		next   bool
+	}{
+		{"directory", 0, []string{"a2-2", "a2-10"}, false, true},
+		{"zip", 1, []string{"a25-1"}, true, true},
+		{"cbz", 2, []string{"a10-1", "a10-2"}, true, false},
+	}
+	chapters, err := l.GetChapterList(series.SubUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			html, err := l.GetHtml(chapters[test.index])
+			if err != nil {
+				t.Fatal(err)
+			}
+			images, err := l.GetImageList(html)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var contents []string
+			for _, image := range images {
+				buf, err := l.FetchImage(image)
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents = append(contents, string(buf))
+			}
+			if !slices.Equal(contents, test.images) {
+				t.Errorf("images are %v, want %v", contents, test.images)
+			}
+
+			prev, _ := l.GetPrev(html)
+			next, _ := l.GetNext(html)
+			if (prev != "") != test.prev || test.prev && prev != chapters[test.index-1] {
+				t.Errorf("prev is %q", prev)
+			}
+			if (next != "") != test.next || test.next && next != chapters[test.index+1] {
+				t.Errorf("next is %q", next)
+			}
+		})
+	}
+
+	t.Run("single chapter", func(t *testing.T) {
+		oneshot := results[0]
+		infos, err := l.GetChapterInfos(oneshot.SubUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].Number != "1" || infos[0].Id != hashId("Oneshot/") {
+			t.Fatalf("Oneshot has chapters %+v", infos)
+		}
+		thumbnail, err := l.GetThumbnail(strconv.Itoa(oneshot.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := l.FetchImage(thumbnail)
+		if err != nil || string(buf) != "o-1" {
+			t.Errorf("thumbnail is %q, %v", buf, err)
+		}
+	})
+
+	t.Run("rescan", func(t *testing.T) {
+		writeFiles(t, filepath.Join(root, "Series A", "Chapter 11"), map[string]string{"1.png": "a11-1"})
+		infos, err := l.GetChapterInfos(series.SubUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 4 || infos[3].Number != "11" {
+			t.Errorf("new chapter was not found, got %d chapters", len(infos))
+		}
+	})
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeCbz(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,7 +1,9 @@
 package provider
 
 type Provider interface {
-  CleanUrlToSub(url string) string
+	Name() string
+	Host() string
+	CleanUrlToSub(url string) string
 	GetImageList(html string) (imageUrls []string, err error)
 	GetHtml(url string) (html string, err error)
 	GetNext(html string) (url string, err error)
@@ -11,3 +13,8 @@ type Provider interface {
 	GetThumbnail(mangaId string) (thumbnailUrl string, err error)
 	GetChapterList(url string) (urls []string, err error)
 }
+
+// ImageFetcher is implemented by providers whose image urls can not be downloaded over http
+type ImageFetcher interface {
+	FetchImage(url string) ([]byte, error)
+}
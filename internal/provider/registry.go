@@ -0,0 +1,78 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var ErrUnknownProvider = errors.New("unknown provider")
+
+// Registry holds every Provider the server can serve, keyed by their Name.
+// The first registered Provider is used whenever no name is given, so
+// mangas saved before providers were tracked keep resolving to it.
+type Registry struct {
+	providers   map[string]Provider
+	names       []string
+	defaultName string
+}
+
+func NewRegistry(providers ...Provider) *Registry {
+	r := &Registry{
+		providers: make(map[string]Provider),
+	}
+	for _, p := range providers {
+		r.Register(p)
+	}
+	return r
+}
+
+func (r *Registry) Register(p Provider) {
+	name := p.Name()
+	if _, ok := r.providers[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	if r.defaultName == "" {
+		r.defaultName = name
+	}
+	r.providers[name] = p
+}
+
+// Get returns the Provider registered under name, an empty name returns the default Provider
+func (r *Registry) Get(name string) (Provider, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+	}
+	return p, nil
+}
+
+func (r *Registry) Default() Provider {
+	return r.providers[r.defaultName]
+}
+
+// FromUrl finds the Provider whose Host matches the host of a full url like https://bato.to/title/...
+func (r *Registry) FromUrl(rawUrl string) (Provider, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil || u.Host == "" {
+		return nil, false
+	}
+	host := strings.TrimPrefix(u.Hostname(), "www.")
+	for _, name := range r.names {
+		p := r.providers[name]
+		if p.Host() != "" && strings.EqualFold(p.Host(), host) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (r *Registry) Names() []string {
+	names := make([]string, len(r.names))
+	copy(names, r.names)
+	return names
+}
@@ -0,0 +1,26 @@
+package provider
+
+type SearchQuery struct {
+	Query string
+	// Page starts at 1
+	Page int
+	// Genres only returns titles that have all of these genres, the values come from Searcher.Genres
+	Genres []string
+}
+
+type SearchResult struct {
+	Id       int
+	Title    string
+	SubUrl   string
+	CoverUrl string
+	// LatestChapter is the display name of the newest chapter, LatestSubUrl is empty if the provider did not list one
+	LatestChapter string
+	LatestSubUrl  string
+}
+
+// Searcher is implemented by providers that can search their titles
+type Searcher interface {
+	Search(query SearchQuery) ([]SearchResult, error)
+	// Genres returns the genres Search can filter by
+	Genres() []string
+}
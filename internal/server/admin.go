@@ -0,0 +1,160 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+)
+
+func (s *Server) HandleUsers(w http.ResponseWriter, r *http.Request) {
+	s.viewUsers(w, r, "")
+}
+
+func (s *Server) viewUsers(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	tmpl := template.Must(view.GetViewTemplate(view.Users))
+
+	users, err := s.DbMgr.Users()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load users")
+		errorMessage = "Could not load users"
+	}
+
+	self := s.userId(r)
+	viewModel := view.UsersViewModel{
+		Csrf:     csrfToken(r),
+		Users:    make([]view.UserViewModel, len(users)),
+		Error:    errorMessage,
+		Settings: s.Settings(),
+	}
+	for _, role := range database.Roles {
+		viewModel.Roles = append(viewModel.Roles, string(role))
+	}
+	for i, user := range users {
+		viewModel.Users[i] = view.UserViewModel{
+			Id:       user.Id,
+			Name:     user.Name,
+			Role:     string(user.Role),
+			Disabled: user.Disabled,
+			Created:  time.Unix(user.CreatedUnix, 0).Format("15:04 (02-01-06)"),
+			Self:     user.Id == self,
+		}
+	}
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Users")
+	}
+}
+
+func (s *Server) HandleUserCreate(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	password := r.PostFormValue("password")
+	if name == "" || password == "" {
+		s.viewUsers(w, r, "Name and password are required")
+		return
+	}
+
+	role, err := database.ParseRole(r.PostFormValue("role"))
+	if err != nil {
+		s.viewUsers(w, r, "Unknown role")
+		return
+	}
+
+	user, err := s.DbMgr.CreateUser(name, password, role)
+	if err != nil {
+		log.Error().Err(err).Str("User", name).Msg("Could not create user")
+		s.viewUsers(w, r, "Could not create user "+name)
+		return
+	}
+	log.Info().Str("User", user.Name).Str("Role", string(user.Role)).Str("By", s.user(r).Name).Msg("Created user")
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+func (s *Server) HandleUserDisable(w http.ResponseWriter, r *http.Request) {
+	userStr := r.PostFormValue("userId")
+	userId, err := strconv.Atoi(userStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", userStr).Msg("Could not convert id to int")
+		http.Redirect(w, r, "/admin/users", http.StatusFound)
+		return
+	}
+	if userId == s.userId(r) {
+		s.viewUsers(w, r, "You can not disable yourself")
+		return
+	}
+
+	var disabled bool
+	err = s.DbMgr.Db.Table("users").Select("disabled").Where("id = ?", userId).Scan(&disabled).Error
+	if err == nil {
+		err = s.DbMgr.SetUserDisabled(userId, !disabled)
+	}
+	if err != nil {
+		log.Error().Err(err).Int("Id", userId).Msg("Could not disable user")
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+func (s *Server) HandleUserPassword(w http.ResponseWriter, r *http.Request) {
+	userStr := r.PostFormValue("userId")
+	userId, err := strconv.Atoi(userStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", userStr).Msg("Could not convert id to int")
+		http.Redirect(w, r, "/admin/users", http.StatusFound)
+		return
+	}
+
+	password := r.PostFormValue("password")
+	if password == "" {
+		s.viewUsers(w, r, "Password can not be empty")
+		return
+	}
+	err = s.DbMgr.SetUserPassword(userId, password)
+	if err != nil {
+		log.Error().Err(err).Int("Id", userId).Msg("Could not set password")
+		s.viewUsers(w, r, "Could not set password")
+		return
+	}
+	// Whoever knew the old password should not stay logged in
+	if userId != s.userId(r) {
+		err = s.DbMgr.DeleteUserSessions(userId)
+		if err != nil {
+			log.Error().Err(err).Int("Id", userId).Msg("Could not delete sessions")
+		}
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+func (s *Server) HandleUserRole(w http.ResponseWriter, r *http.Request) {
+	userStr := r.PostFormValue("userId")
+	userId, err := strconv.Atoi(userStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", userStr).Msg("Could not convert id to int")
+		http.Redirect(w, r, "/admin/users", http.StatusFound)
+		return
+	}
+	// Otherwise the last admin could lock everyone out of this page
+	if userId == s.userId(r) {
+		s.viewUsers(w, r, "You can not change your own role")
+		return
+	}
+	role, err := database.ParseRole(r.PostFormValue("role"))
+	if err != nil {
+		s.viewUsers(w, r, "Unknown role")
+		return
+	}
+
+	err = s.DbMgr.SetUserRole(userId, role)
+	if err != nil {
+		log.Error().Err(err).Int("Id", userId).Msg("Could not set role")
+		s.viewUsers(w, r, "Could not set role")
+		return
+	}
+	log.Info().Int("Id", userId).Str("Role", string(role)).Str("By", s.user(r).Name).Msg("Changed role")
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
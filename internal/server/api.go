@@ -0,0 +1,749 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const apiPrefix = "/api/v1"
+
+type ApiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type ApiManga struct {
+	Id             int         `json:"id"`
+	Provider       string      `json:"provider"`
+	Title          string      `json:"title"`
+	Enabled        bool        `json:"enabled"`
+	LastChapter    string      `json:"lastChapter"`
+	LastAccessUnix int64       `json:"lastAccessUnix"`
+	ThumbnailUrl   string      `json:"thumbnailUrl"`
+	Unread         int         `json:"unread"`
+	Progress       *ApiChapter `json:"progress"`
+	// UpdateInterval is empty if it is learned from the releases
+	UpdateInterval string `json:"updateInterval"`
+	Paused         bool   `json:"paused"`
+	Completed      bool   `json:"completed"`
+	NextUpdateUnix int64  `json:"nextUpdateUnix"`
+	// AutoDownload is empty if released chapters are not downloaded, KeepUnread 0 and DeleteReadAfter empty keep them
+	AutoDownload    string `json:"autoDownload"`
+	KeepUnread      int    `json:"keepUnread"`
+	DeleteReadAfter string `json:"deleteReadAfter"`
+}
+
+type ApiChapter struct {
+	Id             int    `json:"id"`
+	MangaId        int    `json:"mangaId"`
+	Url            string `json:"url"`
+	Name           string `json:"name"`
+	Number         string `json:"number"`
+	Title          string `json:"title"`
+	Volume         string `json:"volume"`
+	Scanlator      string `json:"scanlator"`
+	UploadUnix     int64  `json:"uploadUnix"`
+	LastAccessUnix int64  `json:"lastAccessUnix"`
+	Read           bool   `json:"read"`
+	ReadUnix       int64  `json:"readUnix"`
+	Page           int    `json:"page"`
+}
+
+type ApiSetting struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Default string `json:"default"`
+}
+
+type ApiReader struct {
+	Provider string   `json:"provider"`
+	Url      string   `json:"url"`
+	Title    string   `json:"title"`
+	Images   []string `json:"images"`
+	HasPrev  bool     `json:"hasPrev"`
+	HasNext  bool     `json:"hasNext"`
+}
+
+type ApiSearchResult struct {
+	Id            int    `json:"id"`
+	Provider      string `json:"provider"`
+	Title         string `json:"title"`
+	Url           string `json:"url"`
+	CoverUrl      string `json:"coverUrl"`
+	LatestChapter string `json:"latestChapter"`
+	LatestUrl     string `json:"latestUrl"`
+}
+
+type apiMangaPatch struct {
+	Enabled        *bool   `json:"enabled"`
+	UpdateInterval *string `json:"updateInterval"`
+	Paused         *bool   `json:"paused"`
+	Completed      *bool   `json:"completed"`
+
+	AutoDownload    *string `json:"autoDownload"`
+	KeepUnread      *int    `json:"keepUnread"`
+	DeleteReadAfter *string `json:"deleteReadAfter"`
+}
+
+type apiChapterPatch struct {
+	Read *bool `json:"read"`
+	Page *int  `json:"page"`
+}
+
+type apiMarkRead struct {
+	// To is the highest chapter number to mark, all chapters if it is missing
+	To   *float64 `json:"to"`
+	Read bool     `json:"read"`
+}
+
+type apiSettingPut struct {
+	Value string `json:"value"`
+}
+
+type apiOpen struct {
+	Provider string `json:"provider"`
+	Url      string `json:"url"`
+}
+
+func (s *Server) RegisterApiRoutes() {
+	s.handle("GET "+apiPrefix+"/mangas", database.RoleGuest, s.HandleApiMangas)
+	s.handle("POST "+apiPrefix+"/mangas", database.RoleReader, s.HandleApiMangaAdd)
+	s.handle("GET "+apiPrefix+"/mangas/{id}", database.RoleGuest, s.HandleApiManga)
+	s.handle("PATCH "+apiPrefix+"/mangas/{id}", database.RoleReader, s.HandleApiMangaPatch)
+	s.handle("DELETE "+apiPrefix+"/mangas/{id}", database.RoleReader, s.HandleApiMangaDelete)
+	s.handle("GET "+apiPrefix+"/mangas/{id}/chapters", database.RoleGuest, s.HandleApiChapters)
+	s.handle("GET "+apiPrefix+"/mangas/{id}/thumbnail", database.RoleGuest, s.HandleApiThumbnail)
+	s.handle("POST "+apiPrefix+"/mangas/{id}/update", database.RoleReader, s.HandleApiMangaUpdate)
+	s.handle("POST "+apiPrefix+"/mangas/{id}/read", database.RoleGuest, s.HandleApiMangaRead)
+	s.handle("PATCH "+apiPrefix+"/chapters/{id}", database.RoleGuest, s.HandleApiChapterPatch)
+	s.handle("POST "+apiPrefix+"/update", database.RoleReader, s.HandleApiUpdate)
+	s.handle("GET "+apiPrefix+"/search", database.RoleGuest, s.HandleApiSearch)
+	s.handle("GET "+apiPrefix+"/settings", database.RoleGuest, s.HandleApiSettings)
+	s.handle("GET "+apiPrefix+"/settings/{name}", database.RoleGuest, s.HandleApiSetting)
+	s.handle("PUT "+apiPrefix+"/settings/{name}", database.RoleGuest, s.HandleApiSettingPut)
+	s.handle("GET "+apiPrefix+"/progress", database.RoleGuest, s.HandleApiProgress)
+	s.handle("PUT "+apiPrefix+"/progress", database.RoleGuest, s.HandleApiProgressPut)
+	s.handle("GET "+apiPrefix+"/reader", database.RoleGuest, s.HandleApiReader)
+	s.handle("POST "+apiPrefix+"/reader", database.RoleGuest, s.HandleApiReaderOpen)
+	s.handle("DELETE "+apiPrefix+"/reader", database.RoleGuest, s.HandleApiReaderClose)
+	s.handle("POST "+apiPrefix+"/reader/next", database.RoleGuest, s.HandleApiReaderNext)
+	s.handle("POST "+apiPrefix+"/reader/prev", database.RoleGuest, s.HandleApiReaderPrev)
+	s.mux.HandleFunc(apiPrefix+"/", s.HandleApiNotFound)
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not write json")
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, ApiError{Status: status, Message: message})
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "invalid json body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func isApiRequest(r *http.Request) bool {
+	return r.URL.Path == apiPrefix || strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// apiManga loads the manga from the id path value out of the library of the user,
+// on failure the error is written and false returned
+func (s *Server) apiManga(w http.ResponseWriter, r *http.Request) (*database.Manga, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "id has to be a number")
+		return nil, false
+	}
+
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeApiError(w, http.StatusNotFound, "manga not found")
+		return nil, false
+	} else if err != nil {
+		log.Error().Err(err).Int("Id", id).Msg("Could not load manga")
+		writeApiError(w, http.StatusInternalServerError, "could not load manga")
+		return nil, false
+	}
+	return manga, true
+}
+
+func (s *Server) toApiManga(manga *database.Manga) ApiManga {
+	provider := manga.Provider
+	if p, err := s.Providers.Get(manga.Provider); err == nil {
+		provider = p.Name()
+	}
+
+	m := ApiManga{
+		Id:             manga.Id,
+		Provider:       provider,
+		Title:          manga.Title,
+		Enabled:        manga.Enabled,
+		LastChapter:    manga.LastChapterNum,
+		LastAccessUnix: manga.TimeStampUnix,
+		ThumbnailUrl:   apiPrefix + "/mangas/" + strconv.Itoa(manga.Id) + "/thumbnail",
+		Unread:         manga.UnreadCount(),
+		Paused:         manga.UpdatePaused,
+		Completed:      manga.Completed,
+		NextUpdateUnix: manga.NextUpdateUnix,
+		AutoDownload:   string(manga.AutoDownload),
+		KeepUnread:     manga.KeepUnread,
+	}
+	if manga.UpdateInterval > 0 {
+		m.UpdateInterval = formatInterval(time.Duration(manga.UpdateInterval) * time.Second)
+	}
+	if manga.DeleteReadAfter > 0 {
+		m.DeleteReadAfter = formatInterval(time.Duration(manga.DeleteReadAfter) * time.Second)
+	}
+	if latest, ok := manga.GetLatestChapter(); ok {
+		c := toApiChapter(latest)
+		m.Progress = &c
+	}
+	return m
+}
+
+func toApiChapter(chapter *database.Chapter) ApiChapter {
+	return ApiChapter{
+		Id:             chapter.Id,
+		MangaId:        chapter.MangaId,
+		Url:            chapter.Url,
+		Name:           chapter.Name,
+		Number:         chapter.Number,
+		Title:          chapter.Title,
+		Volume:         chapter.Volume,
+		Scanlator:      chapter.Scanlator,
+		UploadUnix:     chapter.UploadUnix,
+		LastAccessUnix: chapter.TimeStampUnix,
+		Read:           chapter.Read,
+		ReadUnix:       chapter.ReadUnix,
+		Page:           chapter.Page,
+	}
+}
+
+func (s *Server) HandleApiNotFound(w http.ResponseWriter, _ *http.Request) {
+	writeApiError(w, http.StatusNotFound, "not found")
+}
+
+func (s *Server) HandleApiMangas(w http.ResponseWriter, r *http.Request) {
+	var conditions []any
+	switch r.URL.Query().Get("enabled") {
+	case "":
+	case "true":
+		conditions = []any{"user_mangas.enabled = ?", true}
+	case "false":
+		conditions = []any{"user_mangas.enabled = ?", false}
+	default:
+		writeApiError(w, http.StatusBadRequest, "enabled has to be true or false")
+		return
+	}
+
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	all, err := s.DbMgr.Library(s.userId(r), conditions...)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load mangas")
+		writeApiError(w, http.StatusInternalServerError, "could not load mangas")
+		return
+	}
+
+	mangas := make([]ApiManga, 0, len(all))
+	for _, manga := range all {
+		if unreadOnly && manga.UnreadCount() == 0 {
+			continue
+		}
+		mangas = append(mangas, s.toApiManga(manga))
+	}
+	writeJson(w, http.StatusOK, mangas)
+}
+
+func (s *Server) HandleApiManga(w http.ResponseWriter, r *http.Request) {
+	manga, ok := s.apiManga(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, s.toApiManga(manga))
+}
+
+// HandleApiMangaAdd adds a title to the library, url is the title sub url as returned by the search
+func (s *Server) HandleApiMangaAdd(w http.ResponseWriter, r *http.Request) {
+	var add apiOpen
+	if !readJson(w, r, &add) {
+		return
+	}
+
+	p, err := s.Providers.Get(add.Provider)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	manga, err := s.AddToLibrary(s.userId(r), p, add.Url, "")
+	if err != nil {
+		log.Error().Err(err).Str("Url", add.Url).Msg("Could not add manga")
+		writeApiError(w, http.StatusBadGateway, "could not add manga: "+err.Error())
+		return
+	}
+	writeJson(w, http.StatusCreated, s.toApiManga(manga))
+}
+
+func (s *Server) HandleApiMangaPatch(w http.ResponseWriter, r *http.Request) {
+	manga, ok := s.apiManga(w, r)
+	if !ok {
+		return
+	}
+
+	var patch apiMangaPatch
+	if !readJson(w, r, &patch) {
+		return
+	}
+	interval := time.Duration(manga.UpdateInterval) * time.Second
+	if patch.UpdateInterval != nil {
+		var err error
+		interval, err = parseInterval(*patch.UpdateInterval)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, "invalid updateInterval: "+err.Error())
+			return
+		}
+	}
+	target := manga.AutoDownload
+	if patch.AutoDownload != nil {
+		var err error
+		target, err = database.ParseDownloadTarget(*patch.AutoDownload)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, "invalid autoDownload: "+err.Error())
+			return
+		}
+	}
+	keepUnread := manga.KeepUnread
+	if patch.KeepUnread != nil {
+		if *patch.KeepUnread < 0 {
+			writeApiError(w, http.StatusBadRequest, "keepUnread has to be positive")
+			return
+		}
+		keepUnread = *patch.KeepUnread
+	}
+	deleteReadAfter := time.Duration(manga.DeleteReadAfter) * time.Second
+	if patch.DeleteReadAfter != nil {
+		var err error
+		deleteReadAfter, err = parseInterval(*patch.DeleteReadAfter)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, "invalid deleteReadAfter: "+err.Error())
+			return
+		}
+	}
+
+	if patch.Enabled != nil {
+		manga.Enabled = *patch.Enabled
+		err := s.DbMgr.SaveUserManga(s.userId(r), manga)
+		if err != nil {
+			log.Error().Err(err).Int("Id", manga.Id).Msg("Could not update manga")
+			writeApiError(w, http.StatusInternalServerError, "could not update manga")
+			return
+		}
+	}
+
+	if patch.UpdateInterval != nil || patch.Paused != nil || patch.Completed != nil {
+		paused, completed := manga.UpdatePaused, manga.Completed
+		if patch.Paused != nil {
+			paused = *patch.Paused
+		}
+		if patch.Completed != nil {
+			completed = *patch.Completed
+		}
+		err := s.setUpdateSchedule(manga, interval, paused, completed)
+		if err != nil {
+			log.Error().Err(err).Int("Id", manga.Id).Msg("Could not save update schedule")
+			writeApiError(w, http.StatusInternalServerError, "could not update manga")
+			return
+		}
+	}
+
+	if patch.AutoDownload != nil || patch.KeepUnread != nil || patch.DeleteReadAfter != nil {
+		err := s.setAutoDownloadRule(manga, target, keepUnread, deleteReadAfter)
+		if err != nil {
+			log.Error().Err(err).Int("Id", manga.Id).Msg("Could not save auto download rule")
+			writeApiError(w, http.StatusInternalServerError, "could not update manga")
+			return
+		}
+	}
+	writeJson(w, http.StatusOK, s.toApiManga(manga))
+}
+
+func (s *Server) HandleApiMangaDelete(w http.ResponseWriter, r *http.Request) {
+	manga, ok := s.apiManga(w, r)
+	if !ok {
+		return
+	}
+	err := s.RemoveFromLibrary(s.userId(r), manga.Id)
+	if err != nil {
+		log.Error().Err(err).Int("Id", manga.Id).Msg("Could not delete manga")
+		writeApiError(w, http.StatusInternalServerError, "could not delete manga")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) HandleApiChapters(w http.ResponseWriter, r *http.Request) {
+	manga, ok := s.apiManga(w, r)
+	if !ok {
+		return
+	}
+
+	chapters := make([]ApiChapter, len(manga.Chapters))
+	for i := range manga.Chapters {
+		chapters[i] = toApiChapter(&manga.Chapters[i])
+	}
+	writeJson(w, http.StatusOK, chapters)
+}
+
+func (s *Server) HandleApiThumbnail(w http.ResponseWriter, r *http.Request) {
+	manga, ok := s.apiManga(w, r)
+	if !ok {
+		return
+	}
+
+	key, updated, err := s.LoadThumbnail(manga)
+	if err != nil {
+		log.Error().Err(err).Int("Id", manga.Id).Msg("Could not load thumbnail")
+		writeApiError(w, http.StatusBadGateway, "could not load thumbnail")
+		return
+	}
+	if updated {
+		s.DbMgr.SaveMangaUpdate(manga)
+	}
+
+	buf, ok := s.Images.Get(key)
+	if !ok {
+		buf = manga.Thumbnail
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(buf))
+	_, err = w.Write(buf)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not write thumbnail")
+	}
+}
+
+func (s *Server) HandleApiMangaUpdate(w http.ResponseWriter, r *http.Request) {
+	manga, ok := s.apiManga(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := s.Updates.Refresh(r.Context(), manga)
+	if err != nil {
+		writeApiError(w, http.StatusBadGateway, "could not update manga: "+err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, s.toApiManga(manga))
+}
+
+func (s *Server) HandleApiMangaRead(w http.ResponseWriter, r *http.Request) {
+	manga, ok := s.apiManga(w, r)
+	if !ok {
+		return
+	}
+
+	var mark apiMarkRead
+	if !readJson(w, r, &mark) {
+		return
+	}
+
+	to := math.Inf(1)
+	if mark.To != nil {
+		to = *mark.To
+	}
+	err := s.MarkReadUpTo(s.userId(r), manga, to, mark.Read)
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not mark chapters")
+		writeApiError(w, http.StatusInternalServerError, "could not mark chapters")
+		return
+	}
+	writeJson(w, http.StatusOK, s.toApiManga(manga))
+}
+
+func (s *Server) HandleApiChapterPatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "id has to be a number")
+		return
+	}
+
+	var patch apiChapterPatch
+	if !readJson(w, r, &patch) {
+		return
+	}
+
+	// Only chapters of mangas in the library of the user can be changed
+	chapter, err := s.DbMgr.LibraryChapter(s.userId(r), id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeApiError(w, http.StatusNotFound, "chapter not found")
+		return
+	} else if err != nil {
+		log.Error().Err(err).Int("Id", id).Msg("Could not load chapter")
+		writeApiError(w, http.StatusInternalServerError, "could not load chapter")
+		return
+	}
+
+	if patch.Read != nil {
+		err = s.SetChapterRead(s.userId(r), chapter, *patch.Read)
+	}
+	if err == nil && patch.Page != nil {
+		chapter.Page = *patch.Page
+		err = s.DbMgr.SaveUserChapter(s.userId(r), chapter)
+	}
+	if err != nil {
+		log.Error().Err(err).Int("Id", id).Msg("Could not update chapter")
+		writeApiError(w, http.StatusInternalServerError, "could not update chapter")
+		return
+	}
+	writeJson(w, http.StatusOK, toApiChapter(chapter))
+}
+
+func (s *Server) HandleApiUpdate(w http.ResponseWriter, _ *http.Request) {
+	s.background(func(ctx context.Context) {
+		s.UpdateMangaList(ctx, database.UpdateManual)
+	})
+	writeJson(w, http.StatusAccepted, struct {
+		Message string `json:"message"`
+	}{"update started"})
+}
+
+func (s *Server) HandleApiSearch(w http.ResponseWriter, r *http.Request) {
+	query := searchQuery(r)
+	p, results, err := s.search(r.FormValue("provider"), query)
+	if err != nil {
+		log.Error().Err(err).Str("Query", query.Query).Msg("Could not search")
+		writeApiError(w, http.StatusBadGateway, "could not search: "+err.Error())
+		return
+	}
+
+	apiResults := make([]ApiSearchResult, len(results))
+	for i, result := range results {
+		apiResults[i] = ApiSearchResult{
+			Id:            result.Id,
+			Provider:      p.Name(),
+			Title:         result.Title,
+			Url:           result.SubUrl,
+			LatestChapter: result.LatestChapter,
+			LatestUrl:     result.LatestSubUrl,
+		}
+		if result.CoverUrl != "" {
+			apiResults[i].CoverUrl = "/search/cover/" + s.Covers.Add(p, result.CoverUrl)
+		}
+	}
+	writeJson(w, http.StatusOK, apiResults)
+}
+
+func (s *Server) HandleApiSettings(w http.ResponseWriter, r *http.Request) {
+	all := s.UserSettings(s.userId(r))
+	settings := make([]ApiSetting, 0, len(all))
+	for _, setting := range all {
+		settings = append(settings, ApiSetting{Name: setting.Name, Value: setting.Value, Default: setting.Default})
+	}
+	slices.SortFunc(settings, func(a, b ApiSetting) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	writeJson(w, http.StatusOK, settings)
+}
+
+func (s *Server) HandleApiSetting(w http.ResponseWriter, r *http.Request) {
+	setting, ok := s.UserSettings(s.userId(r))[r.PathValue("name")]
+	if !ok {
+		writeApiError(w, http.StatusNotFound, "setting not found")
+		return
+	}
+	writeJson(w, http.StatusOK, ApiSetting{Name: setting.Name, Value: setting.Value, Default: setting.Default})
+}
+
+func (s *Server) HandleApiSettingPut(w http.ResponseWriter, r *http.Request) {
+	var put apiSettingPut
+	if !readJson(w, r, &put) {
+		return
+	}
+
+	name := r.PathValue("name")
+	err := s.SaveSetting(s.user(r), name, put.Value)
+	if errors.Is(err, errNotAdmin) {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("Setting", name).Msg("Could not save setting")
+		writeApiError(w, http.StatusInternalServerError, "could not save setting")
+		return
+	}
+	s.HandleApiSetting(w, r)
+}
+
+func (s *Server) HandleApiProgress(w http.ResponseWriter, r *http.Request) {
+	all, err := s.DbMgr.Library(s.userId(r))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load mangas")
+		writeApiError(w, http.StatusInternalServerError, "could not load progress")
+		return
+	}
+
+	progress := make([]ApiChapter, 0, len(all))
+	for _, manga := range all {
+		if latest, ok := manga.GetLatestChapter(); ok {
+			progress = append(progress, toApiChapter(latest))
+		}
+	}
+	writeJson(w, http.StatusOK, progress)
+}
+
+// HandleApiProgressPut records a chapter as opened without opening it in a reader
+func (s *Server) HandleApiProgressPut(w http.ResponseWriter, r *http.Request) {
+	var put apiOpen
+	if !readJson(w, r, &put) {
+		return
+	}
+
+	p, err := s.Providers.Get(put.Provider)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = s.SaveProgress(s.userId(r), p, put.Url)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "could not save progress: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) writeApiReader(w http.ResponseWriter, rd *Reader) {
+	rd.Mutex.Lock()
+	defer rd.Mutex.Unlock()
+	if rd.Provider == nil || rd.CurrViewModel == nil {
+		writeApiError(w, http.StatusNotFound, "no chapter opened")
+		return
+	}
+
+	reader := ApiReader{
+		Provider: rd.Provider.Name(),
+		Url:      rd.CurrSubUrl,
+		Title:    rd.CurrViewModel.Title,
+		Images:   make([]string, len(rd.CurrViewModel.Images)),
+		HasPrev:  rd.PrevViewModel != nil,
+		HasNext:  rd.NextViewModel != nil,
+	}
+	for i, img := range rd.CurrViewModel.Images {
+		reader.Images[i] = "/img/" + img.Path
+	}
+	writeJson(w, http.StatusOK, reader)
+}
+
+func (s *Server) HandleApiReader(w http.ResponseWriter, r *http.Request) {
+	rd, ok := s.Readers.Lookup(r)
+	if !ok {
+		writeApiError(w, http.StatusNotFound, "no chapter opened")
+		return
+	}
+	s.writeApiReader(w, rd)
+}
+
+func (s *Server) HandleApiReaderOpen(w http.ResponseWriter, r *http.Request) {
+	var open apiOpen
+	if !readJson(w, r, &open) {
+		return
+	}
+
+	p, ok := s.Providers.FromUrl(open.Url)
+	if !ok {
+		var err error
+		p, err = s.Providers.Get(open.Provider)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	url := "/title/" + p.CleanUrlToSub(open.Url)
+	rd := s.Readers.Get(w, r)
+	err := rd.Open(p, url)
+	if err != nil {
+		log.Error().Err(err).Str("Url", url).Msg("Could not load current chapter")
+		writeApiError(w, http.StatusBadGateway, "could not load chapter: "+err.Error())
+		return
+	}
+
+	_, err = s.SaveProgress(s.userId(r), p, url)
+	if err != nil {
+		log.Error().Err(err).Str("subUrl", url).Msg("Could not save progress")
+	}
+	s.writeApiReader(w, rd)
+}
+
+func (s *Server) HandleApiReaderClose(w http.ResponseWriter, r *http.Request) {
+	if rd, ok := s.Readers.Lookup(r); ok {
+		rd.Close()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) HandleApiReaderNext(w http.ResponseWriter, r *http.Request) {
+	s.apiReaderMove(w, r, true)
+}
+
+func (s *Server) HandleApiReaderPrev(w http.ResponseWriter, r *http.Request) {
+	s.apiReaderMove(w, r, false)
+}
+
+func (s *Server) apiReaderMove(w http.ResponseWriter, r *http.Request, next bool) {
+	rd, ok := s.Readers.Lookup(r)
+	if !ok {
+		writeApiError(w, http.StatusNotFound, "no chapter opened")
+		return
+	}
+
+	p, subUrl, _ := rd.Current()
+	var moved bool
+	if next {
+		moved = rd.Next(r.Context())
+	} else {
+		moved = rd.Prev(r.Context())
+	}
+	if !moved {
+		writeApiError(w, http.StatusConflict, "no chapter to move to")
+		return
+	}
+
+	if next {
+		err := s.MarkChapterRead(s.userId(r), p, subUrl)
+		if err != nil {
+			log.Error().Err(err).Str("subUrl", subUrl).Msg("Could not mark chapter as read")
+		}
+	}
+
+	p, subUrl, _ = rd.Current()
+	_, err := s.SaveProgress(s.userId(r), p, subUrl)
+	if err != nil {
+		log.Error().Err(err).Str("subUrl", subUrl).Msg("Could not save progress")
+	}
+	s.writeApiReader(w, rd)
+}
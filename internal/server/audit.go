@@ -0,0 +1,77 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// auditPageSize is the number of events on one page of /admin/audit
+const auditPageSize = 100
+
+// audit stores an auth event and logs it
+func (s *Server) audit(r *http.Request, eventType database.AuthEventType, userId int, name string, detail string) {
+	address := remoteAddress(r)
+	event := database.NewAuthEvent(eventType, userId, name, address, r.UserAgent(), detail, time.Now().Unix())
+
+	var e *zerolog.Event
+	switch eventType {
+	case database.AuthFailure, database.AuthLockout:
+		e = log.Warn()
+	default:
+		e = log.Info()
+	}
+	e.Str("Event", string(eventType)).Str("User", name).Int("UserId", userId).Str("Address", address).
+		Str("UserAgent", r.UserAgent()).Str("Detail", detail).Msg("Auth")
+
+	err := s.DbMgr.AddAuthEvent(&event)
+	if err != nil {
+		log.Error().Err(err).Str("Event", string(eventType)).Msg("Could not save auth event")
+	}
+}
+
+func (s *Server) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(view.GetViewTemplate(view.Audit))
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// One more than shown tells if there is a next page
+	events, err := s.DbMgr.AuthEvents((page-1)*auditPageSize, auditPageSize+1)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load auth events")
+	}
+
+	viewModel := view.AuditViewModel{
+		Csrf:     csrfToken(r),
+		Settings: s.Settings(),
+		Page:     page,
+		HasPrev:  page > 1,
+		HasNext:  len(events) > auditPageSize,
+		PrevPage: page - 1,
+		NextPage: page + 1,
+	}
+	for _, event := range events[:min(len(events), auditPageSize)] {
+		viewModel.Events = append(viewModel.Events, view.AuthEventViewModel{
+			Time:      time.Unix(event.TimeUnix, 0).Format("15:04:05 (02-01-06)"),
+			Type:      string(event.Type),
+			Name:      event.Name,
+			Address:   event.Address,
+			UserAgent: event.UserAgent,
+			Detail:    event.Detail,
+		})
+	}
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Audit")
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const sessionCookie = "session"
+
+// sessionTouchInterval limits how often the last seen time and expiry of a session are written
+const sessionTouchInterval = time.Minute
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	sessionKey
+	csrfKey
+)
+
+// dummyHash is compared against when a user does not exist, so unknown names take as long as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("mangaGetter"), bcrypt.DefaultCost)
+
+// user returns the user of the request, set by the Auth middleware. With auth enabled it is nil for requests
+// nobody is logged in on, like the login page
+func (s *Server) user(r *http.Request) *database.User {
+	if user, ok := r.Context().Value(userKey).(*database.User); ok && user != nil {
+		return user
+	}
+	if !s.options.Auth.Enabled {
+		return s.defaultUser
+	}
+	return nil
+}
+
+func (s *Server) userId(r *http.Request) int {
+	if user := s.user(r); user != nil {
+		return user.Id
+	}
+	return 0
+}
+
+// session returns the session of the request, nil if auth is disabled
+func (s *Server) session(r *http.Request) *database.Session {
+	session, _ := r.Context().Value(sessionKey).(*database.Session)
+	return session
+}
+
+func withUser(r *http.Request, user *database.User, session *database.Session) *http.Request {
+	ctx := context.WithValue(r.Context(), userKey, user)
+	if session != nil {
+		ctx = context.WithValue(ctx, sessionKey, session)
+	}
+	return r.WithContext(ctx)
+}
+
+// setupUsers creates the first admin if there are no users yet and gives them the library from before there were
+// users. The secret becomes the password of that admin, it is used for every request if auth is disabled
+func (s *Server) setupUsers() error {
+	var admin database.User
+	err := s.DbMgr.Db.Where("role = ?", database.RoleAdmin).Order("id").First(&admin).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		created, err := s.DbMgr.CreateUser("admin", s.secret, database.RoleAdmin)
+		if err != nil {
+			return err
+		}
+		admin = *created
+		log.Info().Str("User", admin.Name).Msg("Created admin user")
+	} else if err != nil {
+		return err
+	} else if admin.PasswordHash == "" && s.secret != "" {
+		err = s.DbMgr.SetUserPassword(admin.Id, s.secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.DbMgr.MigrateLibrary(admin.Id)
+	if err != nil {
+		return err
+	}
+	s.defaultUser = &admin
+	return nil
+}
+
+// newToken returns a random token and the hash it is stored as
+func newToken() (token string, hash string, err error) {
+	buf := make([]byte, 32)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionUser returns the logged in user of the session cookie, nil if there is none.
+// Every use of the session moves its expiry MaxAge seconds into the future
+func (s *Server) sessionUser(w http.ResponseWriter, r *http.Request) (*database.User, *database.Session) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	user, session, err := s.DbMgr.SessionUser(hashToken(cookie.Value), now.Unix())
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error().Err(err).Msg("Could not load session")
+		}
+		return nil, nil
+	}
+
+	address := remoteAddress(r)
+	if now.Unix()-session.LastSeenUnix >= int64(sessionTouchInterval/time.Second) || session.Address != address {
+		maxAge := s.options.Auth.Get().MaxAge
+		err = s.DbMgr.TouchSession(session, address, now.Unix(), now.Add(time.Duration(maxAge)*time.Second).Unix())
+		if err != nil {
+			log.Error().Err(err).Msg("Could not update session")
+		} else {
+			s.setSessionCookie(w, cookie.Value, maxAge)
+		}
+	}
+	return user, session
+}
+
+// remoteAddress returns the ip of the client without the port
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// deviceLabel guesses a name for the device from its UserAgent, like "Firefox on Linux"
+func deviceLabel(userAgent string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Windows", "Windows"},
+		{"Mac OS", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			return browser + " on " + o.name
+		}
+	}
+	return browser
+}
+
+func (s *Server) setSessionCookie(w http.ResponseWriter, token string, maxAge int) {
+	auth := s.options.Auth.Get()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   auth.Secure || s.options.Tls.Enabled,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	// The proxy already logged the user in
+	if s.options.Auth.Get().Mode == ProxyAuth {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	s.viewLogin(w, r, http.StatusOK, view.LoginViewModel{})
+}
+
+func (s *Server) viewLogin(w http.ResponseWriter, r *http.Request, status int, viewModel view.LoginViewModel) {
+	tmpl := template.Must(view.GetViewTemplate(view.Login))
+	viewModel.Csrf = csrfToken(r)
+	viewModel.Sso = s.oidc != nil
+	w.WriteHeader(status)
+	err := tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Login")
+	}
+}
+
+func (s *Server) HandleLoginPost(w http.ResponseWriter, r *http.Request) {
+	if !s.options.Auth.Enabled || s.options.Auth.Get().Mode == ProxyAuth {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	password := r.PostFormValue("password")
+
+	// Names are limited independent of the address, so spreading guesses over many addresses does not help
+	now := time.Now()
+	address := remoteAddress(r)
+	nameKey := strings.ToLower(name)
+	if wait := max(s.AddressLogins.Locked(address, now), s.NameLogins.Locked(nameKey, now)); wait > 0 {
+		log.Warn().Str("User", name).Str("Address", address).Dur("Wait", wait).Msg("Rejected login while locked out")
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		s.viewLogin(w, r, http.StatusTooManyRequests, view.LoginViewModel{Name: name, Label: r.PostFormValue("label"),
+			Error: "Too many failed logins, try again in " + wait.Round(time.Second).String()})
+		return
+	}
+
+	user, err := s.DbMgr.UserByName(name)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error().Err(err).Str("User", name).Msg("Could not load user")
+		}
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		user = nil
+	}
+	if user == nil || !user.CheckPassword(password) || user.Disabled {
+		userId, detail := 0, "unknown user"
+		if user != nil {
+			userId, detail = user.Id, "wrong password"
+			if user.Disabled {
+				detail = "user is disabled"
+			}
+		}
+		s.audit(r, database.AuthFailure, userId, name, detail)
+
+		lockout := max(s.AddressLogins.Fail(address, now), s.NameLogins.Fail(nameKey, now))
+		if lockout > 0 {
+			s.audit(r, database.AuthLockout, userId, name, "locked for "+lockout.String())
+		}
+		s.viewLogin(w, r, http.StatusUnauthorized, view.LoginViewModel{Name: name, Label: r.PostFormValue("label"), Error: "Wrong user or password"})
+		return
+	}
+
+	label := strings.TrimSpace(r.PostFormValue("label"))
+	if label == "" {
+		label = deviceLabel(r.UserAgent())
+	}
+	err = s.startSession(w, r, user, label)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save session")
+		s.viewLogin(w, r, http.StatusInternalServerError, view.LoginViewModel{Name: name, Label: r.PostFormValue("label"), Error: "Could not log in"})
+		return
+	}
+
+	s.AddressLogins.Reset(address)
+	s.NameLogins.Reset(nameKey)
+	s.audit(r, database.AuthSuccess, user.Id, user.Name, label)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// startSession logs user in on the browser of the request
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *database.User, label string) error {
+	token, id, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	maxAge := s.options.Auth.Get().MaxAge
+	session := database.NewSession(id, user.Id, label, remoteAddress(r), r.UserAgent(),
+		now.Unix(), now.Add(time.Duration(maxAge)*time.Second).Unix())
+	err = s.DbMgr.CreateSession(&session)
+	if err != nil {
+		return err
+	}
+	err = s.DbMgr.DeleteExpiredSessions(now.Unix())
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not delete expired sessions")
+	}
+	s.setSessionCookie(w, token, maxAge)
+	return nil
+}
+
+func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if s.session(r) != nil {
+		s.audit(r, database.AuthLogout, s.userId(r), s.user(r).Name, "")
+	}
+	s.endSession(w, r)
+}
+
+// endSession deletes the session of the request and sends the browser to the login
+func (s *Server) endSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		err = s.DbMgr.DeleteSession(hashToken(cookie.Value))
+		if err != nil {
+			log.Error().Err(err).Msg("Could not delete session")
+		}
+	}
+	if rd, ok := s.Readers.Lookup(r); ok {
+		rd.Close()
+	}
+	s.setSessionCookie(w, "", -1)
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
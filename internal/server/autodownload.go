@@ -0,0 +1,272 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// retentionInterval is how often the retention policies of all mangas are applied
+const retentionInterval = time.Hour
+
+// autoDownload queues the chapters an update released if the manga downloads them automatically
+func (s *Server) autoDownload(manga *database.Manga, released []database.Chapter) {
+	if manga.AutoDownload == "" || len(released) == 0 {
+		return
+	}
+	if s.Downloader == nil {
+		log.Warn().Str("Manga", manga.Title).Msg("Downloads are disabled, not downloading released chapters")
+		return
+	}
+	p, err := s.Providers.Get(manga.Provider)
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not download released chapters")
+		return
+	}
+
+	for _, chapter := range released {
+		// Chapters found on the first sync were out before the manga was added, so they are not new
+		if chapter.DiscoveredUnix == 0 {
+			continue
+		}
+		s.Downloader.EnqueueAuto(p, chapter.Url, manga.AutoDownload)
+	}
+}
+
+// recordAutoDownload remembers a chapter the updater downloaded, so the retention policy of its manga can delete it again
+func (s *Server) recordAutoDownload(job *DownloadJob) {
+	if !job.Auto || job.ChapterId == 0 {
+		return
+	}
+
+	download := database.AutoDownload{
+		ChapterId:   job.ChapterId,
+		MangaId:     job.MangaId,
+		Number:      job.Chapter,
+		Target:      job.Target,
+		CreatedUnix: time.Now().Unix(),
+		Path:        job.Path,
+		Keys:        strings.Join(job.Keys, "\n"),
+	}
+
+	var manga database.Manga
+	err := s.DbMgr.Db.First(&manga, job.MangaId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Removed from the last library while it was downloading
+		err = s.removeDownloadFiles(download)
+		if err != nil {
+			log.Error().Err(err).Str("Url", job.SubUrl).Msg("Could not delete downloaded chapter")
+		}
+		return
+	} else if err != nil {
+		log.Error().Err(err).Int("Id", job.MangaId).Msg("Could not find manga")
+		return
+	}
+
+	err = s.DbMgr.SaveAutoDownload(&download)
+	if err != nil {
+		log.Error().Err(err).Str("Url", job.SubUrl).Msg("Could not save auto download")
+		return
+	}
+	err = s.applyRetention(&manga, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not apply retention policy")
+	}
+}
+
+func (s *Server) registerRetention() {
+	s.background(func(ctx context.Context) {
+		for {
+			mangas, err := s.DbMgr.RetainedMangas()
+			if err != nil {
+				log.Error().Err(err).Msg("Could not load mangas with a retention policy")
+			}
+			for _, manga := range mangas {
+				err = s.applyRetention(manga, time.Now())
+				if err != nil {
+					log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not apply retention policy")
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retentionInterval):
+			}
+		}
+	})
+}
+
+// applyRetention deletes the automatically downloaded chapters of manga its retention policy no longer keeps.
+// A chapter is read once every user with the manga in their library has read it
+func (s *Server) applyRetention(manga *database.Manga, now time.Time) error {
+	if manga.KeepUnread <= 0 && manga.DeleteReadAfter <= 0 {
+		return nil
+	}
+	downloads, err := s.DbMgr.AutoDownloads(manga.Id)
+	if err != nil || len(downloads) == 0 {
+		return err
+	}
+	read, err := s.DbMgr.ReadByAll(manga.Id)
+	if err != nil {
+		return err
+	}
+
+	var expired, unread []database.AutoDownload
+	for _, download := range downloads {
+		readUnix, ok := read[download.ChapterId]
+		switch {
+		case !ok:
+			unread = append(unread, download)
+		case manga.DeleteReadAfter > 0 && now.Unix()-readUnix >= manga.DeleteReadAfter:
+			expired = append(expired, download)
+		}
+	}
+	if manga.KeepUnread > 0 && len(unread) > manga.KeepUnread {
+		// The newest chapters are kept
+		slices.SortFunc(unread, func(a, b database.AutoDownload) int {
+			an, _ := a.NumberValue()
+			bn, _ := b.NumberValue()
+			return cmp.Or(cmp.Compare(bn, an), cmp.Compare(b.CreatedUnix, a.CreatedUnix))
+		})
+		expired = append(expired, unread[manga.KeepUnread:]...)
+	}
+
+	for _, download := range expired {
+		err = s.deleteAutoDownload(download)
+		if err != nil {
+			return err
+		}
+		log.Info().Str("Manga", manga.Title).Str("Chapter", download.Number).Str("Target", string(download.Target)).
+			Msg("Deleted downloaded chapter")
+	}
+	return nil
+}
+
+func (s *Server) deleteAutoDownload(download database.AutoDownload) error {
+	err := s.removeDownloadFiles(download)
+	if err != nil {
+		return err
+	}
+	return s.DbMgr.DeleteAutoDownload(download.ChapterId)
+}
+
+// removeDownloadFiles deletes the CBZ file or the cached images of an automatically downloaded chapter
+func (s *Server) removeDownloadFiles(download database.AutoDownload) error {
+	switch download.Target {
+	case database.DownloadCbz:
+		err := os.Remove(download.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	case database.DownloadCache:
+		// Without the disk cache the images are gone already
+		if s.Fetcher.Disk != nil && download.Keys != "" {
+			return s.Fetcher.Disk.Remove(strings.Split(download.Keys, "\n"))
+		}
+	}
+	return nil
+}
+
+// RemoveFromLibrary removes the manga from the library of the user,
+// once nobody has it in their library anymore the chapters it downloaded automatically are deleted as well
+func (s *Server) RemoveFromLibrary(userId int, mangaId int) error {
+	downloads, err := s.DbMgr.RemoveFromLibrary(userId, mangaId)
+	if err != nil {
+		return err
+	}
+	for _, download := range downloads {
+		// The manga is gone, retention would never get to these files again
+		err = s.removeDownloadFiles(download)
+		if err != nil {
+			log.Error().Err(err).Int("Manga", mangaId).Str("Chapter", download.Number).Msg("Could not delete downloaded chapter")
+		}
+	}
+	return nil
+}
+
+func (s *Server) HandleMangaAutoDownload(w http.ResponseWriter, r *http.Request) {
+	defer redirectBack(w, r)
+
+	mangaStr := r.PostFormValue("mangaId")
+	mangaId, err := strconv.Atoi(mangaStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not convert id to int")
+		return
+	}
+	target, err := database.ParseDownloadTarget(r.PostFormValue("target"))
+	if err != nil {
+		log.Warn().Err(err).Msg("Invalid auto download target")
+		return
+	}
+	keep, err := parseKeepUnread(r.PostFormValue("keepUnread"))
+	if err != nil {
+		log.Warn().Err(err).Str("KeepUnread", r.PostFormValue("keepUnread")).Msg("Invalid number of unread chapters")
+		return
+	}
+	after, err := parseInterval(r.PostFormValue("deleteReadAfter"))
+	if err != nil {
+		log.Warn().Err(err).Str("DeleteReadAfter", r.PostFormValue("deleteReadAfter")).Msg("Invalid retention")
+		return
+	}
+
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not find manga")
+		return
+	}
+
+	err = s.setAutoDownloadRule(manga, target, keep, after)
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not save auto download rule")
+	}
+}
+
+// setAutoDownloadRule changes where the released chapters of manga are downloaded to and applies the new retention policy
+func (s *Server) setAutoDownloadRule(manga *database.Manga, target database.DownloadTarget, keepUnread int, deleteReadAfter time.Duration) error {
+	manga.AutoDownload = target
+	manga.KeepUnread = keepUnread
+	manga.DeleteReadAfter = int64(deleteReadAfter / time.Second)
+	err := s.DbMgr.SaveAutoDownloadRule(manga)
+	if err != nil {
+		return err
+	}
+	return s.applyRetention(manga, time.Now())
+}
+
+func autoDownloadViewModel(manga *database.Manga) view.AutoDownloadViewModel {
+	viewModel := view.AutoDownloadViewModel{
+		Target: string(manga.AutoDownload),
+	}
+	if manga.KeepUnread > 0 {
+		viewModel.KeepUnread = strconv.Itoa(manga.KeepUnread)
+	}
+	if manga.DeleteReadAfter > 0 {
+		viewModel.DeleteReadAfter = formatInterval(time.Duration(manga.DeleteReadAfter) * time.Second)
+	}
+	return viewModel
+}
+
+// parseKeepUnread reads how many unread chapters are kept, empty is 0 and keeps all
+func parseKeepUnread(text string) (int, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, nil
+	}
+	keep, err := strconv.Atoi(text)
+	if err != nil || keep < 0 {
+		return 0, errors.New("has to be a positive number")
+	}
+	return keep, nil
+}
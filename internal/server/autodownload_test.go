@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+)
+
+// addTestDownload records chapter of manga as downloaded automatically into a CBZ file in dir
+func addTestDownload(t *testing.T, s *Server, dir string, manga *database.Manga, chapter database.Chapter) database.AutoDownload {
+	t.Helper()
+	path := filepath.Join(dir, manga.Title+" "+chapter.Number+".cbz")
+	err := os.WriteFile(path, []byte("cbz"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := database.AutoDownload{
+		ChapterId:   chapter.Id,
+		MangaId:     manga.Id,
+		Number:      chapter.Number,
+		Target:      database.DownloadCbz,
+		CreatedUnix: time.Now().Unix(),
+		Path:        path,
+	}
+	err = s.DbMgr.SaveAutoDownload(&download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return download
+}
+
+func TestRemoveFromLibraryDeletesDownloads(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	other, err := s.DbMgr.CreateUser("other", "hunter2", database.RoleReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manga := addTestManga(t, s, s.defaultUser.Id, "shared", 3, 0)
+	err = s.DbMgr.AddToLibrary(other.Id, manga.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manga.AutoDownload = database.DownloadCbz
+	manga.KeepUnread = 2
+	err = s.DbMgr.SaveAutoDownloadRule(manga)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloads []database.AutoDownload
+	for _, chapter := range manga.Chapters {
+		downloads = append(downloads, addTestDownload(t, s, dir, manga, chapter))
+	}
+	kept := addTestManga(t, s, other.Id, "kept", 1, 0)
+	keptDownload := addTestDownload(t, s, dir, kept, kept.Chapters[0])
+
+	check := func(wantManga bool, wantFiles bool) {
+		t.Helper()
+		var mangas, rows int64
+		s.DbMgr.Db.Model(&database.Manga{}).Where("id = ?", manga.Id).Count(&mangas)
+		s.DbMgr.Db.Model(&database.AutoDownload{}).Where("manga_id = ?", manga.Id).Count(&rows)
+		if (mangas == 1) != wantManga {
+			t.Errorf("manga exists %t, want %t", mangas == 1, wantManga)
+		}
+		if wantFiles && rows != int64(len(downloads)) || !wantFiles && rows != 0 {
+			t.Errorf("%d auto downloads are left, want files %t", rows, wantFiles)
+		}
+		for _, download := range downloads {
+			_, err := os.Stat(download.Path)
+			if (err == nil) != wantFiles {
+				t.Errorf("%s exists %t, want %t", download.Path, err == nil, wantFiles)
+			}
+		}
+		_, err := os.Stat(keptDownload.Path)
+		if err != nil {
+			t.Errorf("download of another manga was deleted: %v", err)
+		}
+	}
+
+	err = s.RemoveFromLibrary(other.Id, manga.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Still in the library of the default user
+	check(true, true)
+
+	rec := serve(s, http.MethodPost, "/delete", url.Values{"mangaId": {strconv.Itoa(manga.Id)}}.Encode())
+	if rec.Code != http.StatusFound {
+		t.Fatalf("POST /delete = %d", rec.Code)
+	}
+	check(false, false)
+
+	t.Run("finished after removal", func(t *testing.T) {
+		path := filepath.Join(dir, "late.cbz")
+		err := os.WriteFile(path, []byte("cbz"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.recordAutoDownload(&DownloadJob{
+			Auto:      true,
+			MangaId:   manga.Id,
+			ChapterId: manga.Chapters[0].Id,
+			Chapter:   "1",
+			Target:    database.DownloadCbz,
+			Path:      path,
+		})
+
+		var rows int64
+		s.DbMgr.Db.Model(&database.AutoDownload{}).Where("manga_id = ?", manga.Id).Count(&rows)
+		_, err = os.Stat(path)
+		if rows != 0 || !os.IsNotExist(err) {
+			t.Errorf("download of a removed manga was kept: %d rows, file %v", rows, err)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/cache"
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+)
+
+func (s *Server) openDiskCache() error {
+	opts := s.options.DiskCache.Get()
+	disk, err := cache.NewDisk(opts.Path, opts.MaxSize, opts.MaxAge, s.DbMgr)
+	if err != nil {
+		return err
+	}
+	s.Fetcher.Disk = disk
+	log.Info().Str("Path", opts.Path).Int64("MaxSize", opts.MaxSize).Str("MaxAge", opts.MaxAge.String()).Msg("Using disk cache")
+
+	s.background(func(ctx context.Context) {
+		for {
+			err := disk.Cleanup()
+			if err != nil {
+				log.Error().Err(err).Msg("Could not clean up disk cache")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Hour):
+			}
+		}
+	})
+	return nil
+}
+
+func (s *Server) HandleCache(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(view.GetViewTemplate(view.Cache))
+
+	stats := s.Images.Stats()
+	viewModel := view.CacheViewModel{
+		Csrf:          csrfToken(r),
+		Admin:         s.user(r).Can(database.RoleAdmin),
+		MemorySize:    formatBytes(stats.Size),
+		MemoryBudget:  formatLimit(stats.Budget),
+		MemoryEntries: stats.Entries,
+		MemoryPinned:  stats.Pinned,
+		Hits:          stats.Hits,
+		Misses:        stats.Misses,
+		Evictions:     stats.Evictions,
+	}
+
+	if disk := s.Fetcher.Disk; disk != nil {
+		viewModel.DiskEnabled = true
+		viewModel.DiskPath = disk.Path
+		viewModel.DiskSize = formatBytes(disk.Size())
+		viewModel.DiskMaxSize = formatLimit(disk.MaxSize)
+		if disk.MaxAge > 0 {
+			viewModel.DiskMaxAge = disk.MaxAge.String()
+		}
+
+		usage, err := disk.Usage()
+		if err != nil {
+			log.Error().Err(err).Msg("Could not get disk cache usage")
+		}
+		for _, u := range usage {
+			var manga database.Manga
+			title := "Unknown"
+			if s.DbMgr.Db.Select("id", "title").First(&manga, u.MangaId).Error == nil {
+				title = manga.Title
+			}
+			viewModel.Mangas = append(viewModel.Mangas, view.CacheMangaViewModel{
+				ID:      u.MangaId,
+				Title:   title,
+				Entries: u.Entries,
+				Size:    formatBytes(u.Size),
+			})
+		}
+	}
+
+	err := tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Cache")
+	}
+}
+
+func (s *Server) HandleCachePurge(w http.ResponseWriter, r *http.Request) {
+	disk := s.Fetcher.Disk
+	if disk == nil {
+		http.Redirect(w, r, "/cache", http.StatusFound)
+		return
+	}
+
+	mangaStr := r.PostFormValue("mangaId")
+	var err error
+	if mangaStr == "" {
+		err = disk.Purge()
+	} else {
+		var mangaId int
+		mangaId, err = strconv.Atoi(mangaStr)
+		if err == nil {
+			err = disk.PurgeManga(mangaId)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not purge disk cache")
+	}
+
+	http.Redirect(w, r, "/cache", http.StatusFound)
+}
+
+// formatBytes formats n as MiB
+func formatBytes(n int64) string {
+	return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + " MiB"
+}
+
+// formatLimit formats the size limit n as MiB, 0 means there is no limit
+func formatLimit(n int64) string {
+	if n <= 0 {
+		return "unlimited"
+	}
+	return formatBytes(n)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"mime"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Csrf rejects state changing requests that were not sent by one of our own pages. Every browser gets a random token
+// in a cookie, which forms have to send back in the csrf field. Other sites can neither read the cookie nor set it,
+// so they can not fill in the field.
+// Api requests can send the token in the X-CSRF-Token header instead, or use a json content type,
+// which browsers do not send cross site without asking the server first
+func (s *Server) Csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			token, err = newCsrfToken()
+			if err != nil {
+				log.Error().Err(err).Msg("Could not create csrf token")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    token,
+				Path:     "/",
+				Secure:   s.options.Auth.Get().Secure || s.options.Tls.Enabled,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		r = r.WithContext(context.WithValue(r.Context(), csrfKey, token))
+
+		// Browsers never add an Authorization header on their own, so requests with a token can not be forged
+		if safeMethod(r.Method) || bearerToken(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOrigin(r) || !validCsrf(r, token) {
+			log.Warn().Str("Method", r.Method).Str("Path", r.URL.Path).Str("Address", remoteAddress(r)).
+				Msg("Rejected request without valid csrf token")
+			if isApiRequest(r) {
+				writeApiError(w, http.StatusForbidden, "missing or invalid csrf token")
+			} else {
+				http.Error(w, "Forbidden, reload the page and try again", http.StatusForbidden)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns the token forms of the request have to send back
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfKey).(string)
+	return token
+}
+
+func newCsrfToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func validCsrf(r *http.Request, token string) bool {
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" && isApiRequest(r) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return mediaType == "application/json"
+	}
+	if sent == "" {
+		sent = r.PostFormValue(csrfField)
+	}
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+// safeMethod reports whether requests with method do not change anything
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin rejects requests the browser marked as coming from another site
+func sameOrigin(r *http.Request) bool {
+	return r.Header.Get("Sec-Fetch-Site") != "cross-site"
+}
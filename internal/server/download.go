@@ -0,0 +1,439 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pablu23/mangaGetter/internal/cache"
+	"github.com/pablu23/mangaGetter/internal/cbz"
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/provider"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+)
+
+type DownloadStatus int
+
+const (
+	Queued DownloadStatus = iota
+	Running
+	Finished
+	Failed
+)
+
+func (d DownloadStatus) String() string {
+	switch d {
+	case Queued:
+		return "Queued"
+	case Running:
+		return "Running"
+	case Finished:
+		return "Finished"
+	case Failed:
+		return "Failed"
+	}
+	return "Unknown"
+}
+
+// DownloadJob downloads a single chapter into a CBZ file or the disk cache
+type DownloadJob struct {
+	Id       int
+	Provider provider.Provider
+	SubUrl   string
+	Title    string
+	Chapter  string
+	Target   database.DownloadTarget
+	// Auto jobs were queued by the updater because of the auto download rule of the manga
+	Auto bool
+
+	Status DownloadStatus
+	Pages  int
+	// Done is the number of downloaded pages, it is updated while the job is running
+	Done atomic.Int32
+	Err  error
+	Path string
+	// MangaId and ChapterId are 0 if the url could not be parsed, Keys are the disk cache keys of the images of a DownloadCache job
+	MangaId   int
+	ChapterId int
+	Keys      []string
+}
+
+// Downloader works through queued DownloadJobs in the background
+type Downloader struct {
+	Path    string
+	Workers int
+	// Finished is called with every job that downloaded its chapter, it may be nil
+	Finished func(job *DownloadJob)
+
+	fetcher *Fetcher
+	// ctx stops the workers, running downloads fail without writing a file
+	ctx     context.Context
+	workers sync.WaitGroup
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	jobs    []*DownloadJob
+	nextId  int
+}
+
+func NewDownloader(ctx context.Context, path string, workers int, fetcher *Fetcher) *Downloader {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &Downloader{
+		Path:    path,
+		Workers: workers,
+		fetcher: fetcher,
+		ctx:     ctx,
+	}
+	d.cond = sync.NewCond(&d.mutex)
+	return d
+}
+
+func (d *Downloader) Start() {
+	// Wake up idle workers, so they notice the context is done
+	context.AfterFunc(d.ctx, func() {
+		d.mutex.Lock()
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+	})
+	for i := 0; i < d.Workers; i++ {
+		d.workers.Add(1)
+		go d.work()
+	}
+}
+
+// Wait blocks until every worker has stopped
+func (d *Downloader) Wait() {
+	d.workers.Wait()
+}
+
+// Enqueue adds the chapter at subUrl to the queue, a chapter that is already queued or running is not added twice
+func (d *Downloader) Enqueue(p provider.Provider, subUrl string) *DownloadJob {
+	return d.enqueue(p, subUrl, database.DownloadCbz, false)
+}
+
+// EnqueueAuto adds a chapter the updater found to the queue, it is downloaded to target
+func (d *Downloader) EnqueueAuto(p provider.Provider, subUrl string, target database.DownloadTarget) *DownloadJob {
+	return d.enqueue(p, subUrl, target, true)
+}
+
+func (d *Downloader) enqueue(p provider.Provider, subUrl string, target database.DownloadTarget, auto bool) *DownloadJob {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, job := range d.jobs {
+		if job.SubUrl == subUrl && job.Provider.Name() == p.Name() && job.Target == target && (job.Status == Queued || job.Status == Running) {
+			return job
+		}
+	}
+
+	title, chapter, err := p.GetTitleAndChapter(subUrl)
+	if err != nil {
+		log.Warn().Err(err).Str("Url", subUrl).Msg("Could not extract title and chapter")
+		title = "Unknown"
+		chapter = "ch_?"
+	}
+	mangaId, chapterId := d.fetcher.ids(p, subUrl)
+
+	d.nextId++
+	job := &DownloadJob{
+		Id:        d.nextId,
+		Provider:  p,
+		SubUrl:    subUrl,
+		Title:     strings.Replace(title, "-", " ", -1),
+		Chapter:   strings.Replace(chapter, "ch_", "", 1),
+		Target:    target,
+		Auto:      auto,
+		Status:    Queued,
+		MangaId:   mangaId,
+		ChapterId: chapterId,
+	}
+	d.jobs = append(d.jobs, job)
+	d.cond.Signal()
+	return job
+}
+
+// Jobs returns a snapshot of all jobs in the order they were queued
+func (d *Downloader) Jobs() []view.DownloadViewModel {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	jobs := make([]view.DownloadViewModel, len(d.jobs))
+	for i, job := range d.jobs {
+		jobs[i] = view.DownloadViewModel{
+			Id:      job.Id,
+			ID:      job.MangaId,
+			Title:   job.Title,
+			Chapter: job.Chapter,
+			Status:  job.Status.String(),
+			Done:    int(job.Done.Load()),
+			Pages:   job.Pages,
+			Path:    job.Path,
+		}
+		if job.Err != nil {
+			jobs[i].Error = job.Err.Error()
+		}
+	}
+	return jobs
+}
+
+// ClearFinished forgets all finished and failed jobs
+func (d *Downloader) ClearFinished() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	jobs := d.jobs[:0]
+	for _, job := range d.jobs {
+		if job.Status == Queued || job.Status == Running {
+			jobs = append(jobs, job)
+		}
+	}
+	d.jobs = jobs
+}
+
+func (d *Downloader) work() {
+	defer d.workers.Done()
+	for {
+		d.mutex.Lock()
+		job := d.nextQueued()
+		for job == nil && d.ctx.Err() == nil {
+			d.cond.Wait()
+			job = d.nextQueued()
+		}
+		if d.ctx.Err() != nil {
+			d.mutex.Unlock()
+			return
+		}
+		job.Status = Running
+		d.mutex.Unlock()
+
+		path, err := d.download(job)
+
+		d.mutex.Lock()
+		if err != nil {
+			job.Status = Failed
+			job.Err = err
+			log.Error().Err(err).Str("Url", job.SubUrl).Msg("Could not download chapter")
+		} else {
+			job.Status = Finished
+			job.Path = path
+			log.Info().Str("Target", string(job.Target)).Str("Path", path).Msg("Downloaded chapter")
+		}
+		d.mutex.Unlock()
+
+		if err == nil && d.Finished != nil {
+			d.Finished(job)
+		}
+	}
+}
+
+// nextQueued returns the oldest queued job, the caller has to hold the mutex
+func (d *Downloader) nextQueued() *DownloadJob {
+	for _, job := range d.jobs {
+		if job.Status == Queued {
+			return job
+		}
+	}
+	return nil
+}
+
+func (d *Downloader) download(job *DownloadJob) (string, error) {
+	p := job.Provider
+	html, err := p.GetHtml(job.SubUrl)
+	if err != nil {
+		return "", err
+	}
+	if err = d.ctx.Err(); err != nil {
+		return "", err
+	}
+
+	urls, err := p.GetImageList(html)
+	if err != nil {
+		return "", err
+	}
+
+	d.mutex.Lock()
+	job.Pages = len(urls)
+	d.mutex.Unlock()
+
+	if job.Target == database.DownloadCache {
+		return "", d.cache(job, urls)
+	}
+
+	pages := make([]cbz.Page, len(urls))
+	err = d.fetcher.FetchAll(d.ctx, p, urls, job.MangaId, func(i int, buf []byte) {
+		pages[i] = cbz.Page{Name: urls[i], Data: buf}
+		job.Done.Add(1)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	web := ""
+	if p.Host() != "" {
+		web = fmt.Sprintf("https://%s%s", p.Host(), job.SubUrl)
+	}
+	info := cbz.NewComicInfo(job.Title, job.Chapter, web, len(pages))
+	buf := new(bytes.Buffer)
+	err = cbz.Write(buf, info, pages)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(d.Path, sanitizeFileName(job.Title))
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, sanitizeFileName(fmt.Sprintf("%s - Ch. %s.cbz", job.Title, job.Chapter)))
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, buf.Bytes(), 0o644)
+	if err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// cache stores the images of the chapter in the disk cache, where the reader finds them without downloading them again
+func (d *Downloader) cache(job *DownloadJob, urls []string) error {
+	if d.fetcher.Disk == nil {
+		return errors.New("the disk cache is disabled")
+	}
+	if _, ok := job.Provider.(provider.ImageFetcher); ok {
+		return errors.New("images of this provider are not cached")
+	}
+
+	err := d.fetcher.FetchAll(d.ctx, job.Provider, urls, job.MangaId, func(int, []byte) {
+		job.Done.Add(1)
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, len(urls))
+	for i, url := range urls {
+		keys[i] = cache.Key(url)
+	}
+	d.mutex.Lock()
+	job.Keys = keys
+	d.mutex.Unlock()
+	return nil
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+}
+
+func (s *Server) HandleDownload(w http.ResponseWriter, r *http.Request) {
+	if s.Downloader == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	sub := r.PostFormValue("subUrl")
+	if sub == "" {
+		rd, ok := s.Readers.Lookup(r)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		p, subUrl, _ := rd.Current()
+		if p != nil && subUrl != "" {
+			s.Downloader.Enqueue(p, subUrl)
+		}
+		http.Redirect(w, r, "/current/", http.StatusFound)
+		return
+	}
+
+	p, err := s.Providers.Get(r.PostFormValue("provider"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not download chapter")
+	} else {
+		s.Downloader.Enqueue(p, sub)
+	}
+	redirectBack(w, r)
+}
+
+func (s *Server) HandleDownloadRange(w http.ResponseWriter, r *http.Request) {
+	defer http.Redirect(w, r, "/", http.StatusFound)
+	if s.Downloader == nil {
+		return
+	}
+
+	mangaStr := r.PostFormValue("mangaId")
+	mangaId, err := strconv.Atoi(mangaStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not convert id to int")
+		return
+	}
+
+	from, err := parseChapterNumber(r.PostFormValue("from"), 0)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid chapter range")
+		return
+	}
+	to, err := parseChapterNumber(r.PostFormValue("to"), math.Inf(1))
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid chapter range")
+		return
+	}
+
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not find manga")
+		return
+	}
+
+	p, err := s.Providers.Get(manga.Provider)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not download chapters")
+		return
+	}
+
+	chapters, err := p.GetChapterList(manga.SubUrl())
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not get chapter list")
+		return
+	}
+
+	for _, sub := range chapters {
+		_, chapter, err := p.GetTitleAndChapter(sub)
+		if err != nil {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.Replace(chapter, "ch_", "", 1), 64)
+		if err != nil || number < from || number > to {
+			continue
+		}
+		s.Downloader.Enqueue(p, sub)
+	}
+}
+
+func (s *Server) HandleDownloadClear(w http.ResponseWriter, r *http.Request) {
+	if s.Downloader != nil {
+		s.Downloader.ClearFinished()
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func parseChapterNumber(value string, fallback float64) (float64, error) {
+	if strings.TrimSpace(value) == "" {
+		return fallback, nil
+	}
+	return strconv.ParseFloat(strings.TrimSpace(value), 64)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/pablu23/mangaGetter/internal/cache"
+	"github.com/pablu23/mangaGetter/internal/provider"
+	"github.com/rs/zerolog/log"
+)
+
+// Fetcher downloads chapter images, if a disk cache is set it is consulted first
+// and every downloaded image is stored in it
+type Fetcher struct {
+	Disk *cache.Disk
+	// Ids returns the ids the manga and chapter at a chapter url are stored with, 0 if they are not stored.
+	// Images in the disk cache belong to that manga
+	Ids func(p provider.Provider, subUrl string) (mangaId int, chapterId int)
+}
+
+func (f *Fetcher) ids(p provider.Provider, subUrl string) (mangaId int, chapterId int) {
+	if f.Ids == nil {
+		return 0, 0
+	}
+	return f.Ids(p, subUrl)
+}
+
+func (f *Fetcher) Fetch(ctx context.Context, p provider.Provider, url string, mangaId int) ([]byte, error) {
+	// Images of providers fetching their own images are not downloaded, so there is nothing to cache
+	if imageFetcher, ok := p.(provider.ImageFetcher); ok {
+		return imageFetcher.FetchImage(url)
+	}
+
+	key := cache.Key(url)
+	if f.Disk != nil {
+		if buf, ok := f.Disk.Get(key); ok {
+			return buf, nil
+		}
+	}
+
+	buf, err := addFileToRam(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Disk != nil {
+		err = f.Disk.Put(key, mangaId, buf)
+		if err != nil {
+			log.Error().Err(err).Str("Url", url).Msg("Could not write image to disk cache")
+		}
+	}
+	return buf, nil
+}
+
+// FetchAll downloads all urls concurrently and calls handle for every image, handle has to be safe for concurrent use.
+// The returned error joins the errors of all failed downloads, once ctx is done the remaining images are skipped
+func (f *Fetcher) FetchAll(ctx context.Context, p provider.Provider, urls []string, mangaId int, handle func(i int, buf []byte)) error {
+	errs := make([]error, len(urls))
+
+	wg := sync.WaitGroup{}
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string, wg *sync.WaitGroup) {
+			defer wg.Done()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+			buf, err := f.Fetch(ctx, p, url, mangaId)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			handle(i, buf)
+		}(i, url, &wg)
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
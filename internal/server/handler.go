@@ -17,13 +17,23 @@ import (
 	"github.com/rs/zerolog/log"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
-	"gorm.io/gorm"
 )
 
 func (s *Server) HandleDisable(w http.ResponseWriter, r *http.Request) {
-	id := r.PostFormValue("mangaId")
-	var manga database.Manga
-	s.DbMgr.Db.Where("id = ?", id).First(&manga)
+	mangaStr := r.PostFormValue("mangaId")
+	mangaId, err := strconv.Atoi(mangaStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not convert id to int")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not find manga")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 
 	if manga.Enabled {
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -32,119 +42,116 @@ func (s *Server) HandleDisable(w http.ResponseWriter, r *http.Request) {
 	}
 
 	manga.Enabled = !manga.Enabled
-	s.DbMgr.Db.Save(&manga)
+	err = s.DbMgr.SaveUserManga(s.userId(r), manga)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not save manga")
+	}
 }
 
 func (s *Server) HandleUpdate(w http.ResponseWriter, r *http.Request) {
-	s.UpdateMangaList()
+	s.UpdateMangaList(r.Context(), database.UpdateManual)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func (s *Server) HandleLoginPost(w http.ResponseWriter, r *http.Request) {
-	if s.options.Auth.Enabled {
-		auth := s.options.Auth.Get()
-		secret := r.PostFormValue("secret")
-		http.SetCookie(w, &http.Cookie{
-			Name:     "auth",
-			Value:    secret,
-			Path:     "/",
-			MaxAge:   auth.MaxAge,
-			Secure:   auth.Secure,
-			HttpOnly: false,
-			SameSite: http.SameSiteLaxMode,
-		})
-	}
-	http.Redirect(w, r, "/", http.StatusFound)
-}
-
-func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(view.GetViewTemplate(view.Login))
-	tmpl.Execute(w, nil)
-}
-
 func (s *Server) HandleNew(w http.ResponseWriter, r *http.Request) {
 	title := r.PathValue("title")
 	chapter := r.PathValue("chapter")
 
-	url := fmt.Sprintf("/title/%s/%s", title, chapter)
+	p, err := s.Providers.Get(r.PathValue("provider"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not open chapter")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 
-	s.CurrSubUrl = url
-	s.PrevSubUrl = ""
-	s.NextSubUrl = ""
-	s.LoadCurr()
+	url := fmt.Sprintf("/title/%s/%s", title, chapter)
 
-	go s.LoadNext()
-	go s.LoadPrev()
+	rd := s.Readers.Get(w, r)
+	err = rd.Open(p, url)
+	if err != nil {
+		log.Error().Err(err).Str("Url", url).Msg("Could not load current chapter")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 
 	http.Redirect(w, r, "/current/", http.StatusFound)
 }
 
 func (s *Server) HandleArchive(w http.ResponseWriter, r *http.Request) {
-	var all []*database.Manga
-	_ = s.DbMgr.Db.Preload("Chapters").Where("enabled = 0").Find(&all)
-
-	var tmp []database.Setting
-	s.DbMgr.Db.Find(&tmp)
-	settings := make(map[string]database.Setting)
-	for _, m := range tmp {
-		settings[m.Name] = m
+	all, err := s.DbMgr.Library(s.userId(r), "user_mangas.enabled = ?", false)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load archive")
 	}
 
-	s.ViewMenu(w, all, settings, true)
+	s.ViewMenu(w, r, all, s.UserSettings(s.userId(r)), true)
 }
 
-func (s *Server) HandleMenu(w http.ResponseWriter, _ *http.Request) {
-	var all []*database.Manga
-	_ = s.DbMgr.Db.Preload("Chapters").Where("enabled = 1").Find(&all)
-
-	var tmp []database.Setting
-	s.DbMgr.Db.Find(&tmp)
-	settings := make(map[string]database.Setting)
-	for _, m := range tmp {
-		settings[m.Name] = m
+func (s *Server) HandleMenu(w http.ResponseWriter, r *http.Request) {
+	all, err := s.DbMgr.Library(s.userId(r), "user_mangas.enabled = ?", true)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load library")
 	}
 
-	s.ViewMenu(w, all, settings, false)
+	s.ViewMenu(w, r, all, s.UserSettings(s.userId(r)), false)
 }
 
-func (s *Server) ViewMenu(w http.ResponseWriter, mangas []*database.Manga, settings map[string]database.Setting, archive bool) {
+func (s *Server) ViewMenu(w http.ResponseWriter, r *http.Request, mangas []*database.Manga, settings map[string]database.Setting, archive bool) {
 	tmpl := template.Must(view.GetViewTemplate(view.Menu))
 
 	l := len(mangas)
 	mangaViewModels := make([]view.MangaViewModel, l)
 	counter := 0
 
+	filter, ok := settings["filter"]
+	unreadOnly := ok && filter.Value == "unread"
+
 	//TODO: Change all this to be more performant
 	for _, manga := range mangas {
 		title := cases.Title(language.English, cases.Compact).String(strings.Replace(manga.Title, "-", " ", -1))
 
+		p, err := s.Providers.Get(manga.Provider)
+		if err != nil {
+			log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not find provider")
+			continue
+		}
+
 		thumbnail, updated, err := s.LoadThumbnail(manga)
 		//TODO: Add default picture instead of not showing Manga at all
 		if err != nil {
 			continue
 		}
 		if updated {
-			s.DbMgr.Db.Save(manga)
+			s.DbMgr.SaveMangaUpdate(manga)
 		}
 		// This is very slow
 		// TODO: put this into own Method
-		if manga.LastChapterNum == "" {
+		if manga.LastChapterNum == "" || manga.ChapterCount == 0 {
 			err, updated := s.UpdateLatestAvailableChapter(manga)
 			if err != nil {
 				log.Error().Err(err).Msg("Could not update latest available chapters")
 			}
 			if updated {
-				s.DbMgr.Db.Save(manga)
+				s.DbMgr.SaveMangaUpdate(manga)
 			}
 		}
 
 		latestChapter, ok := manga.GetLatestChapter()
 		if !ok {
+			// Added from the search without being opened yet
+			latestChapter, ok = manga.GetFirstChapter()
+			if !ok {
+				continue
+			}
+		}
+
+		unread := manga.UnreadCount()
+		if unreadOnly && unread == 0 {
 			continue
 		}
 
 		mangaViewModels[counter] = view.MangaViewModel{
 			ID:         manga.Id,
+			Provider:   p.Name(),
 			Title:      title,
 			Number:     latestChapter.Number,
 			LastNumber: manga.LastChapterNum,
@@ -153,9 +160,14 @@ func (s *Server) ViewMenu(w http.ResponseWriter, mangas []*database.Manga, setti
 			Url:          latestChapter.Url,
 			ThumbnailUrl: thumbnail,
 			Enabled:      manga.Enabled,
+			ChapterId:    latestChapter.Id,
+			Read:         latestChapter.Read,
+			Unread:       unread,
 		}
 		counter++
 	}
+	// Mangas that could not be shown or are filtered out left empty rows at the end
+	mangaViewModels = mangaViewModels[:counter]
 
 	order, ok := settings["order"]
 	if !ok || order.Value == "title" {
@@ -180,13 +192,34 @@ func (s *Server) ViewMenu(w http.ResponseWriter, mangas []*database.Manga, setti
 		})
 	}
 
+	user := s.user(r)
+	var released int64
+	seen, err := s.DbMgr.UpdatesSeen(user.Id)
+	if err == nil {
+		released, err = s.DbMgr.CountReleasedSince(user.Id, seen)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not count released chapters")
+	}
+
 	menuViewModel := view.MenuViewModel{
-		Settings: settings,
-		Mangas:   mangaViewModels,
-		Archive:  archive,
+		Csrf:      csrfToken(r),
+		User:      user.Name,
+		Admin:     user.Can(database.RoleAdmin),
+		Edit:      user.Can(database.RoleReader),
+		Auth:      s.options.Auth.Enabled,
+		Logout:    s.options.Auth.Enabled && s.options.Auth.Get().Mode != ProxyAuth,
+		Providers: s.Providers.Names(),
+		Settings:  settings,
+		Mangas:    mangaViewModels,
+		Archive:   archive,
+		Released:  released,
+	}
+	if s.Downloader != nil {
+		menuViewModel.Downloads = s.Downloader.Jobs()
 	}
 
-	err := tmpl.Execute(w, menuViewModel)
+	err = tmpl.Execute(w, menuViewModel)
 	if err != nil {
 		log.Error().Err(err).Msg("Could not template Menu")
 	}
@@ -207,73 +240,55 @@ func (s *Server) HandleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.DbMgr.Delete(mangaId)
+	err = s.RemoveFromLibrary(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not delete manga")
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func (s *Server) HandleExit(w http.ResponseWriter, r *http.Request) {
+	if rd, ok := s.Readers.Lookup(r); ok {
+		rd.Close()
+	}
+	stats := s.Images.Stats()
+	log.Debug().Uint64("Hits", stats.Hits).Uint64("Misses", stats.Misses).Uint64("Evictions", stats.Evictions).
+		Int64("Size", stats.Size).Int("Entries", stats.Entries).Msg("Image cache")
 	http.Redirect(w, r, "/", http.StatusFound)
-
-	go func() {
-		s.Mutex.Lock()
-		if s.PrevViewModel != nil {
-			for _, img := range s.PrevViewModel.Images {
-				delete(s.ImageBuffers, img.Path)
-			}
-		}
-		if s.CurrViewModel != nil {
-
-			for _, img := range s.CurrViewModel.Images {
-				delete(s.ImageBuffers, img.Path)
-			}
-		}
-		if s.NextViewModel != nil {
-
-			for _, img := range s.NextViewModel.Images {
-				delete(s.ImageBuffers, img.Path)
-			}
-		}
-		s.Mutex.Unlock()
-		log.Info().Msg("Cleaned up images")
-	}()
 }
 
 func (s *Server) HandleCurrent(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(view.GetViewTemplate(view.Viewer))
-	mangaId, chapterId, err := s.Provider.GetTitleIdAndChapterId(s.CurrSubUrl)
-	if err != nil {
-		log.Error().Err(err).Str("subUrl", s.CurrSubUrl).Msg("Could not get TitleId and ChapterId")
+
+	rd, ok := s.Readers.Lookup(r)
+	if !ok {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-
-	title, chapterName, err := s.Provider.GetTitleAndChapter(s.CurrSubUrl)
-	if err != nil {
-		log.Warn().Err(err).Str("subUrl", s.CurrSubUrl).Msg("Could not get Title and Chapter")
+	p, subUrl, viewModel := rd.Current()
+	if p == nil || viewModel == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
-	var manga database.Manga
-	result := s.DbMgr.Db.First(&manga, mangaId)
-	if result.Error != nil && errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		manga = database.NewManga(mangaId, title, time.Now().Unix())
-	} else {
-		manga.TimeStampUnix = time.Now().Unix()
+	chapter, err := s.SaveProgress(s.userId(r), p, subUrl)
+	if err != nil {
+		log.Error().Err(err).Str("subUrl", subUrl).Msg("Could not save progress")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
-	var chapter database.Chapter
-	result = s.DbMgr.Db.First(&chapter, chapterId)
-	if result.Error != nil && errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		chapterNumberStr := strings.Replace(chapterName, "ch_", "", 1)
-		chapter = database.NewChapter(chapterId, mangaId, s.CurrSubUrl, chapterName, chapterNumberStr, time.Now().Unix())
-	} else {
-		chapter.TimeStampUnix = time.Now().Unix()
+	// The view model is shared with the reader, so only change a copy
+	vm := *viewModel
+	vm.SubUrl = subUrl
+	vm.Csrf = csrfToken(r)
+	vm.Edit = s.user(r).Can(database.RoleReader)
+	if !chapter.Read && chapter.Page < len(vm.Images) {
+		vm.Page = chapter.Page
 	}
 
-	s.DbMgr.Db.Save(&manga)
-	s.DbMgr.Db.Save(&chapter)
-
-	err = tmpl.Execute(w, s.CurrViewModel)
+	err = tmpl.Execute(w, vm)
 	if err != nil {
 		log.Error().Err(err).Msg("Could not template Current")
 	}
@@ -281,9 +296,17 @@ func (s *Server) HandleCurrent(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) HandleImage(w http.ResponseWriter, r *http.Request) {
 	u := r.PathValue("url")
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	buf := s.ImageBuffers[u]
+
+	var buf []byte
+	if rd, ok := s.Readers.Lookup(r); ok {
+		buf = rd.Image(u)
+	}
+	if buf == nil {
+		buf, _ = s.Images.Get(u)
+	}
+	if buf == nil && strings.HasPrefix(u, "thumb-") {
+		buf = s.LoadEvictedThumbnail(u)
+	}
 	if buf == nil {
 		log.Warn().Str("url", u).Msg("Image not found")
 		w.WriteHeader(http.StatusNotFound)
@@ -309,56 +332,34 @@ func (s *Server) HandleFavicon(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (s *Server) HandleNext(w http.ResponseWriter, r *http.Request) {
-	if s.PrevViewModel != nil {
-		go func(viewModel view.ImageViewModel, s *Server) {
-			s.Mutex.Lock()
-			for _, img := range viewModel.Images {
-				delete(s.ImageBuffers, img.Path)
-			}
-			s.Mutex.Unlock()
-			log.Debug().Msg("Cleaned imagebuffer")
-		}(*s.PrevViewModel, s)
+	rd, ok := s.Readers.Lookup(r)
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 
-	if s.NextViewModel == nil || s.NextSubUrl == "" {
+	p, subUrl, _ := rd.Current()
+	if !rd.Next(r.Context()) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	s.PrevViewModel = s.CurrViewModel
-	s.CurrViewModel = s.NextViewModel
-	s.PrevSubUrl = s.CurrSubUrl
-	s.CurrSubUrl = s.NextSubUrl
-
-	go s.LoadNext()
+	// Going to the next chapter means the last one was finished
+	err := s.MarkChapterRead(s.userId(r), p, subUrl)
+	if err != nil {
+		log.Error().Err(err).Str("subUrl", subUrl).Msg("Could not mark chapter as read")
+	}
 
 	http.Redirect(w, r, "/current/", http.StatusFound)
 }
 
 func (s *Server) HandlePrev(w http.ResponseWriter, r *http.Request) {
-	if s.NextViewModel != nil {
-		go func(viewModel view.ImageViewModel, s *Server) {
-			s.Mutex.Lock()
-			for _, img := range viewModel.Images {
-				delete(s.ImageBuffers, img.Path)
-			}
-			s.Mutex.Unlock()
-			log.Debug().Msg("Cleaned imagebuffer")
-		}(*s.NextViewModel, s)
-	}
-
-	if s.PrevViewModel == nil || s.PrevSubUrl == "" {
+	rd, ok := s.Readers.Lookup(r)
+	if !ok || !rd.Prev(r.Context()) {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	s.NextViewModel = s.CurrViewModel
-	s.CurrViewModel = s.PrevViewModel
-	s.NextSubUrl = s.CurrSubUrl
-	s.CurrSubUrl = s.PrevSubUrl
-
-	go s.LoadPrev()
-
 	http.Redirect(w, r, "/current/", http.StatusFound)
 }
 
@@ -366,14 +367,12 @@ func (s *Server) HandleSettingSet(w http.ResponseWriter, r *http.Request) {
 	settingName := r.PathValue("setting")
 	settingValue := r.PathValue("value")
 
-	var setting database.Setting
-	res := s.DbMgr.Db.First(&setting, "name = ?", settingName)
-
-	if res.Error != nil && errors.Is(res.Error, gorm.ErrRecordNotFound) {
-		set := database.NewSetting(settingName, settingValue)
-		s.DbMgr.Db.Save(&set)
-	} else {
-		s.DbMgr.Db.Model(&setting).Update("value", settingValue)
+	err := s.SaveSetting(s.user(r), settingName, settingValue)
+	if errors.Is(err, errNotAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("Setting", settingName).Msg("Could not save setting")
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -383,16 +382,12 @@ func (s *Server) HandleSetting(w http.ResponseWriter, r *http.Request) {
 	settingName := r.PostFormValue("setting")
 	settingValue := r.PostFormValue(settingName)
 
-	var setting database.Setting
-	res := s.DbMgr.Db.First(&setting, "name = ?", settingName)
-
-	if res.Error != nil && errors.Is(res.Error, gorm.ErrRecordNotFound) {
-		set := database.NewSetting(settingName, settingValue)
-		s.DbMgr.Db.Save(&set)
-	} else if res.Error != nil {
-		log.Error().Err(res.Error).Send()
-	} else {
-		s.DbMgr.Db.Model(&setting).Update("value", settingValue)
+	err := s.SaveSetting(s.user(r), settingName, settingValue)
+	if errors.Is(err, errNotAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("Setting", settingName).Msg("Could not save setting")
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -401,16 +396,27 @@ func (s *Server) HandleSetting(w http.ResponseWriter, r *http.Request) {
 func (s *Server) HandleNewQuery(w http.ResponseWriter, r *http.Request) {
 	sub := r.PostFormValue("subUrl")
 
-	sub = s.Provider.CleanUrlToSub(sub)
-	url := fmt.Sprintf("/title/%s", sub)
+	p, ok := s.Providers.FromUrl(sub)
+	if !ok {
+		var err error
+		p, err = s.Providers.Get(r.PostFormValue("provider"))
+		if err != nil {
+			log.Error().Err(err).Str("subUrl", sub).Msg("Could not find provider")
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+	}
 
-	s.CurrSubUrl = url
-	s.PrevSubUrl = ""
-	s.NextSubUrl = ""
-	s.LoadCurr()
+	sub = p.CleanUrlToSub(sub)
+	url := fmt.Sprintf("/title/%s", sub)
 
-	go s.LoadNext()
-	go s.LoadPrev()
+	rd := s.Readers.Get(w, r)
+	err := rd.Open(p, url)
+	if err != nil {
+		log.Error().Err(err).Str("Url", url).Msg("Could not load current chapter")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 
 	http.Redirect(w, r, "/current/", http.StatusFound)
 }
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/provider"
+)
+
+// newTestServer returns a server without auth on a new database, with the local provider on an empty directory
+func newTestServer(t *testing.T, options ...func(*Options)) *Server {
+	t.Helper()
+	db := database.NewDatabase(filepath.Join(t.TempDir(), "db.sqlite"), true, false)
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	s := New(provider.NewRegistry(provider.NewLocal(t.TempDir())), &db, http.NewServeMux(), options...)
+	t.Cleanup(s.cancel)
+	err = s.setupUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterRoutes()
+	return s
+}
+
+// addTestManga adds a manga with chapters numbered 1 to chapters to the library of userId, the first read of them are read
+func addTestManga(t *testing.T, s *Server, userId int, title string, chapters int, read int) *database.Manga {
+	t.Helper()
+	var count int64
+	s.DbMgr.Db.Model(&database.Manga{}).Count(&count)
+	manga := database.NewManga(int(count)+1, "local", title, time.Now().Unix())
+	manga.Thumbnail = []byte("thumbnail")
+	manga.LastChapterNum = strconv.Itoa(chapters)
+	manga.ChapterCount = chapters
+	err := s.DbMgr.Db.Create(&manga).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DbMgr.AddToLibrary(userId, manga.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= chapters; i++ {
+		number := strconv.Itoa(i)
+		chapter := database.NewChapter(i, manga.Id, "/title/"+title+"/"+number, "Chapter "+number, number, time.Now().Unix())
+		err = s.DbMgr.Db.Create(&chapter).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i <= read {
+			chapter.Read = true
+			chapter.ReadUnix = time.Now().Unix()
+			err = s.DbMgr.SaveUserChapter(userId, &chapter)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		manga.Chapters = append(manga.Chapters, chapter)
+	}
+	return &manga
+}
+
+// newTestToken returns an api token of a new user with role
+func newTestToken(t *testing.T, s *Server, name string, role database.Role) string {
+	t.Helper()
+	user, err := s.DbMgr.CreateUser(name, "hunter2", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiToken := database.NewApiToken(user.Id, "test", hash, false, time.Now().Unix())
+	err = s.DbMgr.CreateApiToken(&apiToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serve sends a request with body as form or, if it starts with {, as json to s without the csrf check
+func serve(s *Server, method string, target string, body string) *httptest.ResponseRecorder {
+	return serveAs(s, "", method, target, body)
+}
+
+// serveAs sends a request like serve with the api token of a user
+func serveAs(s *Server, token string, method string, target string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if strings.HasPrefix(body, "{") {
+		r.Header.Set("Content-Type", "application/json")
+	} else if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	rec := httptest.NewRecorder()
+	s.Auth(s.mux).ServeHTTP(rec, r)
+	return rec
+}
+
+func TestViewMenuUnreadFilter(t *testing.T) {
+	s := newTestServer(t)
+	addTestManga(t, s, s.defaultUser.Id, "all-read", 3, 3)
+	addTestManga(t, s, s.defaultUser.Id, "one-unread", 3, 2)
+	addTestManga(t, s, s.defaultUser.Id, "none-read", 2, 0)
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"all", []string{"All Read", "None Read", "One Unread"}},
+		{"unread", []string{"None Read", "One Unread"}},
+	}
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			err := s.SaveSetting(s.defaultUser, "filter", test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			s.Csrf(s.Auth(s.mux)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET / = %d", rec.Code)
+			}
+			body := rec.Body.String()
+
+			if strings.Contains(body, `href="/manga/0"`) || strings.Contains(body, `alt="img_"`) {
+				t.Errorf("menu has empty rows:\n%s", body)
+			}
+			if rows := strings.Count(body, `<td class="table-left"><a href="/manga/`); rows != len(test.want) {
+				t.Errorf("menu has %d rows, want %d", rows, len(test.want))
+			}
+			last := -1
+			for _, title := range test.want {
+				i := strings.Index(body, ">"+title+"</a>")
+				if i < 0 {
+					t.Errorf("%q is missing", title)
+				} else if i < last {
+					t.Errorf("%q is out of order", title)
+				}
+				last = i
+			}
+		})
+	}
+}
+
+func TestViewSettings(t *testing.T) {
+	s := newTestServer(t, func(o *Options) {
+		o.Auth.Set(AuthOptions{Mode: PasswordAuth, MaxAge: 3600})
+	})
+	admin := newTestToken(t, s, "boss", database.RoleAdmin)
+	guest := newTestToken(t, s, "guest", database.RoleGuest)
+	reader := newTestToken(t, s, "reader", database.RoleReader)
+	for name, value := range map[string]string{"theme": "white", "order": "title", "filter": "all"} {
+		err := s.SetSetting(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"guest sets their order", guest, http.MethodPut, "/api/v1/settings/order", `{"value": "last"}`, http.StatusOK},
+		{"guest sets their filter", guest, http.MethodPost, "/setting/", url.Values{"setting": {"filter"}, "filter": {"unread"}}.Encode(), http.StatusFound},
+		{"reader sets their order", reader, http.MethodPost, "/setting/set/order/chapter", "", http.StatusFound},
+		{"guest sets the theme", guest, http.MethodPut, "/api/v1/settings/theme", `{"value": "dark"}`, http.StatusForbidden},
+		{"reader sets the theme", reader, http.MethodPost, "/setting/", url.Values{"setting": {"theme"}, "theme": {"dark"}}.Encode(), http.StatusForbidden},
+		{"reader sets the theme by url", reader, http.MethodPost, "/setting/set/theme/dark", "", http.StatusForbidden},
+		{"admin sets the theme", admin, http.MethodPut, "/api/v1/settings/theme", `{"value": "dark"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serveAs(s, test.token, test.method, test.target, test.body)
+			if rec.Code != test.status {
+				t.Errorf("%s %s = %d, want %d: %s", test.method, test.target, rec.Code, test.status, rec.Body)
+			}
+		})
+	}
+
+	users := []struct {
+		name     string
+		token    string
+		settings map[string]string
+	}{
+		{"admin", admin, map[string]string{"theme": "dark", "order": "title", "filter": "all"}},
+		{"guest", guest, map[string]string{"theme": "dark", "order": "last", "filter": "unread"}},
+		{"reader", reader, map[string]string{"theme": "dark", "order": "chapter", "filter": "all"}},
+	}
+	for _, user := range users {
+		settings := user.settings
+		rec := serveAs(s, user.token, http.MethodGet, "/api/v1/settings", "")
+		var got []ApiSetting
+		err := json.Unmarshal(rec.Body.Bytes(), &got)
+		if err != nil {
+			t.Fatalf("GET /api/v1/settings = %d %s", rec.Code, rec.Body)
+		}
+		for _, setting := range got {
+			if setting.Value != settings[setting.Name] {
+				t.Errorf("%s of %s is %q, want %q", setting.Name, user.name, setting.Value, settings[setting.Name])
+			}
+		}
+		if len(got) != len(settings) {
+			t.Errorf("%s got %d settings, want %d", user.name, len(got), len(settings))
+		}
+	}
+}
+
+func TestLibraryScope(t *testing.T) {
+	s := newTestServer(t)
+	other, err := s.DbMgr.CreateUser("other", "hunter2", database.RoleReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only in the library of other, the default user must not be able to change it
+	manga := addTestManga(t, s, other.Id, "not-mine", 2, 0)
+	// It exists in the local library, so downloads of it would be queued
+	p, _ := s.Providers.Get("local")
+	local := p.(*provider.Local)
+	dir := filepath.Join(local.Root, "not-mine", "Chapter 1")
+	err = os.MkdirAll(dir, 0o755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "1.png"), []byte("page"), 0o644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := local.Search(provider.SearchQuery{Page: 1})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("Search() = %v, %v", found, err)
+	}
+	s.DbMgr.Db.Model(manga).Update("provider_id", found[0].Id)
+	s.Downloader = NewDownloader(s.ctx, t.TempDir(), 1, s.Fetcher)
+
+	chapterId := strconv.Itoa(manga.Chapters[0].Id)
+	mangaId := strconv.Itoa(manga.Id)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"mark chapter read", http.MethodPost, "/chapter/read", url.Values{"chapterId": {chapterId}, "read": {"true"}}.Encode(), http.StatusFound},
+		{"api mark chapter read", http.MethodPatch, "/api/v1/chapters/" + chapterId, `{"read": true}`, http.StatusNotFound},
+		{"mark manga read", http.MethodPost, "/manga/read", url.Values{"mangaId": {mangaId}, "read": {"true"}}.Encode(), http.StatusFound},
+		{"update", http.MethodPost, "/manga/update", url.Values{"mangaId": {mangaId}}.Encode(), http.StatusFound},
+		{"api update", http.MethodPost, "/api/v1/mangas/" + mangaId + "/update", "", http.StatusNotFound},
+		{"download", http.MethodPost, "/download/range", url.Values{"mangaId": {mangaId}}.Encode(), http.StatusFound},
+		{"auto download", http.MethodPost, "/manga/autodownload", url.Values{"mangaId": {mangaId}, "target": {"cbz"}}.Encode(), http.StatusFound},
+		{"pause", http.MethodPost, "/manga/schedule", url.Values{"mangaId": {mangaId}, "interval": {"1d"}, "paused": {"true"}}.Encode(), http.StatusFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serve(s, test.method, test.target, test.body)
+			if rec.Code != test.status {
+				t.Errorf("%s %s = %d, want %d: %s", test.method, test.target, rec.Code, test.status, rec.Body)
+			}
+		})
+	}
+
+	var stored database.Manga
+	s.DbMgr.Db.First(&stored, manga.Id)
+	if stored.UpdatePaused || stored.UpdateInterval != 0 {
+		t.Errorf("schedule of manga outside the library was changed to %d seconds, paused %t", stored.UpdateInterval, stored.UpdatePaused)
+	}
+	if stored.AutoDownload != "" {
+		t.Errorf("manga outside the library is downloaded to %q", stored.AutoDownload)
+	}
+
+	var read, results int64
+	s.DbMgr.Db.Model(&database.UserChapter{}).Where("manga_id = ? AND read = ?", manga.Id, true).Count(&read)
+	s.DbMgr.Db.Model(&database.UpdateResult{}).Where("manga_id = ?", manga.Id).Count(&results)
+	if read != 0 || results != 0 || len(s.Downloader.Jobs()) != 0 {
+		t.Errorf("manga outside the library was changed: %d chapters read, %d updates, %d downloads", read, results, len(s.Downloader.Jobs()))
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"cmp"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+func (s *Server) HandleMangaDetail(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(view.GetViewTemplate(view.Manga))
+
+	mangaStr := r.PathValue("id")
+	mangaId, err := strconv.Atoi(mangaStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not convert id to int")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not find manga")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	p, err := s.Providers.Get(manga.Provider)
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not find provider")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	// Mangas from before chapters were stored only know the chapters that were opened
+	if manga.ChapterCount == 0 {
+		err, updated := s.UpdateLatestAvailableChapter(manga)
+		if err != nil {
+			log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not update latest available chapters")
+		}
+		if updated {
+			s.DbMgr.SaveMangaUpdate(manga)
+		}
+	}
+
+	thumbnail, updated, err := s.LoadThumbnail(manga)
+	if err != nil {
+		log.Warn().Err(err).Str("Manga", manga.Title).Msg("Could not load thumbnail")
+	} else if updated {
+		s.DbMgr.SaveMangaUpdate(manga)
+	}
+
+	viewModel := view.MangaDetailViewModel{
+		Csrf:         csrfToken(r),
+		Edit:         s.user(r).Can(database.RoleReader),
+		ID:           manga.Id,
+		Provider:     p.Name(),
+		Title:        cases.Title(language.English, cases.Compact).String(strings.Replace(manga.Title, "-", " ", -1)),
+		ThumbnailUrl: thumbnail,
+		LastNumber:   manga.LastChapterNum,
+		Unread:       manga.UnreadCount(),
+		Enabled:      manga.Enabled,
+		Downloads:    s.Downloader != nil && s.user(r).Can(database.RoleReader),
+		Settings:     s.Settings(),
+		Chapters:     make([]view.ChapterViewModel, len(manga.Chapters)),
+		Updates:      s.updateHistory(manga),
+		Schedule:     s.scheduleViewModel(manga),
+		AutoDownload: autoDownloadViewModel(manga),
+	}
+
+	latest, _ := manga.GetLatestChapter()
+	for i, chapter := range manga.Chapters {
+		viewModel.Chapters[i] = view.ChapterViewModel{
+			Id:        chapter.Id,
+			Number:    chapter.Number,
+			Title:     chapter.Title,
+			Volume:    chapter.Volume,
+			Scanlator: chapter.Scanlator,
+			Url:       chapter.Url,
+			Read:      chapter.Read,
+			Current:   latest != nil && latest.Id == chapter.Id,
+			Page:      chapter.Page,
+		}
+		if chapter.UploadUnix > 0 {
+			viewModel.Chapters[i].Uploaded = time.Unix(chapter.UploadUnix, 0).Format("02-01-06")
+		}
+	}
+
+	// Newest chapters first
+	slices.SortStableFunc(viewModel.Chapters, func(a, b view.ChapterViewModel) int {
+		an, aErr := strconv.ParseFloat(a.Number, 64)
+		bn, bErr := strconv.ParseFloat(b.Number, 64)
+		if aErr != nil || bErr != nil {
+			return cmp.Compare(b.Number, a.Number)
+		}
+		return cmp.Compare(bn, an)
+	})
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Manga")
+	}
+}
+
+func (s *Server) HandleMangaUpdate(w http.ResponseWriter, r *http.Request) {
+	defer redirectBack(w, r)
+
+	mangaStr := r.PostFormValue("mangaId")
+	mangaId, err := strconv.Atoi(mangaStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not convert id to int")
+		return
+	}
+
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not find manga")
+		return
+	}
+
+	// The scheduler logs and records failures
+	_, _ = s.Updates.Refresh(r.Context(), manga)
+}
+
+// redirectBack sends the browser back to the page a form was submitted from, or to the menu
+func redirectBack(w http.ResponseWriter, r *http.Request) {
+	target := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host && ref.Path != "" {
+		target = ref.RequestURI()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -2,19 +2,77 @@ package server
 
 import (
 	"net/http"
+
+	"github.com/pablu23/mangaGetter/internal/database"
 )
 
+// Auth puts the logged in user into the request context, either from the session cookie, the header of a trusted
+// proxy or an api token in the Authorization header. Without auth every request belongs to the default user
 func (s *Server) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, _ := r.Cookie("auth")
-		if r.URL.Path == "/login" || r.URL.Path == "/login/" {
-			next.ServeHTTP(w, r)
+		if !s.options.Auth.Enabled {
+			next.ServeHTTP(w, withUser(r, s.defaultUser, nil))
+			return
+		}
+		if bearer := bearerToken(r); bearer != "" {
+			user, token := s.tokenUser(bearer)
+			if user == nil {
+				writeApiError(w, http.StatusUnauthorized, "invalid api token")
+			} else if token.ReadOnly && !safeMethod(r.Method) {
+				writeApiError(w, http.StatusForbidden, "api token is read-only")
+			} else {
+				next.ServeHTTP(w, withUser(r, user, nil))
+			}
 			return
 		}
-		if s.secret == "" || (cookie != nil && cookie.Value == s.secret) {
+		if s.options.Auth.Get().Mode == ProxyAuth {
+			user, status := s.proxyUser(r)
+			if user != nil {
+				next.ServeHTTP(w, withUser(r, user, nil))
+			} else if isApiRequest(r) {
+				writeApiError(w, status, http.StatusText(status))
+			} else {
+				http.Error(w, http.StatusText(status), status)
+			}
+			return
+		}
+		if r.URL.Path == "/login" || r.URL.Path == "/login/oidc" ||
+			r.URL.Path == oidcCallbackPath || r.URL.Path == "/favicon.ico" {
 			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, session := s.sessionUser(w, r)
+		if user != nil {
+			next.ServeHTTP(w, withUser(r, user, session))
+		} else if isApiRequest(r) {
+			writeApiError(w, http.StatusUnauthorized, "not authenticated")
 		} else {
 			http.Redirect(w, r, "/login", http.StatusFound)
 		}
 	})
 }
+
+// Require only lets users with role or a higher one through to next, requests without a user are sent to the login
+func (s *Server) Require(role database.Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := s.user(r)
+		if user == nil {
+			if isApiRequest(r) {
+				writeApiError(w, http.StatusUnauthorized, "not authenticated")
+			} else {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			}
+			return
+		}
+		if !user.Can(role) {
+			if isApiRequest(r) {
+				writeApiError(w, http.StatusForbidden, "forbidden")
+			} else {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+			}
+			return
+		}
+		next(w, r)
+	}
+}
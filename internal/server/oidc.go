@@ -0,0 +1,581 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcCookie       = "oidc"
+	oidcCallbackPath = "/login/oidc/callback"
+	// oidcLoginTimeout is how long the browser may take to log in at the issuer
+	oidcLoginTimeout = 10 * time.Minute
+	// oidcKeyRefresh limits how often unknown key ids make us load the keys of the issuer again
+	oidcKeyRefresh = time.Minute
+	// oidcClockSkew is how far the clock of the issuer may be off
+	oidcClockSkew = time.Minute
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// OidcClient logs users in at an OpenID Connect issuer with the authorization code flow and PKCE.
+// The discovery document is loaded on the first login, so the server starts even if the issuer is down
+type OidcClient struct {
+	options OidcOptions
+	client  *http.Client
+
+	mutex       sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+func NewOidcClient(options OidcOptions) *OidcClient {
+	if options.UsernameClaim == "" {
+		options.UsernameClaim = "preferred_username"
+	}
+	return &OidcClient{
+		options: options,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// idTokenClaims are the claims of an id token that are checked, the username claim is read separately
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+
+	// Name is the user name new users get, taken from the username claim, email or subject
+	Name string `json:"-"`
+}
+
+// audience is either a single string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*a = list
+	return err
+}
+
+func (a audience) contains(value string) bool {
+	for _, v := range a {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *OidcClient) getJson(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the discovery document of the issuer, it is only loaded once it was loaded successfully
+func (c *OidcClient) discover(ctx context.Context) (*oidcDiscovery, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	err := c.getJson(ctx, strings.TrimSuffix(c.options.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(c.options.Issuer, "/") {
+		return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	c.discovery = &discovery
+	return c.discovery, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, errors.New("rsa exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// key returns the signing key with id kid, the keys of the issuer are loaded again if it is not known
+func (c *OidcClient) key(ctx context.Context, jwksUri string, kid string) (crypto.PublicKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(c.keysFetched) < oidcKeyRefresh {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	c.keysFetched = time.Now()
+	err := c.getJson(ctx, jwksUri, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warn().Err(err).Str("Kid", k.Kid).Msg("Skipping key of OpenID Connect issuer")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	c.keys = keys
+
+	if key, ok := c.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (c *OidcClient) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if key, ok := c.keys[kid]; ok {
+		return key, true
+	}
+	// Issuers with a single key sometimes leave out the key id
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// verifySignature checks the signature of a jws, only asymmetric algorithms are accepted
+func verifySignature(key crypto.PublicKey, alg string, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an rsa key")
+		}
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an ecdsa key")
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an id token and returns its claims
+func (c *OidcClient) verify(ctx context.Context, discovery *oidcDiscovery, idToken string, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token is not a jws")
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJson, &header)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Alg) != 5 {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	key, err := c.key(ctx, discovery.JwksUri, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(key, header.Alg, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims idTokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		return nil, fmt.Errorf("id token is from issuer %q", claims.Issuer)
+	case claims.Subject == "":
+		return nil, errors.New("id token has no subject")
+	case !claims.Audience.contains(c.options.ClientId):
+		return nil, errors.New("id token is not for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != c.options.ClientId:
+		return nil, errors.New("id token was issued to another party")
+	case now.Add(-oidcClockSkew).Unix() >= claims.Expiry:
+		return nil, errors.New("id token expired")
+	case claims.IssuedAt > now.Add(oidcClockSkew).Unix():
+		return nil, errors.New("id token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	var all map[string]any
+	err = json.Unmarshal(payload, &all)
+	if err != nil {
+		return nil, err
+	}
+	for _, claim := range []string{c.options.UsernameClaim, "email"} {
+		if name, ok := all[claim].(string); ok && strings.TrimSpace(name) != "" {
+			claims.Name = strings.TrimSpace(name)
+			break
+		}
+	}
+	if claims.Name == "" {
+		claims.Name = claims.Subject
+	}
+	return &claims, nil
+}
+
+// exchange trades the authorization code for an id token at the token endpoint
+func (c *OidcClient) exchange(ctx context.Context, discovery *oidcDiscovery, code string, verifier string, redirectUrl string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectUrl},
+		"code_verifier": {verifier},
+		"client_id":     {c.options.ClientId},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.options.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.options.ClientId), url.QueryEscape(c.options.ClientSecret))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("token endpoint returned %s: %w", resp.Status, err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.IdToken == "" {
+		return "", errors.New("token endpoint returned no id token")
+	}
+	return token.IdToken, nil
+}
+
+// redirectUrl returns where the issuer sends the browser back to
+func (c *OidcClient) redirectUrl(r *http.Request) string {
+	if c.options.RedirectUrl != "" {
+		return c.options.RedirectUrl
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oidcCallbackPath
+}
+
+// HandleOidcLogin sends the browser to the issuer. State, nonce and the PKCE verifier are kept in a short-lived
+// cookie until it comes back
+func (s *Server) HandleOidcLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	discovery, err := s.oidc.discover(r.Context())
+	if err != nil {
+		log.Error().Err(err).Str("Issuer", s.oidc.options.Issuer).Msg("Could not load OpenID Connect discovery document")
+		s.viewLogin(w, r, http.StatusBadGateway, view.LoginViewModel{Error: "Could not reach the login provider"})
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		values[i], _, err = newToken()
+		if err != nil {
+			log.Error().Err(err).Msg("Could not create OpenID Connect state")
+			s.viewLogin(w, r, http.StatusInternalServerError, view.LoginViewModel{Error: "Could not log in"})
+			return
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	challenge := sha256.Sum256([]byte(verifier))
+
+	authUrl, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		log.Error().Err(err).Str("Url", discovery.AuthorizationEndpoint).Msg("Invalid authorization endpoint")
+		s.viewLogin(w, r, http.StatusBadGateway, view.LoginViewModel{Error: "Could not reach the login provider"})
+		return
+	}
+	query := authUrl.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", s.oidc.options.ClientId)
+	query.Set("redirect_uri", s.oidc.redirectUrl(r))
+	query.Set("scope", "openid profile email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authUrl.RawQuery = query.Encode()
+
+	s.setOidcCookie(w, state+"."+nonce+"."+verifier, int(oidcLoginTimeout/time.Second))
+	http.Redirect(w, r, authUrl.String(), http.StatusFound)
+}
+
+func (s *Server) setOidcCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/login/oidc",
+		MaxAge:   maxAge,
+		Secure:   s.options.Auth.Get().Secure || s.options.Tls.Enabled,
+		HttpOnly: true,
+		// The issuer sends the browser back with a top level navigation, which Lax cookies survive
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// HandleOidcCallback verifies the id token the issuer sent the browser back with and logs in the user its subject is
+// linked to, new subjects get a new user
+func (s *Server) HandleOidcCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	fail := func(status int, message string, detail string) {
+		s.audit(r, database.AuthFailure, 0, "", "oidc: "+detail)
+		s.viewLogin(w, r, status, view.LoginViewModel{Error: message})
+	}
+
+	cookie, err := r.Cookie(oidcCookie)
+	s.setOidcCookie(w, "", -1)
+	if err != nil {
+		fail(http.StatusBadRequest, "Login took too long, try again", "no login in progress")
+		return
+	}
+	values := strings.Split(cookie.Value, ".")
+	if len(values) != 3 {
+		fail(http.StatusBadRequest, "Login took too long, try again", "invalid login cookie")
+		return
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail(http.StatusUnauthorized, "The login provider refused the login", e+" "+r.URL.Query().Get("error_description"))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(state)) != 1 {
+		fail(http.StatusBadRequest, "Login took too long, try again", "state does not match")
+		return
+	}
+
+	discovery, err := s.oidc.discover(r.Context())
+	if err != nil {
+		log.Error().Err(err).Str("Issuer", s.oidc.options.Issuer).Msg("Could not load OpenID Connect discovery document")
+		s.viewLogin(w, r, http.StatusBadGateway, view.LoginViewModel{Error: "Could not reach the login provider"})
+		return
+	}
+	idToken, err := s.oidc.exchange(r.Context(), discovery, r.URL.Query().Get("code"), verifier, s.oidc.redirectUrl(r))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not exchange OpenID Connect code")
+		fail(http.StatusBadGateway, "Could not log in at the login provider", err.Error())
+		return
+	}
+	claims, err := s.oidc.verify(r.Context(), discovery, idToken, nonce)
+	if err != nil {
+		log.Warn().Err(err).Msg("Rejected OpenID Connect id token")
+		fail(http.StatusUnauthorized, "Could not log in at the login provider", err.Error())
+		return
+	}
+
+	user, err := s.DbMgr.IdentityUser(claims.Issuer, claims.Subject)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user, err = s.DbMgr.CreateIdentityUser(claims.Issuer, claims.Subject, claims.Name, s.defaultRole())
+		if err == nil {
+			log.Info().Str("User", user.Name).Str("Subject", claims.Subject).Msg("Created user from OpenID Connect")
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Subject", claims.Subject).Msg("Could not load OpenID Connect user")
+		s.viewLogin(w, r, http.StatusInternalServerError, view.LoginViewModel{Error: "Could not log in"})
+		return
+	}
+	if user.Disabled {
+		s.audit(r, database.AuthFailure, user.Id, user.Name, "oidc: user is disabled")
+		s.viewLogin(w, r, http.StatusForbidden, view.LoginViewModel{Error: "User is disabled"})
+		return
+	}
+
+	label := deviceLabel(r.UserAgent())
+	err = s.startSession(w, r, user, label)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save session")
+		s.viewLogin(w, r, http.StatusInternalServerError, view.LoginViewModel{Error: "Could not log in"})
+		return
+	}
+	s.audit(r, database.AuthSuccess, user.Id, user.Name, label+" (oidc)")
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/provider"
+)
+
+const (
+	testClientId     = "mangagetter"
+	testClientSecret = "client-secret"
+)
+
+// mockIssuer is an OpenID Connect issuer that signs id tokens with the keys it publishes
+type mockIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mutex sync.Mutex
+	// published are the keys served as jwks, signing is the key id new tokens are signed with
+	published map[string]crypto.Signer
+	signing   string
+	// discovery changes the discovery document before it is served
+	discovery func(doc map[string]string)
+	// claims changes the claims of tokens issued by the token endpoint
+	claims            func(claims map[string]any)
+	codes             map[string]mockCode
+	discoveryRequests int
+	jwksRequests      int
+}
+
+type mockCode struct {
+	challenge   string
+	nonce       string
+	redirectUri string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	issuer := &mockIssuer{
+		t:         t,
+		published: map[string]crypto.Signer{"rsa": newRsaKey(t)},
+		signing:   "rsa",
+		codes:     make(map[string]mockCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc("GET /jwks", issuer.handleJwks)
+	mux.HandleFunc("GET /authorize", issuer.handleAuthorize)
+	mux.HandleFunc("POST /token", issuer.handleToken)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (m *mockIssuer) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.discoveryRequests++
+	doc := map[string]string{
+		"issuer":                 m.server.URL,
+		"authorization_endpoint": m.server.URL + "/authorize",
+		"token_endpoint":         m.server.URL + "/token",
+		"jwks_uri":               m.server.URL + "/jwks",
+	}
+	if m.discovery != nil {
+		m.discovery(doc)
+	}
+	_ = json.NewEncoder(w).Encode(doc)
+}
+
+func (m *mockIssuer) handleJwks(w http.ResponseWriter, _ *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.jwksRequests++
+	var keys []jsonWebKey
+	for kid, key := range m.published {
+		keys = append(keys, publicJwk(kid, key.Public()))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+// handleAuthorize logs everybody in and sends the browser straight back with a code
+func (m *mockIssuer) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != testClientId ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("nonce") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString(m.t)
+	m.mutex.Lock()
+	m.codes[code] = mockCode{
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		redirectUri: query.Get("redirect_uri"),
+	}
+	m.mutex.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// handleToken checks the code, the PKCE verifier and the client credentials like a real issuer
+func (m *mockIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(e string) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": e})
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != testClientId || secret != testClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		tokenError("unsupported_grant_type")
+		return
+	}
+
+	m.mutex.Lock()
+	code, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mutex.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || code.redirectUri != r.PostFormValue("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	claims := m.validClaims(code.nonce)
+	m.mutex.Lock()
+	if m.claims != nil {
+		m.claims(claims)
+	}
+	m.mutex.Unlock()
+	_ = json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(claims)})
+}
+
+func (m *mockIssuer) validClaims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":                m.server.URL,
+		"sub":                "subject-1",
+		"aud":                testClientId,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"preferred_username": "alice",
+	}
+}
+
+// sign signs claims with the current signing key
+func (m *mockIssuer) sign(claims map[string]any) string {
+	m.mutex.Lock()
+	kid, key := m.signing, m.published[m.signing]
+	m.mutex.Unlock()
+	return signJwt(m.t, kid, key, claims)
+}
+
+// rotate publishes only key under kid and signs new tokens with it
+func (m *mockIssuer) rotate(kid string, key crypto.Signer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.published = map[string]crypto.Signer{kid: key}
+	m.signing = kid
+}
+
+func (m *mockIssuer) client() *OidcClient {
+	return NewOidcClient(OidcOptions{
+		Issuer:       m.server.URL,
+		ClientId:     testClientId,
+		ClientSecret: testClientSecret,
+	})
+}
+
+func signJwt(t *testing.T, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func publicJwk(kid string, key crypto.PublicKey) jsonWebKey {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{Kid: kid, Kty: "RSA", Use: "sig", N: encode(k.N), E: encode(big.NewInt(int64(k.E)))}
+	case *ecdsa.PublicKey:
+		return jsonWebKey{Kid: kid, Kty: "EC", Use: "sig", Crv: "P-256", X: encode(k.X), Y: encode(k.Y)}
+	}
+	return jsonWebKey{}
+}
+
+func newRsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEcKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func randomString(t *testing.T) string {
+	t.Helper()
+	token, _, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOidcDiscovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(doc map[string]string)
+		wantErr string
+	}{
+		{"valid", nil, ""},
+		{"other issuer", func(doc map[string]string) { doc["issuer"] = "https://evil.example.com" }, "is for issuer"},
+		{"missing jwks", func(doc map[string]string) { delete(doc, "jwks_uri") }, "missing endpoints"},
+		{"missing token endpoint", func(doc map[string]string) { doc["token_endpoint"] = "" }, "missing endpoints"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newMockIssuer(t)
+			issuer.discovery = test.change
+			client := issuer.client()
+
+			discovery, err := client.discover(context.Background())
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("discover() error = %v, want %q", err, test.wantErr)
+				}
+				// A broken document is not kept, the next login tries again
+				_, _ = client.discover(context.Background())
+				if issuer.discoveryRequests != 2 {
+					t.Errorf("discovery was loaded %d times, want 2", issuer.discoveryRequests)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if discovery.JwksUri != issuer.server.URL+"/jwks" {
+				t.Errorf("jwks uri is %q", discovery.JwksUri)
+			}
+			_, err = client.discover(context.Background())
+			if err != nil || issuer.discoveryRequests != 1 {
+				t.Errorf("discovery was loaded %d times, %v, want it cached", issuer.discoveryRequests, err)
+			}
+		})
+	}
+}
+
+func TestOidcKeyRotation(t *testing.T) {
+	issuer := newMockIssuer(t)
+	client := issuer.client()
+	ctx := context.Background()
+	discovery, err := client.discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldToken := issuer.sign(issuer.validClaims("nonce"))
+	_, err = client.verify(ctx, discovery, oldToken, "nonce")
+	if err != nil {
+		t.Fatalf("token of the first key: %v", err)
+	}
+
+	issuer.rotate("ec", newEcKey(t))
+	rotatedToken := issuer.sign(issuer.validClaims("nonce"))
+	_, err = client.verify(ctx, discovery, rotatedToken, "nonce")
+	if err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("new key right after loading the keys: %v, want unknown key", err)
+	}
+	if issuer.jwksRequests != 1 {
+		t.Fatalf("keys were loaded %d times within %s, want 1", issuer.jwksRequests, oidcKeyRefresh)
+	}
+
+	// Once the keys are old enough an unknown key id loads them again
+	client.keysFetched = time.Now().Add(-oidcKeyRefresh)
+	_, err = client.verify(ctx, discovery, rotatedToken, "nonce")
+	if err != nil {
+		t.Fatalf("token of the rotated key: %v", err)
+	}
+	if issuer.jwksRequests != 2 {
+		t.Errorf("keys were loaded %d times, want 2", issuer.jwksRequests)
+	}
+	_, err = client.verify(ctx, discovery, oldToken, "nonce")
+	if err == nil {
+		t.Error("token of the removed key was accepted")
+	}
+}
+
+func TestOidcVerify(t *testing.T) {
+	issuer := newMockIssuer(t)
+	client := issuer.client()
+	ctx := context.Background()
+	discovery, err := client.discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := newRsaKey(t)
+
+	tests := []struct {
+		name string
+		// change the claims, token replaces the signed token if it is set
+		change   func(claims map[string]any)
+		token    func(claims map[string]any) string
+		wantErr  string
+		wantName string
+	}{
+		{name: "valid", wantName: "alice"},
+		{name: "email as name", change: func(c map[string]any) { delete(c, "preferred_username"); c["email"] = "a@b.c" }, wantName: "a@b.c"},
+		{name: "subject as name", change: func(c map[string]any) { delete(c, "preferred_username") }, wantName: "subject-1"},
+		{name: "audience list with azp", change: func(c map[string]any) {
+			c["aud"] = []string{testClientId, "other"}
+			c["azp"] = testClientId
+		}, wantName: "alice"},
+		{name: "expired within clock skew", change: func(c map[string]any) { c["exp"] = time.Now().Add(-oidcClockSkew / 2).Unix() }, wantName: "alice"},
+
+		{name: "bad signature", token: func(c map[string]any) string { return signJwt(t, "rsa", otherKey, c) }, wantErr: "verification error"},
+		{name: "changed payload", token: func(c map[string]any) string {
+			parts := strings.Split(issuer.sign(c), ".")
+			c["sub"] = "admin"
+			payload, _ := json.Marshal(c)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}, wantErr: "verification error"},
+		{name: "symmetric algorithm", token: func(c map[string]any) string {
+			return jwtWithHeader(t, `{"alg":"HS256","kid":"rsa"}`, c)
+		}, wantErr: "unsupported algorithm"},
+		{name: "no algorithm", token: func(c map[string]any) string {
+			return jwtWithHeader(t, `{"alg":"none","kid":"rsa"}`, c)
+		}, wantErr: "unsupported algorithm"},
+		{name: "not a jws", token: func(map[string]any) string { return "abc.def" }, wantErr: "not a jws"},
+		{name: "other issuer", change: func(c map[string]any) { c["iss"] = "https://evil.example.com" }, wantErr: "from issuer"},
+		{name: "no subject", change: func(c map[string]any) { c["sub"] = "" }, wantErr: "no subject"},
+		{name: "other audience", change: func(c map[string]any) { c["aud"] = "other" }, wantErr: "not for this client"},
+		{name: "audience list without azp", change: func(c map[string]any) { c["aud"] = []string{testClientId, "other"} }, wantErr: "another party"},
+		{name: "other azp", change: func(c map[string]any) {
+			c["aud"] = []string{testClientId, "other"}
+			c["azp"] = "other"
+		}, wantErr: "another party"},
+		{name: "expired", change: func(c map[string]any) { c["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix() }, wantErr: "expired"},
+		{name: "no expiry", change: func(c map[string]any) { delete(c, "exp") }, wantErr: "expired"},
+		{name: "issued in the future", change: func(c map[string]any) { c["iat"] = time.Now().Add(2 * oidcClockSkew).Unix() }, wantErr: "future"},
+		{name: "other nonce", change: func(c map[string]any) { c["nonce"] = "replayed" }, wantErr: "nonce"},
+		{name: "no nonce", change: func(c map[string]any) { delete(c, "nonce") }, wantErr: "nonce"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := issuer.validClaims("nonce")
+			if test.change != nil {
+				test.change(claims)
+			}
+			token := issuer.sign(claims)
+			if test.token != nil {
+				token = test.token(claims)
+			}
+
+			verified, err := client.verify(ctx, discovery, token, "nonce")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("verify() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verified.Name != test.wantName || verified.Subject != "subject-1" {
+				t.Errorf("verified %+v, want name %q", verified, test.wantName)
+			}
+		})
+	}
+}
+
+func jwtWithHeader(t *testing.T, header string, claims map[string]any) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString([]byte("signature"))
+}
+
+// newOidcServer serves the routes of a Server that logs in at issuer
+func newOidcServer(t *testing.T, issuer *mockIssuer) (*Server, *httptest.Server) {
+	t.Helper()
+	db := database.NewDatabase(filepath.Join(t.TempDir(), "db.sqlite"), true, false)
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	s := New(provider.NewRegistry(), &db, http.NewServeMux(), func(o *Options) {
+		o.Auth.Set(AuthOptions{
+			Mode:   OidcAuth,
+			MaxAge: 3600,
+			Oidc: OidcOptions{
+				Issuer:       issuer.server.URL,
+				ClientId:     testClientId,
+				ClientSecret: testClientSecret,
+			},
+			DefaultRole: database.RoleReader,
+		})
+	})
+	t.Cleanup(s.cancel)
+	s.secret = "hunter2"
+	s.oidc = NewOidcClient(s.options.Auth.Get().Oidc)
+	err = s.setupUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterRoutes()
+
+	app := httptest.NewServer(s.Csrf(s.Auth(s.mux)))
+	t.Cleanup(app.Close)
+	return s, app
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func TestOidcCallback(t *testing.T) {
+	issuer := newMockIssuer(t)
+	s, app := newOidcServer(t, issuer)
+
+	login := func(browser *http.Client) *http.Response {
+		t.Helper()
+		resp, err := browser.Get(app.URL + "/login/oidc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	browser := newBrowser(t)
+	resp := login(browser)
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Fatalf("login ended on %s with %s, want the menu", resp.Request.URL, resp.Status)
+	}
+	user, err := s.DbMgr.IdentityUser(issuer.server.URL, "subject-1")
+	if err != nil {
+		t.Fatalf("no user for the subject: %v", err)
+	}
+	if user.Name != "alice" || user.Role != database.RoleReader {
+		t.Errorf("created user %q with role %q", user.Name, user.Role)
+	}
+
+	// The session cookie works like one of a password login
+	resp, err = browser.Get(app.URL + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/sessions" {
+		t.Errorf("sessions page ended on %s with %s", resp.Request.URL, resp.Status)
+	}
+
+	// The next login of the subject finds the same user
+	login(newBrowser(t))
+	var count int64
+	s.DbMgr.Db.Model(&database.User{}).Where("name LIKE ?", "alice%").Count(&count)
+	if count != 1 {
+		t.Errorf("%d users for the subject, want 1", count)
+	}
+
+	t.Run("rejected token", func(t *testing.T) {
+		issuer.claims = func(c map[string]any) { c["nonce"] = "replayed" }
+		defer func() { issuer.claims = nil }()
+		resp := login(newBrowser(t))
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("login with another nonce returned %s, want 401", resp.Status)
+		}
+	})
+
+	t.Run("state mismatch", func(t *testing.T) {
+		browser := newBrowser(t)
+		browser.CheckRedirect = func(req *http.Request, _ []*http.Request) error {
+			if req.URL.Path == oidcCallbackPath {
+				query := req.URL.Query()
+				query.Set("state", "forged")
+				req.URL.RawQuery = query.Encode()
+			}
+			return nil
+		}
+		resp := login(browser)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("login with a forged state returned %s, want 400", resp.Status)
+		}
+	})
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		browser := newBrowser(t)
+		browser.CheckRedirect = func(req *http.Request, _ []*http.Request) error {
+			if req.URL.Path != oidcCallbackPath {
+				return nil
+			}
+			// Replace the verifier in the login cookie, the issuer has to refuse the code
+			for _, cookie := range browser.Jar.Cookies(req.URL) {
+				if cookie.Name != oidcCookie {
+					continue
+				}
+				values := strings.Split(cookie.Value, ".")
+				values[2] = randomString(t)
+				req.Header.Set("Cookie", oidcCookie+"="+strings.Join(values, "."))
+			}
+			return nil
+		}
+		resp := login(browser)
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("login with another verifier returned %s, want 502", resp.Status)
+		}
+	})
+
+	t.Run("no login in progress", func(t *testing.T) {
+		resp, err := newBrowser(t).Get(app.URL + oidcCallbackPath + "?code=abc&state=def")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("callback without a login returned %s, want 400", resp.Status)
+		}
+	})
+
+	var sessions int64
+	s.DbMgr.Db.Model(&database.Session{}).Count(&sessions)
+	if sessions != 2 {
+		t.Errorf("%d sessions, only the 2 successful logins should have one", sessions)
+	}
+}
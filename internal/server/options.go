@@ -1,12 +1,28 @@
 package server
 
-import "time"
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+)
 
 type Options struct {
 	Port           int
 	Auth           Optional[AuthOptions]
 	Tls            Optional[TlsOptions]
 	UpdateInterval time.Duration
+	Updates        UpdateOptions
+	// ReaderTimeout is how long an unused Reader keeps its chapters, 0 keeps them forever
+	ReaderTimeout time.Duration
+	// CacheSize is the budget of the image cache in bytes, 0 disables eviction
+	CacheSize int64
+	DiskCache Optional[DiskCacheOptions]
+	Downloads Optional[DownloadOptions]
+	// ShutdownTimeout is how long open requests get to finish on shutdown, cancelled background jobs get as long again
+	ShutdownTimeout time.Duration
 }
 
 type Optional[v any] struct {
@@ -35,12 +51,92 @@ const (
 	File
 )
 
+type AuthMode int
+
+const (
+	// PasswordAuth logs users in with the login form
+	PasswordAuth AuthMode = iota
+	// ProxyAuth trusts the user name a reverse proxy puts into ProxyHeader
+	ProxyAuth
+	// OidcAuth logs users in at an OpenID Connect issuer, the login form stays available for local users
+	OidcAuth
+)
+
 type AuthOptions struct {
+	Mode AuthMode
 	// Secret Direct or Path to secret File
 	Secret   string
 	LoadType AuthType
 	Secure   bool
 	MaxAge   int
+	// ProxyHeader is only trusted on requests from TrustedProxies, users it names are created on their first request
+	ProxyHeader    string
+	TrustedProxies []netip.Prefix
+	Oidc           OidcOptions
+	// DefaultRole is given to users created by the proxy or OpenID Connect
+	DefaultRole database.Role
+}
+
+type OidcOptions struct {
+	// Issuer is the url the discovery document is loaded from, without /.well-known/openid-configuration
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// RedirectUrl is where the issuer sends the browser back to, built from the request if empty
+	RedirectUrl string
+	// UsernameClaim is the claim of the id token new users are named after
+	UsernameClaim string
+}
+
+// ParseTrustedProxies reads a comma separated list of CIDRs, single addresses are allowed as well
+func ParseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type DiskCacheOptions struct {
+	Path string
+	// MaxSize in bytes, 0 for unlimited
+	MaxSize int64
+	// MaxAge since the last access, 0 keeps images forever
+	MaxAge time.Duration
+}
+
+type DownloadOptions struct {
+	// Path to the directory the CBZ files are written to
+	Path string
+	// Workers is the number of chapters downloaded at the same time
+	Workers int
+}
+
+type UpdateOptions struct {
+	// Workers is the number of mangas updated at the same time
+	Workers int
+	// HostInterval is the least time between two updates from the same host
+	HostInterval time.Duration
+	// MaxBackoff caps how long a manga that keeps failing to update is skipped
+	MaxBackoff time.Duration
+	// MaxInterval caps how long a manga waits for its next release without being updated
+	MaxInterval time.Duration
 }
 
 type TlsOptions struct {
@@ -57,6 +153,24 @@ func NewDefaultOptions() Options {
 		Tls: Optional[TlsOptions]{
 			Enabled: false,
 		},
+		DiskCache: Optional[DiskCacheOptions]{
+			Enabled: false,
+		},
+		Downloads: Optional[DownloadOptions]{
+			Enabled: false,
+			value: DownloadOptions{
+				Workers: 2,
+			},
+		},
 		UpdateInterval: 15 * time.Minute,
+		Updates: UpdateOptions{
+			Workers:      4,
+			HostInterval: 2 * time.Second,
+			MaxBackoff:   24 * time.Hour,
+			MaxInterval:  72 * time.Hour,
+		},
+		ReaderTimeout:   12 * time.Hour,
+		CacheSize:       512 << 20,
+		ShutdownTimeout: 10 * time.Second,
 	}
 }
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// trustedProxy reports whether the request comes directly from one of the trusted proxies
+func (s *Server) trustedProxy(r *http.Request) bool {
+	addr, err := netip.ParseAddr(remoteAddress(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.options.Auth.Get().TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyUser returns the user named in the proxy header, it is created if it does not exist yet.
+// The status is the error to answer with if there is no user
+func (s *Server) proxyUser(r *http.Request) (*database.User, int) {
+	header := s.options.Auth.Get().ProxyHeader
+	name := strings.TrimSpace(r.Header.Get(header))
+	_, sent := r.Header[http.CanonicalHeaderKey(header)]
+
+	if !s.trustedProxy(r) {
+		if sent {
+			log.Warn().Str("Header", header).Str("User", name).Str("Address", remoteAddress(r)).
+				Msg("Rejected proxy header from untrusted address")
+			s.audit(r, database.AuthFailure, 0, name, "proxy header from untrusted address")
+			return nil, http.StatusForbidden
+		}
+		return nil, http.StatusUnauthorized
+	}
+	if name == "" {
+		return nil, http.StatusUnauthorized
+	}
+
+	user, err := s.DbMgr.UserByName(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Users created by the proxy have no password, so they can only log in through it
+		user, err = s.DbMgr.CreateUser(name, "", s.defaultRole())
+		if err != nil {
+			// Another request might have created the user in the meantime
+			user, err = s.DbMgr.UserByName(name)
+		} else {
+			log.Info().Str("User", name).Msg("Created user from proxy header")
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("User", name).Msg("Could not load proxy user")
+		return nil, http.StatusInternalServerError
+	}
+	if user.Disabled {
+		return nil, http.StatusForbidden
+	}
+	return user, http.StatusOK
+}
+
+// defaultRole is the role of users that are created on their first login
+func (s *Server) defaultRole() database.Role {
+	if role := s.options.Auth.Get().DefaultRole; role != "" {
+		return role
+	}
+	return database.RoleReader
+}
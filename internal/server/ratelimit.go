@@ -0,0 +1,88 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// forgetFailures is how long failed logins are remembered after the last one
+const forgetFailures = 24 * time.Hour
+
+type loginAttempts struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// LoginLimiter counts failed logins per key, like an address or a user name. After free failures the key is locked,
+// every further failure doubles the lockout from base up to max
+type LoginLimiter struct {
+	mutex    sync.Mutex
+	attempts map[string]*loginAttempts
+	free     int
+	base     time.Duration
+	max      time.Duration
+}
+
+func NewLoginLimiter(free int, base time.Duration, max time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		attempts: make(map[string]*loginAttempts),
+		free:     free,
+		base:     base,
+		max:      max,
+	}
+}
+
+// Locked returns how long key is still locked out, 0 if it is not
+func (l *LoginLimiter) Locked(key string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	a, ok := l.attempts[key]
+	if !ok || !now.Before(a.lockedUntil) {
+		return 0
+	}
+	return a.lockedUntil.Sub(now)
+}
+
+// Fail records a failed login of key and returns how long it is locked out because of it, 0 if it is not
+func (l *LoginLimiter) Fail(key string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.attempts) >= 1000 {
+		l.forget(now)
+	}
+
+	a, ok := l.attempts[key]
+	if !ok || now.Sub(a.last) > forgetFailures {
+		a = &loginAttempts{}
+		l.attempts[key] = a
+	}
+	a.failures++
+	a.last = now
+	if a.failures < l.free {
+		return 0
+	}
+
+	lockout := l.base
+	for i := l.free; i < a.failures && lockout < l.max; i++ {
+		lockout *= 2
+	}
+	lockout = min(lockout, l.max)
+	a.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// Reset forgets the failed logins of key after a successful one
+func (l *LoginLimiter) Reset(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.attempts, key)
+}
+
+func (l *LoginLimiter) forget(now time.Time) {
+	for key, a := range l.attempts {
+		if now.Sub(a.last) > forgetFailures && !now.Before(a.lockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+}
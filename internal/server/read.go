@@ -0,0 +1,250 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/provider"
+	"github.com/rs/zerolog/log"
+)
+
+// SyncChapters stores every chapter in infos, chapters that are not known yet are added as unread
+// and the metadata of known ones is refreshed. It returns the chapters that were released since the last sync
+// and true if the manga itself was changed and has to be saved
+func (s *Server) SyncChapters(manga *database.Manga, infos []provider.ChapterInfo) ([]database.Chapter, bool, error) {
+	// Chapters might not be preloaded, so ask the database which ones are known
+	var existing []database.Chapter
+	err := s.DbMgr.Db.Where("manga_id = ?", manga.Id).Find(&existing).Error
+	if err != nil {
+		return nil, false, err
+	}
+	// Chapters found on the first sync were already out when the manga was added
+	var discovered int64
+	if manga.ChapterCount > 0 {
+		discovered = time.Now().Unix()
+	}
+	// Keep the progress of the user the chapters were loaded for
+	loaded := make(map[int]database.Chapter, len(manga.Chapters))
+	for _, chapter := range manga.Chapters {
+		loaded[chapter.Id] = chapter
+	}
+	known := make(map[int]*database.Chapter, len(existing))
+	for i := range existing {
+		if chapter, ok := loaded[existing[i].Id]; ok {
+			existing[i].TimeStampUnix = chapter.TimeStampUnix
+			existing[i].Read = chapter.Read
+			existing[i].ReadUnix = chapter.ReadUnix
+			existing[i].Page = chapter.Page
+		}
+		known[existing[i].ProviderId] = &existing[i]
+	}
+
+	var added []database.Chapter
+	for _, info := range infos {
+		chapter, ok := known[info.Id]
+		if !ok {
+			c := database.NewChapter(info.Id, manga.Id, info.SubUrl, "ch_"+info.Number, info.Number, 0)
+			c.DiscoveredUnix = discovered
+			applyChapterInfo(&c, info)
+			added = append(added, c)
+			known[info.Id] = &c
+			continue
+		}
+
+		if applyChapterInfo(chapter, info) {
+			err = s.DbMgr.Db.Model(chapter).
+				Select("url", "number", "title", "volume", "scanlator", "upload_unix").
+				Updates(chapter).Error
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	if len(added) > 0 {
+		err = s.DbMgr.Db.Create(&added).Error
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	manga.Chapters = existing
+	manga.Chapters = append(manga.Chapters, added...)
+
+	var released []database.Chapter
+	if discovered > 0 {
+		released = added
+	}
+	if manga.ChapterCount == len(infos) {
+		return released, false, nil
+	}
+	manga.ChapterCount = len(infos)
+	return released, true, nil
+}
+
+// applyChapterInfo copies the provider metadata into chapter and reports whether anything changed
+func applyChapterInfo(chapter *database.Chapter, info provider.ChapterInfo) bool {
+	changed := chapter.Url != info.SubUrl || chapter.Number != info.Number || chapter.Title != info.Title ||
+		chapter.Volume != info.Volume || chapter.Scanlator != info.Scanlator || chapter.UploadUnix != info.UploadUnix
+	chapter.Url = info.SubUrl
+	chapter.Number = info.Number
+	chapter.Title = info.Title
+	chapter.Volume = info.Volume
+	chapter.Scanlator = info.Scanlator
+	chapter.UploadUnix = info.UploadUnix
+	return changed
+}
+
+// SetChapterRead marks chapter as read or unread for the user, its progress has to be loaded already
+func (s *Server) SetChapterRead(userId int, chapter *database.Chapter, read bool) error {
+	chapter.Read = read
+	if read {
+		chapter.ReadUnix = time.Now().Unix()
+	} else {
+		chapter.ReadUnix = 0
+		chapter.Page = 0
+	}
+	return s.DbMgr.SaveUserChapter(userId, chapter)
+}
+
+// MarkChapterRead marks the chapter at subUrl as read, it is saved as progress first if it is not known yet
+func (s *Server) MarkChapterRead(userId int, p provider.Provider, subUrl string) error {
+	_, chapter, err := s.findChapter(p, subUrl)
+	if err != nil {
+		chapter, err = s.SaveProgress(userId, p, subUrl)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = s.DbMgr.LoadChapterState(userId, chapter)
+		if err != nil {
+			return err
+		}
+	}
+	return s.SetChapterRead(userId, chapter, true)
+}
+
+// MarkReadUpTo marks every chapter of manga with a number up to and including number as read or unread,
+// manga has to be loaded from the library of the user
+func (s *Server) MarkReadUpTo(userId int, manga *database.Manga, number float64, read bool) error {
+	if manga.ChapterCount == 0 {
+		err, updated := s.UpdateLatestAvailableChapter(manga)
+		if err != nil {
+			log.Warn().Err(err).Str("Manga", manga.Title).Msg("Could not load chapter list, only marking known chapters")
+		} else if updated {
+			s.DbMgr.SaveMangaUpdate(manga)
+		}
+	}
+
+	for i := range manga.Chapters {
+		chapter := &manga.Chapters[i]
+		n, ok := chapter.NumberValue()
+		if !ok || n > number || chapter.Read == read {
+			continue
+		}
+		err := s.SetChapterRead(userId, chapter, read)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SavePosition remembers the last viewed image of the chapter at subUrl, reaching the last image marks it as read
+func (s *Server) SavePosition(userId int, p provider.Provider, subUrl string, page int, pages int) error {
+	_, chapter, err := s.findChapter(p, subUrl)
+	if err != nil {
+		return err
+	}
+	err = s.DbMgr.LoadChapterState(userId, chapter)
+	if err != nil {
+		return err
+	}
+
+	chapter.Page = page
+	if page >= pages-1 && !chapter.Read {
+		return s.SetChapterRead(userId, chapter, true)
+	}
+	return s.DbMgr.SaveUserChapter(userId, chapter)
+}
+
+func (s *Server) HandlePosition(w http.ResponseWriter, r *http.Request) {
+	rd, ok := s.Readers.Lookup(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	page, err := strconv.Atoi(r.PostFormValue("page"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	p, subUrl, viewModel := rd.Current()
+	if p == nil || viewModel == nil || r.PostFormValue("subUrl") != subUrl {
+		// The reader already moved on to another chapter
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	err = s.SavePosition(s.userId(r), p, subUrl, page, len(viewModel.Images))
+	if err != nil {
+		log.Error().Err(err).Str("subUrl", subUrl).Msg("Could not save position")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) HandleChapterRead(w http.ResponseWriter, r *http.Request) {
+	defer redirectBack(w, r)
+
+	chapterStr := r.PostFormValue("chapterId")
+	chapterId, err := strconv.Atoi(chapterStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", chapterStr).Msg("Could not convert id to int")
+		return
+	}
+
+	chapter, err := s.DbMgr.LibraryChapter(s.userId(r), chapterId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", chapterId).Msg("Could not find chapter")
+		return
+	}
+
+	err = s.SetChapterRead(s.userId(r), chapter, r.PostFormValue("read") == "true")
+	if err != nil {
+		log.Error().Err(err).Int("Id", chapterId).Msg("Could not mark chapter")
+	}
+}
+
+func (s *Server) HandleMangaRead(w http.ResponseWriter, r *http.Request) {
+	defer redirectBack(w, r)
+
+	mangaStr := r.PostFormValue("mangaId")
+	mangaId, err := strconv.Atoi(mangaStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not convert id to int")
+		return
+	}
+
+	to, err := parseChapterNumber(r.PostFormValue("to"), math.Inf(1))
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid chapter number")
+		return
+	}
+
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not find manga")
+		return
+	}
+
+	err = s.MarkReadUpTo(s.userId(r), manga, to, r.PostFormValue("read") == "true")
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not mark chapters")
+	}
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/cache"
+	"github.com/pablu23/mangaGetter/internal/provider"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+)
+
+const readerCookieName = "reader"
+
+type imageSource struct {
+	provider provider.Provider
+	url      string
+	mangaId  int
+}
+
+// Reader is the reading window of a single browser. It holds the previous, current and next chapter
+// together with their images, so every browser can read independently of the others
+type Reader struct {
+	Id string
+
+	PrevViewModel *view.ImageViewModel
+	CurrViewModel *view.ImageViewModel
+	NextViewModel *view.ImageViewModel
+
+	// sources maps the cache keys of all loaded images to where they came from, so evicted images can be downloaded again
+	sources map[string]imageSource
+	images  *cache.Cache
+	fetcher *Fetcher
+
+	NextSubUrl string
+	CurrSubUrl string
+	PrevSubUrl string
+
+	Provider provider.Provider
+
+	// Mutex guards all fields of the Reader, it is never held while downloading
+	Mutex *sync.Mutex
+
+	// ctx is cancelled on shutdown, prefetches are counted in jobs so shutdown can wait for them
+	ctx  context.Context
+	jobs *sync.WaitGroup
+
+	// generation is increased on every navigation, loads started for an older generation are thrown away
+	generation uint64
+	nextDone   chan struct{}
+	prevDone   chan struct{}
+	lastAccess time.Time
+}
+
+func newReader(ctx context.Context, jobs *sync.WaitGroup, id string, images *cache.Cache, fetcher *Fetcher) *Reader {
+	return &Reader{
+		Id:         id,
+		sources:    make(map[string]imageSource),
+		images:     images,
+		fetcher:    fetcher,
+		ctx:        ctx,
+		jobs:       jobs,
+		Mutex:      &sync.Mutex{},
+		lastAccess: time.Now(),
+	}
+}
+
+// Open replaces the current chapter with subUrl, loads it and starts prefetching its neighbours
+func (rd *Reader) Open(p provider.Provider, subUrl string) error {
+	rd.Mutex.Lock()
+	rd.releaseAll()
+	rd.generation++
+	gen := rd.generation
+	rd.Provider = p
+	rd.CurrSubUrl = subUrl
+	rd.Mutex.Unlock()
+
+	vm, err := rd.loadChapter(p, subUrl)
+
+	rd.Mutex.Lock()
+	defer rd.Mutex.Unlock()
+	if rd.generation != gen {
+		rd.release(vm)
+		return errors.New("chapter was replaced while loading")
+	}
+	if err != nil {
+		rd.CurrSubUrl = ""
+		return err
+	}
+	rd.CurrViewModel = vm
+	rd.pin(vm)
+	rd.startNext()
+	rd.startPrev()
+	return nil
+}
+
+// Next moves the window one chapter forward, it waits for a running prefetch of the next chapter.
+// Returns false if there is no next chapter
+func (rd *Reader) Next(ctx context.Context) bool {
+	rd.Mutex.Lock()
+	done := rd.nextDone
+	rd.Mutex.Unlock()
+	wait(ctx, done)
+
+	rd.Mutex.Lock()
+	defer rd.Mutex.Unlock()
+	if rd.NextViewModel == nil || rd.NextSubUrl == "" {
+		return false
+	}
+
+	rd.release(rd.PrevViewModel)
+	rd.unpin(rd.CurrViewModel)
+	rd.pin(rd.NextViewModel)
+	rd.PrevViewModel, rd.CurrViewModel, rd.NextViewModel = rd.CurrViewModel, rd.NextViewModel, nil
+	rd.PrevSubUrl, rd.CurrSubUrl, rd.NextSubUrl = rd.CurrSubUrl, rd.NextSubUrl, ""
+	rd.generation++
+	rd.prevDone = nil
+	rd.startNext()
+	return true
+}
+
+// Prev moves the window one chapter back, it waits for a running prefetch of the previous chapter.
+// Returns false if there is no previous chapter
+func (rd *Reader) Prev(ctx context.Context) bool {
+	rd.Mutex.Lock()
+	done := rd.prevDone
+	rd.Mutex.Unlock()
+	wait(ctx, done)
+
+	rd.Mutex.Lock()
+	defer rd.Mutex.Unlock()
+	if rd.PrevViewModel == nil || rd.PrevSubUrl == "" {
+		return false
+	}
+
+	rd.release(rd.NextViewModel)
+	rd.unpin(rd.CurrViewModel)
+	rd.pin(rd.PrevViewModel)
+	rd.NextViewModel, rd.CurrViewModel, rd.PrevViewModel = rd.CurrViewModel, rd.PrevViewModel, nil
+	rd.NextSubUrl, rd.CurrSubUrl, rd.PrevSubUrl = rd.CurrSubUrl, rd.PrevSubUrl, ""
+	rd.generation++
+	rd.nextDone = nil
+	rd.startPrev()
+	return true
+}
+
+// Close drops all chapters and images of the Reader
+func (rd *Reader) Close() {
+	rd.Mutex.Lock()
+	defer rd.Mutex.Unlock()
+	rd.generation++
+	rd.releaseAll()
+	rd.CurrSubUrl = ""
+	rd.nextDone = nil
+	rd.prevDone = nil
+	log.Debug().Str("Reader", rd.Id).Msg("Cleaned up images")
+}
+
+// Current returns a snapshot of the current chapter
+func (rd *Reader) Current() (provider.Provider, string, *view.ImageViewModel) {
+	rd.Mutex.Lock()
+	defer rd.Mutex.Unlock()
+	return rd.Provider, rd.CurrSubUrl, rd.CurrViewModel
+}
+
+// Image returns the image with the cache key of a chapter in this Reader, if it was evicted it is downloaded again
+func (rd *Reader) Image(key string) []byte {
+	if buf, ok := rd.images.Get(key); ok {
+		return buf
+	}
+
+	rd.Mutex.Lock()
+	source, ok := rd.sources[key]
+	rd.Mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	buf, err := rd.fetcher.Fetch(rd.ctx, source.provider, source.url, source.mangaId)
+	if err != nil {
+		log.Error().Err(err).Str("Url", source.url).Msg("Could not download evicted image")
+		return nil
+	}
+	rd.images.Add(key, buf)
+	return buf
+}
+
+// startNext starts prefetching the next chapter, the caller has to hold the Mutex
+func (rd *Reader) startNext() {
+	rd.nextDone = make(chan struct{})
+	rd.jobs.Add(1)
+	go rd.loadNeighbour(rd.generation, rd.Provider, rd.CurrSubUrl, true, rd.nextDone)
+}
+
+// startPrev starts prefetching the previous chapter, the caller has to hold the Mutex
+func (rd *Reader) startPrev() {
+	rd.prevDone = make(chan struct{})
+	rd.jobs.Add(1)
+	go rd.loadNeighbour(rd.generation, rd.Provider, rd.CurrSubUrl, false, rd.prevDone)
+}
+
+func (rd *Reader) loadNeighbour(gen uint64, p provider.Provider, curr string, next bool, done chan struct{}) {
+	defer rd.jobs.Done()
+	defer close(done)
+
+	direction := "prev"
+	if next {
+		direction = "next"
+	}
+
+	var sub string
+	var vm *view.ImageViewModel
+	c, err := p.GetHtml(curr)
+	if err == nil {
+		err = rd.ctx.Err()
+	}
+	if err == nil {
+		if next {
+			sub, err = p.GetNext(c)
+		} else {
+			sub, err = p.GetPrev(c)
+		}
+	}
+	if err == nil && sub != "" {
+		vm, err = rd.loadChapter(p, sub)
+	}
+
+	rd.Mutex.Lock()
+	defer rd.Mutex.Unlock()
+	if rd.generation != gen {
+		rd.release(vm)
+		log.Debug().Str("Direction", direction).Msg("Discarded outdated chapter")
+		return
+	}
+
+	if err != nil || sub == "" {
+		if err != nil && rd.ctx.Err() == nil {
+			log.Error().Err(err).Str("Direction", direction).Msg("Could not load chapter")
+		}
+		sub = ""
+		vm = nil
+	}
+
+	if next {
+		rd.NextSubUrl = sub
+		rd.NextViewModel = vm
+	} else {
+		rd.PrevSubUrl = sub
+		rd.PrevViewModel = vm
+	}
+	log.Debug().Str("Direction", direction).Msg("Successfully loaded chapter")
+}
+
+func (rd *Reader) loadChapter(p provider.Provider, subUrl string) (*view.ImageViewModel, error) {
+	html, err := p.GetHtml(subUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	mangaId, _ := rd.fetcher.ids(p, subUrl)
+	images, err := rd.AppendImagesToBuf(p, html, mangaId)
+	if err != nil {
+		return nil, err
+	}
+
+	title, chapter, err := p.GetTitleAndChapter(subUrl)
+	if err != nil {
+		log.Warn().Err(err).Str("Url", subUrl).Msg("Could not extract title and chapter")
+		title = "Unknown"
+		chapter = "ch_?"
+	}
+
+	full := strings.Replace(title, "-", " ", -1) + " - " + strings.Replace(chapter, "_", " ", -1)
+	return &view.ImageViewModel{Images: images, Title: full}, nil
+}
+
+func (rd *Reader) AppendImagesToBuf(p provider.Provider, html string, mangaId int) ([]view.Image, error) {
+	imgList, err := p.GetImageList(html)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]view.Image, len(imgList))
+	var missing []string
+	var missingKeys []string
+	for i, url := range imgList {
+		key := cache.Key(url)
+		images[i] = view.Image{Path: key, Index: i}
+		if !rd.images.Contains(key) {
+			missing = append(missing, url)
+			missingKeys = append(missingKeys, key)
+		}
+	}
+
+	err = rd.fetcher.FetchAll(rd.ctx, p, missing, mangaId, func(i int, buf []byte) {
+		rd.images.Add(missingKeys[i], buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rd.Mutex.Lock()
+	for i, img := range images {
+		rd.sources[img.Path] = imageSource{provider: p, url: imgList[i], mangaId: mangaId}
+	}
+	rd.Mutex.Unlock()
+	return images, nil
+}
+
+// release forgets the images of viewModel, they stay in the cache until they are evicted.
+// The caller has to hold the Mutex
+func (rd *Reader) release(viewModel *view.ImageViewModel) {
+	if viewModel == nil {
+		return
+	}
+	for _, img := range viewModel.Images {
+		delete(rd.sources, img.Path)
+	}
+}
+
+func (rd *Reader) pin(viewModel *view.ImageViewModel) {
+	if viewModel == nil {
+		return
+	}
+	for _, img := range viewModel.Images {
+		rd.images.Pin(img.Path)
+	}
+}
+
+func (rd *Reader) unpin(viewModel *view.ImageViewModel) {
+	if viewModel == nil {
+		return
+	}
+	for _, img := range viewModel.Images {
+		rd.images.Unpin(img.Path)
+	}
+}
+
+// releaseAll drops every chapter of the Reader, the caller has to hold the Mutex
+func (rd *Reader) releaseAll() {
+	rd.unpin(rd.CurrViewModel)
+	rd.release(rd.PrevViewModel)
+	rd.release(rd.CurrViewModel)
+	rd.release(rd.NextViewModel)
+	rd.PrevViewModel = nil
+	rd.CurrViewModel = nil
+	rd.NextViewModel = nil
+	rd.PrevSubUrl = ""
+	rd.NextSubUrl = ""
+}
+
+func wait(ctx context.Context, done chan struct{}) {
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// ReaderManager hands out one Reader per browser, identified by the reader cookie
+type ReaderManager struct {
+	ctx     context.Context
+	jobs    sync.WaitGroup
+	mutex   sync.Mutex
+	readers map[string]*Reader
+	images  *cache.Cache
+	fetcher *Fetcher
+	secure  bool
+	maxIdle time.Duration
+}
+
+func NewReaderManager(ctx context.Context, images *cache.Cache, fetcher *Fetcher, secure bool, maxIdle time.Duration) *ReaderManager {
+	return &ReaderManager{
+		ctx:     ctx,
+		readers: make(map[string]*Reader),
+		images:  images,
+		fetcher: fetcher,
+		secure:  secure,
+		maxIdle: maxIdle,
+	}
+}
+
+// Get returns the Reader of the requesting browser, a new Reader and cookie are created if there is none
+func (m *ReaderManager) Get(w http.ResponseWriter, r *http.Request) *Reader {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cleanup()
+
+	if cookie, err := r.Cookie(readerCookieName); err == nil {
+		if rd, ok := m.readers[cookie.Value]; ok {
+			rd.lastAccess = time.Now()
+			return rd
+		}
+	}
+
+	rd := newReader(m.ctx, &m.jobs, newReaderId(), m.images, m.fetcher)
+	m.readers[rd.Id] = rd
+	http.SetCookie(w, &http.Cookie{
+		Name:     readerCookieName,
+		Value:    rd.Id,
+		Path:     "/",
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return rd
+}
+
+// Lookup returns the Reader of the requesting browser without creating one
+func (m *ReaderManager) Lookup(r *http.Request) (*Reader, bool) {
+	cookie, err := r.Cookie(readerCookieName)
+	if err != nil {
+		return nil, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	rd, ok := m.readers[cookie.Value]
+	if ok {
+		rd.lastAccess = time.Now()
+	}
+	return rd, ok
+}
+
+// Wait blocks until every prefetch has stopped, they stop early once the context of the manager is cancelled
+func (m *ReaderManager) Wait() {
+	m.jobs.Wait()
+}
+
+// cleanup closes Readers that have not been used for maxIdle, the caller has to hold the mutex
+func (m *ReaderManager) cleanup() {
+	if m.maxIdle <= 0 {
+		return
+	}
+	for id, rd := range m.readers {
+		if time.Since(rd.lastAccess) > m.maxIdle {
+			rd.Close()
+			delete(m.readers, id)
+		}
+	}
+}
+
+func newReaderId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
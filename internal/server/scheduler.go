@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/rs/zerolog/log"
+)
+
+// backoffBase is how long a manga is skipped after its first failed update, it doubles with every further failure
+const backoffBase = 5 * time.Minute
+
+// updateHistory is how long update runs and results are kept
+const updateHistory = 30 * 24 * time.Hour
+
+const (
+	// cadenceReleases is the number of recent releases the release cadence is learned from
+	cadenceReleases = 8
+	// releaseGroup merges chapters released within it into one release
+	releaseGroup = 24 * time.Hour
+)
+
+type updateResult int
+
+const (
+	updateSkipped updateResult = iota
+	updateUnchanged
+	updateFound
+	updateFailed
+)
+
+type updateFailure struct {
+	failures   int
+	retryAfter time.Time
+}
+
+// Scheduler updates mangas on a bounded pool of workers. Requests to the same host are spaced out by
+// HostInterval and mangas that keep failing are skipped with an exponential backoff up to MaxBackoff.
+// Every run and the result of every manga is stored in the database.
+// After each update the next one of the manga is planned from its own interval or its release cadence
+type Scheduler struct {
+	// interval is how often mangas without a cadence or an interval of their own are updated
+	interval time.Duration
+	options  UpdateOptions
+	db       *database.Manager
+	// host returns the host a manga is updated from, mangas without one are not rate limited
+	host func(manga *database.Manga) string
+	// update checks a manga for new chapters and returns the released ones
+	update func(manga *database.Manga) ([]database.Chapter, error)
+
+	// running is held during a run, so the periodic and manual runs do not overlap
+	running  sync.Mutex
+	mutex    sync.Mutex
+	current  int
+	hosts    map[string]time.Time
+	failures map[int]*updateFailure
+}
+
+func NewScheduler(interval time.Duration, options UpdateOptions, db *database.Manager, host func(*database.Manga) string,
+	update func(*database.Manga) ([]database.Chapter, error)) *Scheduler {
+	return &Scheduler{
+		interval: interval,
+		options:  options,
+		db:       db,
+		host:     host,
+		update:   update,
+		hosts:    make(map[string]time.Time),
+		failures: make(map[int]*updateFailure),
+	}
+}
+
+// UpdateAll updates mangas and blocks until all are done or ctx is, it returns false if another run is still going
+func (sc *Scheduler) UpdateAll(ctx context.Context, trigger database.UpdateTrigger, mangas []*database.Manga) bool {
+	if !sc.running.TryLock() {
+		return false
+	}
+	defer sc.running.Unlock()
+
+	start := time.Now()
+	run := database.UpdateRun{StartedUnix: start.Unix(), Trigger: trigger, Mangas: len(mangas)}
+	err := sc.db.AddUpdateRun(&run)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save update run")
+	}
+	sc.setCurrent(run.Id)
+	defer sc.setCurrent(0)
+
+	var counts sync.Mutex
+	results := make(map[updateResult]int)
+
+	queue := make(chan *database.Manga)
+	wg := sync.WaitGroup{}
+	for i := 0; i < max(sc.options.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for manga := range queue {
+				result := sc.updateOne(ctx, run.Id, manga)
+				counts.Lock()
+				results[result]++
+				counts.Unlock()
+			}
+		}()
+	}
+
+queue:
+	for _, manga := range mangas {
+		select {
+		case queue <- manga:
+		case <-ctx.Done():
+			break queue
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	// Mangas that were never handed to a worker count as skipped
+	run.Updated = results[updateFound]
+	run.Failed = results[updateFailed]
+	run.Skipped = run.Mangas - run.Updated - run.Failed - results[updateUnchanged]
+	run.Cancelled = ctx.Err() != nil
+	run.FinishedUnix = time.Now().Unix()
+
+	event := log.Info()
+	if run.Cancelled {
+		event = log.Warn()
+	}
+	event.Int("Mangas", run.Mangas).Int("Updated", run.Updated).Int("Failed", run.Failed).Int("Skipped", run.Skipped).
+		Str("Duration", time.Since(start).Round(time.Millisecond).String()).Bool("Cancelled", run.Cancelled).
+		Msg("Finished updating mangas")
+
+	if run.Id != 0 {
+		err = sc.db.SaveUpdateRun(&run)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not save update run")
+		}
+	}
+	err = sc.db.PruneUpdates(time.Now().Add(-updateHistory).Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not prune update history")
+	}
+	return true
+}
+
+// Current returns the id of the running update run, 0 if there is none
+func (sc *Scheduler) Current() int {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.current
+}
+
+func (sc *Scheduler) setCurrent(runId int) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.current = runId
+}
+
+// Refresh updates a single manga right away, even if it is backing off, and returns the released chapters
+func (sc *Scheduler) Refresh(ctx context.Context, manga *database.Manga) ([]database.Chapter, error) {
+	if !sc.waitForHost(ctx, sc.host(manga)) {
+		return nil, ctx.Err()
+	}
+	return sc.run(0, manga)
+}
+
+// updateOne updates manga unless it is backing off after failing or ctx is done
+func (sc *Scheduler) updateOne(ctx context.Context, runId int, manga *database.Manga) updateResult {
+	if retry := sc.retryAfter(manga.Id); time.Now().Before(retry) {
+		log.Debug().Str("Manga", manga.Title).Time("RetryAfter", retry).Msg("Skipping manga, it failed recently")
+		return updateSkipped
+	}
+	if !sc.waitForHost(ctx, sc.host(manga)) {
+		return updateSkipped
+	}
+
+	released, err := sc.run(runId, manga)
+	switch {
+	case err != nil:
+		return updateFailed
+	case len(released) > 0:
+		return updateFound
+	default:
+		return updateUnchanged
+	}
+}
+
+// run updates manga, records the result and the backoff if it failed
+func (sc *Scheduler) run(runId int, manga *database.Manga) ([]database.Chapter, error) {
+	start := time.Now()
+	previous := manga.NextUpdateUnix
+	released, err := sc.update(manga)
+	result := database.UpdateResult{
+		RunId:       runId,
+		MangaId:     manga.Id,
+		TimeUnix:    start.Unix(),
+		DurationMs:  time.Since(start).Milliseconds(),
+		NewChapters: len(released),
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		backoff := sc.fail(manga.Id, time.Now())
+		log.Error().Err(err).Str("Manga", manga.Title).Str("Backoff", backoff.Round(time.Second).String()).
+			Msg("Could not update latest available chapters")
+	} else {
+		sc.succeed(manga.Id)
+	}
+
+	dbErr := sc.db.AddUpdateResult(&result)
+	if dbErr != nil {
+		log.Error().Err(dbErr).Str("Manga", manga.Title).Msg("Could not save update result")
+	}
+
+	manga.NextUpdateUnix = sc.NextUpdate(manga, time.Now()).Unix()
+	dbErr = sc.db.SaveNextUpdate(manga.Id, previous, manga.NextUpdateUnix)
+	if dbErr != nil {
+		log.Error().Err(dbErr).Str("Manga", manga.Title).Msg("Could not save next update")
+	}
+	return released, err
+}
+
+// NextUpdate returns when manga should be updated again after now. Mangas with an interval of their own use it,
+// the others are checked at the base interval once their next release is close and less often until then
+func (sc *Scheduler) NextUpdate(manga *database.Manga, now time.Time) time.Time {
+	if manga.UpdateInterval > 0 {
+		return now.Add(time.Duration(manga.UpdateInterval) * time.Second)
+	}
+
+	gap, last, ok := releaseCadence(manga.Chapters)
+	if !ok {
+		return now.Add(jitter(sc.interval))
+	}
+	// Releases rarely come early, so wait until three quarters of the usual gap passed
+	soon := last.Add(gap - gap/4)
+	wait := max(min(soon.Sub(now), sc.options.MaxInterval), sc.interval)
+	return now.Add(jitter(wait))
+}
+
+// waitForHost reserves the next free slot of host and sleeps until it, it returns false if ctx is done first
+func (sc *Scheduler) waitForHost(ctx context.Context, host string) bool {
+	if host == "" || sc.options.HostInterval <= 0 {
+		return ctx.Err() == nil
+	}
+
+	sc.mutex.Lock()
+	now := time.Now()
+	slot := sc.hosts[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	sc.hosts[host] = slot.Add(sc.options.HostInterval)
+	sc.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(slot.Sub(now)):
+		return true
+	}
+}
+
+func (sc *Scheduler) retryAfter(mangaId int) time.Time {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if f, ok := sc.failures[mangaId]; ok {
+		return f.retryAfter
+	}
+	return time.Time{}
+}
+
+// fail records a failed update and returns how long the manga is skipped because of it
+func (sc *Scheduler) fail(mangaId int, now time.Time) time.Duration {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	f, ok := sc.failures[mangaId]
+	if !ok {
+		f = &updateFailure{}
+		sc.failures[mangaId] = f
+	}
+	f.failures++
+
+	backoff := backoffBase
+	for i := 1; i < f.failures && backoff < sc.options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = jitter(min(backoff, sc.options.MaxBackoff))
+	f.retryAfter = now.Add(backoff)
+	return backoff
+}
+
+func (sc *Scheduler) succeed(mangaId int) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	delete(sc.failures, mangaId)
+}
+
+// jitter changes d randomly by up to a tenth, so runs and retries of many instances do not line up
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 10)
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int64N(2*spread+1)-spread)
+}
+
+// releaseCadence returns the median time between the recent releases of chapters and when the last one was released,
+// ok is false if there are too few releases to tell
+func releaseCadence(chapters []database.Chapter) (gap time.Duration, last time.Time, ok bool) {
+	times := make([]int64, 0, len(chapters))
+	for _, chapter := range chapters {
+		released := chapter.UploadUnix
+		if released == 0 {
+			released = chapter.DiscoveredUnix
+		}
+		if released > 0 {
+			times = append(times, released)
+		}
+	}
+	slices.Sort(times)
+
+	var releases []int64
+	for _, t := range times {
+		if len(releases) == 0 || time.Duration(t-releases[len(releases)-1])*time.Second > releaseGroup {
+			releases = append(releases, t)
+		}
+	}
+	releases = releases[max(len(releases)-cadenceReleases, 0):]
+	if len(releases) < 4 {
+		return 0, time.Time{}, false
+	}
+
+	gaps := make([]int64, len(releases)-1)
+	for i := range gaps {
+		gaps[i] = releases[i+1] - releases[i]
+	}
+	slices.Sort(gaps)
+	return time.Duration(gaps[len(gaps)/2]) * time.Second, time.Unix(times[len(times)-1], 0), true
+}
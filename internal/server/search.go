@@ -0,0 +1,284 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/cache"
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/provider"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// maxCovers limits how many cover urls of search results are remembered
+const maxCovers = 1000
+
+type cover struct {
+	provider provider.Provider
+	url      string
+}
+
+// Covers remembers the cover urls of search results, so /search/cover only fetches urls a provider returned
+type Covers struct {
+	mutex  sync.Mutex
+	covers map[string]cover
+}
+
+func (c *Covers) Add(p provider.Provider, url string) string {
+	key := cache.Key(url)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.covers == nil || len(c.covers) >= maxCovers {
+		c.covers = make(map[string]cover)
+	}
+	c.covers[key] = cover{provider: p, url: url}
+	return key
+}
+
+func (c *Covers) Get(key string) (cover, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cov, ok := c.covers[key]
+	return cov, ok
+}
+
+// searchers returns the names of all providers that can search
+func (s *Server) searchers() []string {
+	names := make([]string, 0)
+	for _, name := range s.Providers.Names() {
+		p, err := s.Providers.Get(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := p.(provider.Searcher); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// search runs the query on the provider named providerName, the default searcher if it is empty
+func (s *Server) search(providerName string, query provider.SearchQuery) (provider.Provider, []provider.SearchResult, error) {
+	if providerName == "" {
+		names := s.searchers()
+		if len(names) == 0 {
+			return nil, nil, errors.New("no provider supports searching")
+		}
+		if slices.Contains(names, s.Providers.Default().Name()) {
+			providerName = s.Providers.Default().Name()
+		} else {
+			providerName = names[0]
+		}
+	}
+
+	p, err := s.Providers.Get(providerName)
+	if err != nil {
+		return nil, nil, err
+	}
+	searcher, ok := p.(provider.Searcher)
+	if !ok {
+		return p, nil, fmt.Errorf("provider %s does not support searching", p.Name())
+	}
+
+	results, err := searcher.Search(query)
+	return p, results, err
+}
+
+func searchQuery(r *http.Request) provider.SearchQuery {
+	_ = r.ParseForm()
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return provider.SearchQuery{
+		Query:  strings.TrimSpace(r.FormValue("q")),
+		Page:   page,
+		Genres: r.Form["genre"],
+	}
+}
+
+func (s *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(view.GetViewTemplate(view.Search))
+
+	query := searchQuery(r)
+	viewModel := view.SearchViewModel{
+		Csrf:      csrfToken(r),
+		Edit:      s.user(r).Can(database.RoleReader),
+		Query:     query.Query,
+		Page:      query.Page,
+		Providers: s.searchers(),
+		Settings:  s.Settings(),
+	}
+
+	searched := query.Query != "" || len(query.Genres) > 0
+	var p provider.Provider
+	var results []provider.SearchResult
+	var err error
+	if searched {
+		p, results, err = s.search(r.FormValue("provider"), query)
+		if err != nil {
+			log.Error().Err(err).Str("Query", query.Query).Msg("Could not search")
+			viewModel.Error = err.Error()
+		}
+	} else if len(viewModel.Providers) > 0 {
+		p, _ = s.Providers.Get(r.FormValue("provider"))
+		if _, ok := p.(provider.Searcher); !ok {
+			p, _ = s.Providers.Get(viewModel.Providers[0])
+		}
+	}
+
+	if p != nil {
+		viewModel.Provider = p.Name()
+		if searcher, ok := p.(provider.Searcher); ok {
+			for _, genre := range searcher.Genres() {
+				viewModel.Genres = append(viewModel.Genres, view.GenreViewModel{
+					Name:     genre,
+					Selected: slices.Contains(query.Genres, genre),
+				})
+			}
+		}
+	}
+
+	ids := make([]int, len(results))
+	for i, result := range results {
+		ids[i] = result.Id
+	}
+	known, err := s.DbMgr.InLibrary(s.userId(r), ids...)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not check library")
+	}
+
+	for _, result := range results {
+		resultViewModel := view.SearchResultViewModel{
+			ID:            result.Id,
+			Title:         result.Title,
+			SubUrl:        result.SubUrl,
+			LatestChapter: result.LatestChapter,
+			LatestUrl:     result.LatestSubUrl,
+			InLibrary:     slices.Contains(known, result.Id),
+		}
+		if result.CoverUrl != "" {
+			resultViewModel.CoverKey = s.Covers.Add(p, result.CoverUrl)
+		}
+		viewModel.Results = append(viewModel.Results, resultViewModel)
+	}
+	viewModel.HasPrev = query.Page > 1
+	viewModel.HasNext = len(results) > 0
+	viewModel.PrevPage = query.Page - 1
+	viewModel.NextPage = query.Page + 1
+	viewModel.Searched = searched
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Search")
+	}
+}
+
+func (s *Server) HandleSearchCover(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	buf, ok := s.Images.Get(key)
+	if !ok {
+		cov, ok := s.Covers.Get(key)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var err error
+		buf, err = s.Fetcher.Fetch(r.Context(), cov.provider, cov.url, 0)
+		if err != nil {
+			log.Error().Err(err).Str("Url", cov.url).Msg("Could not load cover")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		s.Images.Add(key, buf)
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(buf))
+	_, err := w.Write(buf)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not write cover")
+	}
+}
+
+// AddToLibrary adds the title at subUrl to the library of the user without opening a chapter
+func (s *Server) AddToLibrary(userId int, p provider.Provider, subUrl string, title string) (*database.Manga, error) {
+	providerId, err := titleId(subUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	var manga database.Manga
+	result := s.DbMgr.Db.Preload("Chapters").Where("provider = ? AND provider_id = ?", p.Name(), providerId).First(&manga)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		manga = database.NewManga(providerId, p.Name(), titleSlug(subUrl, title), time.Now().Unix())
+		// The chapters are stored with the id of the manga
+		err = s.DbMgr.Db.Create(&manga).Error
+		if err != nil {
+			return nil, err
+		}
+		err, _ = s.UpdateLatestAvailableChapter(&manga)
+		if err != nil {
+			s.DbMgr.Delete(manga.Id)
+			return nil, err
+		}
+		err = s.DbMgr.SaveMangaUpdate(&manga)
+		if err != nil {
+			return nil, err
+		}
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+
+	err = s.DbMgr.AddToLibrary(userId, manga.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &manga, s.DbMgr.LoadUserState(userId, &manga)
+}
+
+func (s *Server) HandleSearchAdd(w http.ResponseWriter, r *http.Request) {
+	p, err := s.Providers.Get(r.PostFormValue("provider"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not add manga")
+		redirectBack(w, r)
+		return
+	}
+
+	manga, err := s.AddToLibrary(s.userId(r), p, r.PostFormValue("subUrl"), r.PostFormValue("title"))
+	if err != nil {
+		log.Error().Err(err).Str("subUrl", r.PostFormValue("subUrl")).Msg("Could not add manga")
+		redirectBack(w, r)
+		return
+	}
+	http.Redirect(w, r, "/manga/"+strconv.Itoa(manga.Id), http.StatusFound)
+}
+
+// titleId reads the manga id from a title sub url like /title/123-some-title
+func titleId(subUrl string) (int, error) {
+	rest, ok := strings.CutPrefix(subUrl, "/title/")
+	if !ok {
+		return 0, fmt.Errorf("invalid title url %q", subUrl)
+	}
+	id, _, _ := strings.Cut(rest, "-")
+	return strconv.Atoi(id)
+}
+
+// titleSlug returns the title part of a sub url, mangas opened from a chapter are stored the same way
+func titleSlug(subUrl string, fallback string) string {
+	rest := strings.TrimPrefix(subUrl, "/title/")
+	rest, _, _ = strings.Cut(rest, "/")
+	if _, slug, ok := strings.Cut(rest, "-"); ok && slug != "" {
+		return slug
+	}
+	return fallback
+}
@@ -2,40 +2,48 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/pablu23/mangaGetter/internal/cache"
 	"github.com/pablu23/mangaGetter/internal/database"
 	"github.com/pablu23/mangaGetter/internal/provider"
-	"github.com/pablu23/mangaGetter/internal/view"
 	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
 )
 
-type Server struct {
-	PrevViewModel *view.ImageViewModel
-	CurrViewModel *view.ImageViewModel
-	NextViewModel *view.ImageViewModel
+// errNotAdmin is returned by SaveSetting when someone else than an admin changes a shared setting
+var errNotAdmin = errors.New("only admins may change shared settings")
 
-	ImageBuffers map[string][]byte
-	Mutex        *sync.Mutex
+type Server struct {
+	// Images holds the thumbnails and the chapter images of all Readers
+	Images *cache.Cache
+	Mutex  *sync.Mutex
 
-	NextSubUrl string
-	CurrSubUrl string
-	PrevSubUrl string
+	Readers *ReaderManager
+	Fetcher *Fetcher
+	Updates *Scheduler
+	// Downloader is nil if downloads are disabled
+	Downloader *Downloader
 
-	Provider provider.Provider
+	Providers *provider.Registry
+	Covers    *Covers
 
-	IsFirst bool
-	IsLast  bool
+	// AddressLogins and NameLogins lock out addresses and user names after too many failed logins
+	AddressLogins *LoginLimiter
+	NameLogins    *LoginLimiter
 
 	DbMgr *database.Manager
 
@@ -43,53 +51,127 @@ type Server struct {
 
 	options Options
 	secret  string
+	// defaultUser is the first admin, every request belongs to them if auth is disabled
+	defaultUser *database.User
+	// oidc is nil unless users log in with OpenID Connect
+	oidc *OidcClient
+
+	// ctx is cancelled on shutdown, it stops the updater, downloads and prefetches
+	ctx    context.Context
+	cancel context.CancelFunc
+	// jobs counts the background goroutines started with background
+	jobs sync.WaitGroup
 }
 
-func New(provider provider.Provider, db *database.Manager, mux *http.ServeMux, options ...func(*Options)) *Server {
+func New(providers *provider.Registry, db *database.Manager, mux *http.ServeMux, options ...func(*Options)) *Server {
 	opts := NewDefaultOptions()
 	for _, opt := range options {
 		opt(&opts)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	images := cache.New(opts.CacheSize)
+	fetcher := &Fetcher{}
 	s := Server{
-		ImageBuffers: make(map[string][]byte),
-		Provider:     provider,
-		DbMgr:        db,
-		Mutex:        &sync.Mutex{},
-		mux:          mux,
-		options:      opts,
+		Images:        images,
+		Readers:       NewReaderManager(ctx, images, fetcher, opts.Tls.Enabled || opts.Auth.Get().Secure, opts.ReaderTimeout),
+		Fetcher:       fetcher,
+		Providers:     providers,
+		Covers:        &Covers{},
+		AddressLogins: NewLoginLimiter(10, 30*time.Second, time.Hour),
+		NameLogins:    NewLoginLimiter(5, 30*time.Second, time.Hour),
+		DbMgr:         db,
+		Mutex:         &sync.Mutex{},
+		mux:           mux,
+		options:       opts,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
+	fetcher.Ids = s.chapterIds
+	s.Updates = NewScheduler(opts.UpdateInterval, opts.Updates, db, s.mangaHost, s.updateManga)
 
 	return &s
 }
 
+// handle registers handler for pattern, only users with role or a higher one may use it
+func (s *Server) handle(pattern string, role database.Role, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, s.Require(role, handler))
+}
+
 func (s *Server) RegisterRoutes() {
+	// Nobody is logged in yet on these
 	s.mux.HandleFunc("GET /login", s.HandleLogin)
 	s.mux.HandleFunc("POST /login", s.HandleLoginPost)
-	s.mux.HandleFunc("/", s.HandleMenu)
-	s.mux.HandleFunc("/new/", s.HandleNewQuery)
-	s.mux.HandleFunc("/new/title/{title}/{chapter}", s.HandleNew)
-	s.mux.HandleFunc("/current/", s.HandleCurrent)
-	s.mux.HandleFunc("/img/{url}", s.HandleImage)
-	s.mux.HandleFunc("POST /next", s.HandleNext)
-	s.mux.HandleFunc("POST /prev", s.HandlePrev)
-	s.mux.HandleFunc("POST /exit", s.HandleExit)
-	s.mux.HandleFunc("POST /delete", s.HandleDelete)
+	s.mux.HandleFunc("GET /login/oidc", s.HandleOidcLogin)
+	s.mux.HandleFunc("GET "+oidcCallbackPath, s.HandleOidcCallback)
 	s.mux.HandleFunc("/favicon.ico", s.HandleFavicon)
-	s.mux.HandleFunc("POST /setting/", s.HandleSetting)
-	s.mux.HandleFunc("GET /setting/set/{setting}/{value}", s.HandleSettingSet)
-	s.mux.HandleFunc("GET /update", s.HandleUpdate)
-	s.mux.HandleFunc("POST /disable", s.HandleDisable)
-	s.mux.HandleFunc("GET /archive", s.HandleArchive)
+
+	s.handle("POST /logout", database.RoleGuest, s.HandleLogout)
+	s.handle("GET /sessions", database.RoleGuest, s.HandleSessions)
+	s.handle("POST /sessions/revoke", database.RoleGuest, s.HandleSessionRevoke)
+	s.handle("POST /sessions/revoke-all", database.RoleGuest, s.HandleSessionRevokeAll)
+	s.handle("GET /tokens", database.RoleGuest, s.HandleTokens)
+	s.handle("POST /tokens", database.RoleGuest, s.HandleTokenCreate)
+	s.handle("POST /tokens/revoke", database.RoleGuest, s.HandleTokenRevoke)
+	s.handle("GET /admin/users", database.RoleAdmin, s.HandleUsers)
+	s.handle("POST /admin/users", database.RoleAdmin, s.HandleUserCreate)
+	s.handle("POST /admin/users/disable", database.RoleAdmin, s.HandleUserDisable)
+	s.handle("POST /admin/users/password", database.RoleAdmin, s.HandleUserPassword)
+	s.handle("POST /admin/users/role", database.RoleAdmin, s.HandleUserRole)
+	s.handle("GET /admin/audit", database.RoleAdmin, s.HandleAudit)
+	s.handle("GET /admin/webhooks", database.RoleAdmin, s.HandleWebhooks)
+	s.handle("POST /admin/webhooks", database.RoleAdmin, s.HandleWebhookCreate)
+	s.handle("POST /admin/webhooks/test", database.RoleAdmin, s.HandleWebhookTest)
+	s.handle("POST /admin/webhooks/disable", database.RoleAdmin, s.HandleWebhookDisable)
+	s.handle("POST /admin/webhooks/delete", database.RoleAdmin, s.HandleWebhookDelete)
+
+	// Reading only changes the progress of the user
+	s.handle("/", database.RoleGuest, s.HandleMenu)
+	s.handle("/new/", database.RoleGuest, s.HandleNewQuery)
+	s.handle("/new/{provider}/title/{title}/{chapter}", database.RoleGuest, s.HandleNew)
+	s.handle("/current/", database.RoleGuest, s.HandleCurrent)
+	s.handle("/img/{url}", database.RoleGuest, s.HandleImage)
+	s.handle("POST /next", database.RoleGuest, s.HandleNext)
+	s.handle("POST /prev", database.RoleGuest, s.HandlePrev)
+	s.handle("POST /exit", database.RoleGuest, s.HandleExit)
+	s.handle("GET /archive", database.RoleGuest, s.HandleArchive)
+	s.handle("POST /position", database.RoleGuest, s.HandlePosition)
+	s.handle("POST /chapter/read", database.RoleGuest, s.HandleChapterRead)
+	s.handle("POST /manga/read", database.RoleGuest, s.HandleMangaRead)
+	s.handle("GET /manga/{id}", database.RoleGuest, s.HandleMangaDetail)
+	s.handle("GET /search", database.RoleGuest, s.HandleSearch)
+	s.handle("GET /search/cover/{key}", database.RoleGuest, s.HandleSearchCover)
+	s.handle("GET /updates", database.RoleGuest, s.HandleUpdates)
+
+	s.handle("POST /delete", database.RoleReader, s.HandleDelete)
+	s.handle("POST /disable", database.RoleReader, s.HandleDisable)
+	s.handle("POST /setting/", database.RoleGuest, s.HandleSetting)
+	s.handle("POST /setting/set/{setting}/{value}", database.RoleGuest, s.HandleSettingSet)
+	s.handle("POST /update", database.RoleReader, s.HandleUpdate)
+	s.handle("POST /manga/update", database.RoleReader, s.HandleMangaUpdate)
+	s.handle("POST /manga/schedule", database.RoleReader, s.HandleMangaSchedule)
+	s.handle("POST /manga/autodownload", database.RoleReader, s.HandleMangaAutoDownload)
+	s.handle("POST /search/add", database.RoleReader, s.HandleSearchAdd)
+	s.handle("POST /download", database.RoleReader, s.HandleDownload)
+	s.handle("POST /download/range", database.RoleReader, s.HandleDownloadRange)
+	s.handle("POST /download/clear", database.RoleReader, s.HandleDownloadClear)
+	s.handle("GET /cache", database.RoleReader, s.HandleCache)
+	s.handle("POST /cache/purge", database.RoleAdmin, s.HandleCachePurge)
+	s.RegisterApiRoutes()
 }
 
-func (s *Server) Start() error {
+// Start serves until ctx is done and then shuts down gracefully: open requests get ShutdownTimeout to finish,
+// afterward background jobs are cancelled and waited for, so the database can be closed once Start returns
+func (s *Server) Start(ctx context.Context) error {
+	defer s.cancel()
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", s.options.Port),
-		Handler: s.mux,
+		Handler: s.Csrf(s.Auth(s.mux)),
+		// Requests still running when the shutdown times out are cancelled with the server
+		BaseContext: func(net.Listener) context.Context {
+			return s.ctx
+		},
 	}
-	s.RegisterRoutes()
-	s.registerUpdater()
 
 	if s.options.Auth.Enabled {
 		auth := s.options.Auth.Get()
@@ -104,9 +186,40 @@ func (s *Server) Start() error {
 			s.secret = string(secretBytes)
 		}
 		s.secret = strings.TrimSpace(s.secret)
-		server.Handler = s.Auth(s.mux)
+		if auth.Mode == OidcAuth {
+			s.oidc = NewOidcClient(auth.Oidc)
+		}
+	}
+
+	err := s.setupUsers()
+	if err != nil {
+		return err
+	}
+	err = s.DbMgr.SetMissingProvider(s.Providers.Default().Name())
+	if err != nil {
+		return err
+	}
+
+	s.RegisterRoutes()
+	s.registerUpdater()
+
+	if s.options.DiskCache.Enabled {
+		err := s.openDiskCache()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.options.Downloads.Enabled {
+		downloadOpts := s.options.Downloads.Get()
+		s.Downloader = NewDownloader(s.ctx, downloadOpts.Path, downloadOpts.Workers, s.Fetcher)
+		s.Downloader.Finished = s.recordAutoDownload
+		s.Downloader.Start()
+		log.Info().Str("Path", downloadOpts.Path).Msg("Downloading chapters")
 	}
+	s.registerRetention()
 
+	serveErr := make(chan error, 1)
 	if s.options.Tls.Enabled {
 		tlsOpts := s.options.Tls.Get()
 		server.TLSConfig = &tls.Config{
@@ -119,246 +232,391 @@ func (s *Server) Start() error {
 			},
 		}
 		log.Info().Int("Port", s.options.Port).Str("Cert", tlsOpts.CertPath).Str("Key", tlsOpts.KeyPath).Msg("Starting server")
-		return server.ListenAndServeTLS("", "")
+		go func() {
+			serveErr <- server.ListenAndServeTLS("", "")
+		}()
 	} else {
 		log.Info().Int("Port", s.options.Port).Msg("Starting server")
-		return server.ListenAndServe()
+		go func() {
+			serveErr <- server.ListenAndServe()
+		}()
 	}
+
+	select {
+	case err := <-serveErr:
+		s.cancel()
+		s.wait(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+	return s.shutdown(&server)
 }
 
-func (s *Server) UpdateMangaList() {
-	var all []*database.Manga
-	s.DbMgr.Db.Where("enabled = 1").Find(&all)
-	for _, m := range all {
-		err, updated := s.UpdateLatestAvailableChapter(m)
-		if err != nil {
-			log.Error().Err(err).Str("Manga", m.Title).Msg("Could not update latest available chapters")
+func (s *Server) shutdown(server *http.Server) error {
+	log.Info().Str("Timeout", s.options.ShutdownTimeout.String()).Msg("Shutting down server")
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.ShutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Requests did not finish in time, cancelling them")
+		err = server.Close()
+	}
+	s.cancel()
+
+	// Cancelled jobs only have to finish their current database write, they get the same timeout again
+	ctx, cancel = context.WithTimeout(context.Background(), s.options.ShutdownTimeout)
+	defer cancel()
+	s.wait(ctx)
+	return err
+}
+
+// wait blocks until the background jobs, downloads and prefetches stopped or ctx is done
+func (s *Server) wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		s.Readers.Wait()
+		if s.Downloader != nil {
+			s.Downloader.Wait()
 		}
-		if updated {
-			s.DbMgr.Db.Save(m)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Debug().Msg("Background jobs stopped")
+	case <-ctx.Done():
+		log.Warn().Msg("Background jobs did not stop in time")
+	}
+}
+
+// background runs job in a goroutine that shutdown waits for, job has to return once ctx is done
+func (s *Server) background(job func(ctx context.Context)) {
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		job(s.ctx)
+	}()
+}
+
+// UpdateMangaList checks the enabled mangas that are not paused or completed for new chapters with the Scheduler,
+// scheduled runs only check the ones that are due. It stops early once ctx is done
+func (s *Server) UpdateMangaList(ctx context.Context, trigger database.UpdateTrigger) {
+	all, err := s.DbMgr.UpdatableMangas()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load mangas to update")
+		return
+	}
+	if trigger == database.UpdateScheduled {
+		now := time.Now().Unix()
+		// Mangas are ordered by their next update, so the due ones come first
+		due := slices.IndexFunc(all, func(m *database.Manga) bool {
+			return m.NextUpdateUnix > now
+		})
+		if due >= 0 {
+			all = all[:due]
+		}
+		if len(all) == 0 {
+			return
 		}
 	}
+	if !s.Updates.UpdateAll(ctx, trigger, all) {
+		log.Info().Msg("Update is already running")
+	}
+}
+
+// updateManga updates manga, saves it if it changed and returns the released chapters
+func (s *Server) updateManga(manga *database.Manga) ([]database.Chapter, error) {
+	released, updated, err := s.updateChapters(manga)
+	if err != nil {
+		return released, err
+	}
+	if updated {
+		err = s.DbMgr.SaveMangaUpdate(manga)
+		if err != nil {
+			return released, err
+		}
+	}
+	s.handleReleased(manga, released)
+	return released, nil
+}
+
+// handleReleased downloads the chapters an update of manga found if it downloads them automatically and sends them to
+// the webhooks, every update has to call it
+func (s *Server) handleReleased(manga *database.Manga, released []database.Chapter) {
+	s.autoDownload(manga, released)
+	s.notifyReleased(manga, released)
+}
+
+func (s *Server) mangaHost(manga *database.Manga) string {
+	p, err := s.Providers.Get(manga.Provider)
+	if err != nil {
+		return manga.Provider
+	}
+	return p.Host()
 }
 
 func (s *Server) registerUpdater() {
 	if s.options.UpdateInterval > 0 {
-		log.Info().Str("Interval", s.options.UpdateInterval.String()).Msg("Registering Updater")
-		go func(s *Server) {
+		log.Info().Str("Interval", s.options.UpdateInterval.String()).Int("Workers", s.options.Updates.Workers).
+			Str("HostInterval", s.options.Updates.HostInterval.String()).Msg("Registering Updater")
+		// Mangas have their own next update, so check often which ones are due
+		tick := min(s.options.UpdateInterval, time.Minute)
+		s.background(func(ctx context.Context) {
 			for {
 				select {
-				case <-time.After(s.options.UpdateInterval):
-					s.UpdateMangaList()
+				case <-ctx.Done():
+					return
+				case <-time.After(tick):
+					s.UpdateMangaList(ctx, database.UpdateScheduled)
 				}
 			}
-		}(s)
+		})
 	}
 }
 
-func (s *Server) LoadNext() {
-	c, err := s.Provider.GetHtml(s.CurrSubUrl)
+// SaveProgress marks the chapter at subUrl as the last opened chapter of its manga for the user,
+// the manga is added to the library if it is new
+func (s *Server) SaveProgress(userId int, p provider.Provider, subUrl string) (*database.Chapter, error) {
+	titleId, chapterId, err := p.GetTitleIdAndChapterId(subUrl)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not get Html for current chapter")
-		s.NextSubUrl = ""
-		s.NextViewModel = nil
-		return
+		return nil, err
 	}
 
-	next, err := s.Provider.GetNext(c)
+	title, chapterName, err := p.GetTitleAndChapter(subUrl)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not load next chapter")
-		s.NextSubUrl = ""
-		s.NextViewModel = nil
-		return
+		log.Warn().Err(err).Str("subUrl", subUrl).Msg("Could not get Title and Chapter")
 	}
 
-	html, err := s.Provider.GetHtml(next)
+	now := time.Now().Unix()
+	manga, err := s.DbMgr.MangaByProviderId(p.Name(), titleId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		created := database.NewManga(titleId, p.Name(), title, now)
+		err = s.DbMgr.Db.Create(&created).Error
+		manga = &created
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("Could not get Html for next chapter")
-		s.NextSubUrl = ""
-		s.NextViewModel = nil
-		return
+		return nil, err
 	}
 
-	imagesNext, err := s.AppendImagesToBuf(html)
-	if err != nil {
-		log.Error().Err(err).Msg("Could not download images")
-		s.NextSubUrl = ""
-		s.NextViewModel = nil
-		return
+	chapter, err := s.DbMgr.ChapterByProviderId(manga.Id, chapterId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		chapterNumberStr := strings.Replace(chapterName, "ch_", "", 1)
+		created := database.NewChapter(chapterId, manga.Id, subUrl, chapterName, chapterNumberStr, now)
+		err = s.DbMgr.Db.Create(&created).Error
+		if err != nil {
+			return nil, err
+		}
+		chapter = &created
+	} else if err != nil {
+		return nil, err
+	} else {
+		err = s.DbMgr.LoadChapterState(userId, chapter)
+		if err != nil {
+			return nil, err
+		}
+		chapter.TimeStampUnix = now
 	}
 
-	title, chapter, err := s.Provider.GetTitleAndChapter(next)
+	err = s.DbMgr.AddToLibrary(userId, manga.Id)
 	if err != nil {
-		log.Warn().Err(err).Str("Url", next).Msg("Could not extract title and chapter")
-		title = "Unknown"
-		chapter = "ch_?"
+		return nil, err
 	}
-
-	full := strings.Replace(title, "-", " ", -1) + " - " + strings.Replace(chapter, "_", " ", -1)
-
-	s.NextViewModel = &view.ImageViewModel{Images: imagesNext, Title: full}
-	s.NextSubUrl = next
-	log.Debug().Msg("Successfully loaded next chapter")
+	err = s.DbMgr.Db.Model(&database.UserManga{}).Where("user_id = ? AND manga_id = ?", userId, manga.Id).
+		Update("time_stamp_unix", now).Error
+	if err != nil {
+		return nil, err
+	}
+	return chapter, s.DbMgr.SaveUserChapter(userId, chapter)
 }
 
-func (s *Server) LoadPrev() {
-	c, err := s.Provider.GetHtml(s.CurrSubUrl)
+// findChapter finds the manga and chapter stored for the chapter at subUrl, chapter is nil if only the manga is stored
+func (s *Server) findChapter(p provider.Provider, subUrl string) (*database.Manga, *database.Chapter, error) {
+	titleId, chapterId, err := p.GetTitleIdAndChapterId(subUrl)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not get Html for current chapter")
-		s.PrevSubUrl = ""
-		s.PrevViewModel = nil
-		return
+		return nil, nil, err
 	}
-	prev, err := s.Provider.GetPrev(c)
+	manga, err := s.DbMgr.MangaByProviderId(p.Name(), titleId)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not load prev chapter")
-		s.PrevSubUrl = ""
-		s.PrevViewModel = nil
-		return
+		return nil, nil, err
 	}
-	html, err := s.Provider.GetHtml(prev)
+	chapter, err := s.DbMgr.ChapterByProviderId(manga.Id, chapterId)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not get Html for prev chapter")
-		s.PrevSubUrl = ""
-		s.PrevViewModel = nil
-		return
+		return manga, nil, err
 	}
+	return manga, chapter, nil
+}
 
-	imagesNext, err := s.AppendImagesToBuf(html)
-	if err != nil {
-		log.Error().Err(err).Msg("Could not download images")
-		s.PrevSubUrl = ""
-		s.PrevViewModel = nil
-		return
+// chapterIds returns the ids the manga and chapter at subUrl are stored with, 0 for the ones that are not stored
+func (s *Server) chapterIds(p provider.Provider, subUrl string) (mangaId int, chapterId int) {
+	manga, chapter, _ := s.findChapter(p, subUrl)
+	if manga != nil {
+		mangaId = manga.Id
 	}
-
-	title, chapter, err := s.Provider.GetTitleAndChapter(prev)
-	if err != nil {
-		log.Warn().Err(err).Str("Url", prev).Msg("Could not extract title and chapter")
-		title = "Unknown"
-		chapter = "ch_?"
+	if chapter != nil {
+		chapterId = chapter.Id
 	}
+	return mangaId, chapterId
+}
 
-	full := strings.Replace(title, "-", " ", -1) + " - " + strings.Replace(chapter, "_", " ", -1)
-
-	s.PrevViewModel = &view.ImageViewModel{Images: imagesNext, Title: full}
-
-	s.PrevSubUrl = prev
-	log.Debug().Msg("Successfully loaded prev chapter")
-
+// Settings returns all settings by name
+func (s *Server) Settings() map[string]database.Setting {
+	var tmp []database.Setting
+	s.DbMgr.Db.Find(&tmp)
+	settings := make(map[string]database.Setting)
+	for _, m := range tmp {
+		settings[m.Name] = m
+	}
+	return settings
 }
 
-func (s *Server) LoadCurr() {
-	html, err := s.Provider.GetHtml(s.CurrSubUrl)
+// UserSettings returns all settings by name with the view settings the user chose
+func (s *Server) UserSettings(userId int) map[string]database.Setting {
+	settings := s.Settings()
+	chosen, err := s.DbMgr.UserSettings(userId)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not get Html for current chapter")
-		s.NextSubUrl = ""
-		s.PrevSubUrl = ""
-		s.CurrSubUrl = ""
-		s.NextViewModel = nil
-		s.CurrViewModel = nil
-		s.PrevViewModel = nil
-		return
+		log.Error().Err(err).Int("User", userId).Msg("Could not load settings of user")
 	}
+	for _, c := range chosen {
+		setting := settings[c.Name]
+		setting.Name = c.Name
+		setting.Value = c.Value
+		settings[c.Name] = setting
+	}
+	return settings
+}
 
-	imagesCurr, err := s.AppendImagesToBuf(html)
-
-	title, chapter, err := s.Provider.GetTitleAndChapter(s.CurrSubUrl)
-	if err != nil {
-		log.Warn().Err(err).Str("Url", s.CurrSubUrl).Msg("Could not extract title and chapter")
-		title = "Unknown"
-		chapter = "ch_?"
+// SaveSetting stores a view setting for user alone, other settings are shared and only admins may change them
+func (s *Server) SaveSetting(user *database.User, name string, value string) error {
+	if database.IsViewSetting(name) {
+		return s.DbMgr.SaveUserSetting(user.Id, name, value)
+	}
+	if !user.Can(database.RoleAdmin) {
+		return errNotAdmin
 	}
+	return s.SetSetting(name, value)
+}
 
-	full := strings.Replace(title, "-", " ", -1) + " - " + strings.Replace(chapter, "_", " ", -1)
+func (s *Server) SetSetting(name string, value string) error {
+	var setting database.Setting
+	res := s.DbMgr.Db.First(&setting, "name = ?", name)
 
-	s.CurrViewModel = &view.ImageViewModel{Images: imagesCurr, Title: full}
-	log.Debug().Msg("Successfully loaded curr chapter")
+	if res.Error != nil && errors.Is(res.Error, gorm.ErrRecordNotFound) {
+		set := database.NewSetting(name, value)
+		return s.DbMgr.Db.Save(&set).Error
+	} else if res.Error != nil {
+		return res.Error
+	}
+	return s.DbMgr.Db.Model(&setting).Update("value", value).Error
 }
 
 func (s *Server) UpdateLatestAvailableChapter(manga *database.Manga) (error, bool) {
-	log.Info().Str("Manga", manga.Title).Msg("Updating Manga")
+	released, updated, err := s.updateChapters(manga)
+	if err == nil {
+		s.handleReleased(manga, released)
+	}
+	return err, updated
+}
 
-	l, err := s.Provider.GetChapterList("/title/" + strconv.Itoa(manga.Id))
+// updateChapters loads the chapter list of manga, it returns the chapters released since the last update
+// and true if manga has to be saved
+func (s *Server) updateChapters(manga *database.Manga) ([]database.Chapter, bool, error) {
+	log.Info().Str("Manga", manga.Title).Str("Provider", manga.Provider).Msg("Updating Manga")
+
+	p, err := s.Providers.Get(manga.Provider)
 	if err != nil {
-		return err, false
+		return nil, false, err
 	}
 
-	le := len(l)
-	_, c, err := s.Provider.GetTitleAndChapter(l[le-1])
+	infos, err := provider.GetChapterInfos(p, manga.SubUrl())
 	if err != nil {
-		return err, false
+		return nil, false, err
 	}
 
-	chapterNumberStr := strings.Replace(c, "ch_", "", 1)
+	le := len(infos)
+	if le == 0 {
+		return nil, false, errors.New("no chapters found")
+	}
+
+	released, synced, err := s.SyncChapters(manga, infos)
+	if err != nil {
+		return nil, false, err
+	}
+
+	chapterNumberStr := infos[le-1].Number
 
 	if manga.LastChapterNum == chapterNumberStr {
-		return nil, false
+		return released, synced, nil
 	} else {
 		manga.LastChapterNum = chapterNumberStr
-		return nil, true
+		return released, true, nil
 	}
 }
 
 func (s *Server) LoadThumbnail(manga *database.Manga) (path string, updated bool, err error) {
-	strId := strconv.Itoa(manga.Id)
+	p, err := s.Providers.Get(manga.Provider)
+	if err != nil {
+		return "", false, err
+	}
+
+	key := thumbnailKey(p.Name(), manga.Id)
 
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	if s.ImageBuffers[strId] != nil {
-		return strId, false, nil
+	if s.Images.Contains(key) {
+		return key, false, nil
 	}
 
 	if manga.Thumbnail != nil {
-		s.ImageBuffers[strId] = manga.Thumbnail
-		return strId, false, nil
+		s.Images.Add(key, manga.Thumbnail)
+		return key, false, nil
 	}
 
-	url, err := s.Provider.GetThumbnail(strId)
+	url, err := p.GetThumbnail(strconv.Itoa(manga.ProviderId))
 	if err != nil {
 		return "", false, err
 	}
-	ram, err := addFileToRam(url)
+	ram, err := s.Fetcher.Fetch(s.ctx, p, url, manga.Id)
 	if err != nil {
 		return "", false, err
 	}
 	manga.Thumbnail = ram
-	s.ImageBuffers[strId] = ram
-	return strId, true, nil
+	s.Images.Add(key, ram)
+	return key, true, nil
 }
 
-func (s *Server) AppendImagesToBuf(html string) ([]view.Image, error) {
-	imgList, err := s.Provider.GetImageList(html)
+// LoadEvictedThumbnail puts the thumbnail stored in the database back into the cache
+func (s *Server) LoadEvictedThumbnail(key string) []byte {
+	i := strings.LastIndex(key, "-")
+	if !strings.HasPrefix(key, "thumb-") || i < 0 {
+		return nil
+	}
+	id, err := strconv.Atoi(key[i+1:])
 	if err != nil {
-		return nil, err
+		return nil
 	}
 
-	images := make([]view.Image, len(imgList))
-
-	wg := sync.WaitGroup{}
-	for i, url := range imgList {
-		wg.Add(1)
-		go func(i int, url string, wg *sync.WaitGroup) {
-			buf, err := addFileToRam(url)
-			if err != nil {
-				panic(err)
-			}
-			name := filepath.Base(url)
-			s.Mutex.Lock()
-			s.ImageBuffers[name] = buf
-			s.Mutex.Unlock()
-			images[i] = view.Image{Path: name, Index: i}
-			wg.Done()
-		}(i, url, &wg)
+	var manga database.Manga
+	result := s.DbMgr.Db.First(&manga, id)
+	if result.Error != nil || manga.Thumbnail == nil {
+		return nil
 	}
+	s.Images.Add(key, manga.Thumbnail)
+	return manga.Thumbnail
+}
 
-	wg.Wait()
-	return images, nil
+func thumbnailKey(provider string, mangaId int) string {
+	return fmt.Sprintf("thumb-%s-%d", provider, mangaId)
 }
 
-func addFileToRam(url string) ([]byte, error) {
+func addFileToRam(ctx context.Context, url string) ([]byte, error) {
 	// Get the data
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -369,6 +627,11 @@ func addFileToRam(url string) ([]byte, error) {
 		}
 	}(resp.Body)
 
+	// Error pages are not images, they must not end up in the caches
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("could not get %s: %s", url, resp.Status)
+	}
+
 	buf := new(bytes.Buffer)
 
 	// Write the body to file
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+)
+
+func (s *Server) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(view.GetViewTemplate(view.Sessions))
+
+	now := time.Now()
+	sessions, err := s.DbMgr.UserSessions(s.userId(r), now.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load sessions")
+	}
+
+	current := s.session(r)
+	viewModel := view.SessionsViewModel{
+		Csrf:     csrfToken(r),
+		Sessions: make([]view.SessionViewModel, len(sessions)),
+		Settings: s.Settings(),
+	}
+	for i, session := range sessions {
+		viewModel.Sessions[i] = view.SessionViewModel{
+			Id:        session.Id,
+			Label:     session.Label,
+			Address:   session.Address,
+			UserAgent: session.UserAgent,
+			Created:   time.Unix(session.CreatedUnix, 0).Format("15:04 (02-01-06)"),
+			LastSeen:  time.Unix(session.LastSeenUnix, 0).Format("15:04 (02-01-06)"),
+			Expires:   time.Unix(session.ExpiresUnix, 0).Format("15:04 (02-01-06)"),
+			Current:   current != nil && current.Id == session.Id,
+		}
+	}
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Sessions")
+	}
+}
+
+func (s *Server) HandleSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	id := r.PostFormValue("sessionId")
+	err := s.DbMgr.DeleteUserSession(s.userId(r), id)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not revoke session")
+	}
+
+	if current := s.session(r); current != nil && current.Id == id {
+		s.HandleLogout(w, r)
+		return
+	}
+	s.audit(r, database.AuthLogout, s.userId(r), s.user(r).Name, "revoked another session")
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
+
+// HandleSessionRevokeAll logs the user out of every device, including this one
+func (s *Server) HandleSessionRevokeAll(w http.ResponseWriter, r *http.Request) {
+	err := s.DbMgr.DeleteUserSessions(s.userId(r))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not revoke sessions")
+	}
+	s.audit(r, database.AuthLogout, s.userId(r), s.user(r).Name, "logged out everywhere")
+	s.endSession(w, r)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// apiTokenPrefix makes api tokens recognizable, for example by secret scanners
+const apiTokenPrefix = "mg_"
+
+// bearerToken returns the token of the Authorization header, empty if there is none
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// tokenUser returns the user of the api token, nil if the token is unknown or the user disabled
+func (s *Server) tokenUser(bearer string) (*database.User, *database.ApiToken) {
+	user, token, err := s.DbMgr.TokenUser(hashToken(bearer))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error().Err(err).Msg("Could not load api token")
+		}
+		return nil, nil
+	}
+
+	now := time.Now().Unix()
+	if now-token.LastUsedUnix >= int64(sessionTouchInterval/time.Second) {
+		err = s.DbMgr.TouchApiToken(token, now)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not update api token")
+		}
+	}
+	return user, token
+}
+
+func (s *Server) HandleTokens(w http.ResponseWriter, r *http.Request) {
+	s.viewTokens(w, r, "", "")
+}
+
+func (s *Server) viewTokens(w http.ResponseWriter, r *http.Request, created string, errorMessage string) {
+	tmpl := template.Must(view.GetViewTemplate(view.Tokens))
+
+	tokens, err := s.DbMgr.UserApiTokens(s.userId(r))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load api tokens")
+	}
+
+	viewModel := view.TokensViewModel{
+		Csrf:     csrfToken(r),
+		Settings: s.Settings(),
+		Created:  created,
+		Error:    errorMessage,
+		Tokens:   make([]view.TokenViewModel, len(tokens)),
+	}
+	for i, token := range tokens {
+		viewModel.Tokens[i] = view.TokenViewModel{
+			Id:       token.Id,
+			Name:     token.Name,
+			ReadOnly: token.ReadOnly,
+			Created:  time.Unix(token.CreatedUnix, 0).Format("15:04 (02-01-06)"),
+		}
+		if token.LastUsedUnix > 0 {
+			viewModel.Tokens[i].LastUsed = time.Unix(token.LastUsedUnix, 0).Format("15:04 (02-01-06)")
+		}
+	}
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Tokens")
+	}
+}
+
+// HandleTokenCreate shows the new token once, only its hash is stored
+func (s *Server) HandleTokenCreate(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" {
+		s.viewTokens(w, r, "", "The token needs a name")
+		return
+	}
+
+	secret, _, err := newToken()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create api token")
+		s.viewTokens(w, r, "", "Could not create token")
+		return
+	}
+	secret = apiTokenPrefix + secret
+
+	token := database.NewApiToken(s.userId(r), name, hashToken(secret), r.PostFormValue("scope") != "write", time.Now().Unix())
+	err = s.DbMgr.CreateApiToken(&token)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save api token")
+		s.viewTokens(w, r, "", "Could not create token")
+		return
+	}
+	log.Info().Str("User", s.user(r).Name).Str("Token", name).Bool("ReadOnly", token.ReadOnly).Msg("Created api token")
+	s.viewTokens(w, r, secret, "")
+}
+
+func (s *Server) HandleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	tokenStr := r.PostFormValue("tokenId")
+	tokenId, err := strconv.Atoi(tokenStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", tokenStr).Msg("Could not convert id to int")
+		http.Redirect(w, r, "/tokens", http.StatusFound)
+		return
+	}
+
+	err = s.DbMgr.DeleteUserApiToken(s.userId(r), tokenId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", tokenId).Msg("Could not revoke api token")
+	}
+	http.Redirect(w, r, "/tokens", http.StatusFound)
+}
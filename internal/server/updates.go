@@ -0,0 +1,280 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+const (
+	// releasedShown is the number of released chapters on /updates
+	releasedShown = 50
+	// runsShown is the number of update runs on /updates
+	runsShown = 10
+	// historyShown is the number of update results on the page of a manga
+	historyShown = 10
+)
+
+func (s *Server) HandleUpdates(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(view.GetViewTemplate(view.Updates))
+	userId := s.userId(r)
+	now := time.Now().Unix()
+
+	seen, err := s.DbMgr.UpdatesSeen(userId)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load when updates were seen")
+	}
+	released, err := s.DbMgr.ReleasedChapters(userId, releasedShown)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load released chapters")
+	}
+	runs, err := s.DbMgr.UpdateRuns(runsShown)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load update runs")
+	}
+	mangas, err := s.DbMgr.Library(userId)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load library")
+	}
+	latest, err := s.DbMgr.LatestUpdateResults(userId)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load update results")
+	}
+
+	viewModel := view.UpdatesViewModel{
+		Csrf:     csrfToken(r),
+		Edit:     s.user(r).Can(database.RoleReader),
+		Settings: s.Settings(),
+	}
+	if seen > 0 {
+		viewModel.Seen = time.Unix(seen, 0).Format("15:04 (02-01-06)")
+	}
+
+	for _, chapter := range released {
+		viewModel.Released = append(viewModel.Released, view.ReleasedChapterViewModel{
+			MangaId:    chapter.MangaId,
+			MangaTitle: displayTitle(chapter.MangaTitle),
+			Provider:   chapter.MangaProvider,
+			Number:     chapter.Number,
+			Title:      chapter.Title,
+			Url:        chapter.Url,
+			Discovered: time.Unix(chapter.DiscoveredUnix, 0).Format("15:04 (02-01-06)"),
+			New:        chapter.DiscoveredUnix > seen,
+		})
+	}
+
+	current := s.Updates.Current()
+	for _, run := range runs {
+		runViewModel := view.UpdateRunViewModel{
+			Started:   time.Unix(run.StartedUnix, 0).Format("15:04:05 (02-01-06)"),
+			Trigger:   string(run.Trigger),
+			Mangas:    run.Mangas,
+			Updated:   run.Updated,
+			Failed:    run.Failed,
+			Skipped:   run.Skipped,
+			Cancelled: run.Cancelled,
+			Running:   run.Id == current,
+		}
+		if run.FinishedUnix > 0 {
+			runViewModel.Duration = (time.Duration(run.FinishedUnix-run.StartedUnix) * time.Second).String()
+		}
+		viewModel.Runs = append(viewModel.Runs, runViewModel)
+	}
+
+	for _, manga := range mangas {
+		result, ok := latest[manga.Id]
+		if !ok {
+			viewModel.Never = append(viewModel.Never, view.UpdateResultViewModel{
+				MangaId: manga.Id,
+				Title:   displayTitle(manga.Title),
+				Next:    s.nextUpdateText(manga),
+			})
+			continue
+		}
+		resultViewModel := toUpdateResultViewModel(result, manga.Title)
+		resultViewModel.Next = s.nextUpdateText(manga)
+		viewModel.Results = append(viewModel.Results, resultViewModel)
+	}
+	// Failed mangas first, they are the ones that need attention
+	slices.SortFunc(viewModel.Results, func(a, b view.UpdateResultViewModel) int {
+		if (a.Error == "") != (b.Error == "") {
+			if a.Error != "" {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Title, b.Title)
+	})
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Updates")
+	}
+
+	err = s.DbMgr.SetUpdatesSeen(userId, now)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save when updates were seen")
+	}
+}
+
+// updateHistory returns the last update results of the manga for its page
+func (s *Server) updateHistory(manga *database.Manga) []view.UpdateResultViewModel {
+	results, err := s.DbMgr.UpdateResults(manga.Id, historyShown)
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not load update results")
+		return nil
+	}
+	viewModels := make([]view.UpdateResultViewModel, len(results))
+	for i, result := range results {
+		viewModels[i] = toUpdateResultViewModel(result, manga.Title)
+	}
+	return viewModels
+}
+
+func (s *Server) HandleMangaSchedule(w http.ResponseWriter, r *http.Request) {
+	defer redirectBack(w, r)
+
+	mangaStr := r.PostFormValue("mangaId")
+	mangaId, err := strconv.Atoi(mangaStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", mangaStr).Msg("Could not convert id to int")
+		return
+	}
+	interval, err := parseInterval(r.PostFormValue("interval"))
+	if err != nil {
+		log.Warn().Err(err).Str("Interval", r.PostFormValue("interval")).Msg("Invalid update interval")
+		return
+	}
+
+	// The schedule is shared by everyone with the manga in their library, only they may change it
+	manga, err := s.DbMgr.LibraryManga(s.userId(r), mangaId)
+	if err != nil {
+		log.Error().Err(err).Int("Id", mangaId).Msg("Could not find manga")
+		return
+	}
+
+	err = s.setUpdateSchedule(manga, interval, r.PostFormValue("paused") == "true", r.PostFormValue("completed") == "true")
+	if err != nil {
+		log.Error().Err(err).Str("Manga", manga.Title).Msg("Could not save update schedule")
+	}
+}
+
+// setUpdateSchedule changes the update settings of manga, it is due right away so the new settings apply
+func (s *Server) setUpdateSchedule(manga *database.Manga, interval time.Duration, paused bool, completed bool) error {
+	manga.UpdateInterval = int64(interval / time.Second)
+	manga.UpdatePaused = paused
+	manga.Completed = completed
+	manga.NextUpdateUnix = 0
+	return s.DbMgr.SaveUpdateSchedule(manga)
+}
+
+// scheduleViewModel describes when manga is updated, its chapters have to be loaded for the release cadence
+func (s *Server) scheduleViewModel(manga *database.Manga) view.ScheduleViewModel {
+	viewModel := view.ScheduleViewModel{
+		Paused:    manga.UpdatePaused,
+		Completed: manga.Completed,
+		Next:      s.nextUpdateText(manga),
+	}
+	if manga.UpdateInterval > 0 {
+		viewModel.Interval = formatInterval(time.Duration(manga.UpdateInterval) * time.Second)
+	}
+	if gap, _, ok := releaseCadence(manga.Chapters); ok {
+		viewModel.Cadence = formatInterval(gap)
+	}
+	return viewModel
+}
+
+func (s *Server) nextUpdateText(manga *database.Manga) string {
+	switch {
+	case manga.Completed:
+		return "completed"
+	case manga.UpdatePaused:
+		return "paused"
+	case s.options.UpdateInterval <= 0:
+		return "by hand"
+	case manga.NextUpdateUnix <= time.Now().Unix():
+		return "due"
+	default:
+		return time.Unix(manga.NextUpdateUnix, 0).Format("15:04 (02-01-06)")
+	}
+}
+
+// parseInterval reads a duration like 12h, which may start with days like 7d or 1d12h, empty is 0
+func parseInterval(text string) (time.Duration, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, nil
+	}
+
+	var days time.Duration
+	if before, after, ok := strings.Cut(text, "d"); ok {
+		n, err := strconv.Atoi(before)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid days %q", before)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		text = after
+	}
+
+	var rest time.Duration
+	if text != "" {
+		var err error
+		rest, err = time.ParseDuration(text)
+		if err != nil {
+			return 0, err
+		}
+	}
+	interval := days + rest
+	if interval < time.Minute {
+		return 0, errors.New("interval has to be at least a minute")
+	}
+	return interval, nil
+}
+
+// formatInterval writes d in days, hours and minutes like parseInterval reads it
+func formatInterval(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days := d / (24 * time.Hour)
+	hours := d % (24 * time.Hour) / time.Hour
+	minutes := d % time.Hour / time.Minute
+
+	text := ""
+	if days > 0 {
+		text += fmt.Sprintf("%dd", days)
+	}
+	if hours > 0 {
+		text += fmt.Sprintf("%dh", hours)
+	}
+	if minutes > 0 || text == "" {
+		text += fmt.Sprintf("%dm", minutes)
+	}
+	return text
+}
+
+func toUpdateResultViewModel(result database.UpdateResult, title string) view.UpdateResultViewModel {
+	return view.UpdateResultViewModel{
+		MangaId:     result.MangaId,
+		Title:       displayTitle(title),
+		Time:        time.Unix(result.TimeUnix, 0).Format("15:04:05 (02-01-06)"),
+		Duration:    (time.Duration(result.DurationMs) * time.Millisecond).String(),
+		NewChapters: result.NewChapters,
+		Error:       result.Error,
+	}
+}
+
+// displayTitle turns the title slug of a manga into a readable title
+func displayTitle(title string) string {
+	return cases.Title(language.English, cases.Compact).String(strings.Replace(title, "-", " ", -1))
+}
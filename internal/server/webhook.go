@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	textTemplate "text/template"
+	"time"
+
+	"github.com/pablu23/mangaGetter/internal/database"
+	"github.com/pablu23/mangaGetter/internal/view"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// webhookAttempts is how often a webhook is sent before giving up
+	webhookAttempts = 5
+	// webhookMaxWait caps how long a Retry-After of the receiver is honored
+	webhookMaxWait = time.Minute
+)
+
+// webhookBackoff is the wait before the first retry, it doubles with every further one
+var webhookBackoff = 2 * time.Second
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookTemplates are the bodies of the webhook styles, they are executed with webhookData
+var webhookTemplates = map[database.WebhookStyle]string{
+	database.WebhookJson: `{{json .WebhookPayload}}`,
+	database.WebhookDiscord: `{"content": {{json .Message}}, "embeds": [{"title": {{json .Title}}, ` +
+		`"description": {{json (printf "Chapter %s" .Chapter)}}{{if .Url}}, "url": {{json .Url}}{{end}}` +
+		`{{if .Thumbnail}}, "thumbnail": {"url": {{json .Thumbnail}}}{{end}}}]}`,
+	database.WebhookSlack: `{"text": {{if .Url}}{{json (printf "<%s|%s>" .Url .Message)}}{{else}}{{json .Message}}{{end}}}`,
+	database.WebhookNtfy: `{"topic": {{json .Topic}}, "title": {{json .Title}}, "message": {{json .Message}}` +
+		`{{if .Url}}, "click": {{json .Url}}{{end}}{{if .Thumbnail}}, "icon": {{json .Thumbnail}}{{end}}}`,
+	database.WebhookGotify: `{"title": {{json .Title}}, "message": {{json .Message}}, "priority": 5` +
+		`{{if .Url}}, "extras": {"client::notification": {"click": {"url": {{json .Url}}}}}{{end}}}`,
+}
+
+// WebhookPayload describes the chapters an update found for one manga
+type WebhookPayload struct {
+	MangaId  int    `json:"mangaId"`
+	Title    string `json:"title"`
+	Provider string `json:"provider"`
+	// Chapter is the newest of Chapters, Url links to it on the site of the provider
+	Chapter   string   `json:"chapter"`
+	Chapters  []string `json:"chapters"`
+	Url       string   `json:"url"`
+	Thumbnail string   `json:"thumbnail"`
+	Message   string   `json:"message"`
+}
+
+type webhookData struct {
+	WebhookPayload
+	// Topic is the ntfy topic, ntfy takes json only on its root, so it is cut off the webhook url
+	Topic string
+}
+
+// notifyReleased sends the chapters an update found to every enabled webhook in the background
+func (s *Server) notifyReleased(manga *database.Manga, released []database.Chapter) {
+	var chapters []database.Chapter
+	for _, chapter := range released {
+		// Chapters found on the first sync were out before the manga was added, so they are not new
+		if chapter.DiscoveredUnix > 0 {
+			chapters = append(chapters, chapter)
+		}
+	}
+	if len(chapters) == 0 {
+		return
+	}
+	hooks, err := s.DbMgr.EnabledWebhooks()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load webhooks")
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	title, mangaId, providerName, providerId := manga.Title, manga.Id, manga.Provider, manga.ProviderId
+	s.background(func(ctx context.Context) {
+		payload := s.webhookPayload(mangaId, title, providerName, providerId, chapters)
+		// A webhook that is retrying does not hold up the others
+		wg := sync.WaitGroup{}
+		for i := range hooks {
+			wg.Add(1)
+			go func(hook *database.Webhook) {
+				defer wg.Done()
+				_ = s.sendWebhook(ctx, hook, payload, webhookAttempts)
+			}(&hooks[i])
+		}
+		wg.Wait()
+	})
+}
+
+// webhookPayload links the newest of chapters and the thumbnail on the site of the provider, if it has one
+func (s *Server) webhookPayload(mangaId int, title string, providerName string, providerId int, chapters []database.Chapter) WebhookPayload {
+	payload := WebhookPayload{
+		MangaId:  mangaId,
+		Title:    displayTitle(title),
+		Provider: providerName,
+	}
+	newest := chapters[0]
+	highest, _ := newest.NumberValue()
+	for _, chapter := range chapters {
+		payload.Chapters = append(payload.Chapters, chapter.Number)
+		if n, ok := chapter.NumberValue(); ok && n > highest {
+			newest, highest = chapter, n
+		}
+	}
+	payload.Chapter = newest.Number
+
+	if len(chapters) == 1 {
+		payload.Message = fmt.Sprintf("Chapter %s of %s is out", payload.Chapter, payload.Title)
+	} else {
+		payload.Message = fmt.Sprintf("%d new chapters of %s, up to chapter %s", len(chapters), payload.Title, payload.Chapter)
+	}
+
+	p, err := s.Providers.Get(providerName)
+	if err != nil {
+		return payload
+	}
+	payload.Provider = p.Name()
+	if p.Host() != "" {
+		payload.Url = fmt.Sprintf("https://%s%s", p.Host(), newest.Url)
+	}
+	thumbnail, err := p.GetThumbnail(strconv.Itoa(providerId))
+	if err != nil {
+		log.Warn().Err(err).Str("Manga", title).Msg("Could not get thumbnail for webhooks")
+	} else if strings.HasPrefix(thumbnail, "http") {
+		payload.Thumbnail = thumbnail
+	}
+	return payload
+}
+
+// sendWebhook posts payload to hook, retrying failed attempts with an exponential backoff, and stores the result
+func (s *Server) sendWebhook(ctx context.Context, hook *database.Webhook, payload WebhookPayload, attempts int) error {
+	status := 0
+	target, body, err := webhookRequest(hook, payload)
+	if err == nil {
+		status, err = deliverWebhook(ctx, hook.Name, target, body, attempts)
+	}
+
+	hook.LastUnix = time.Now().Unix()
+	hook.LastStatus = status
+	hook.LastError = ""
+	if err != nil {
+		hook.LastError = err.Error()
+		log.Error().Err(err).Str("Webhook", hook.Name).Str("Manga", payload.Title).Msg("Could not send webhook")
+	} else {
+		log.Info().Str("Webhook", hook.Name).Str("Manga", payload.Title).Str("Chapter", payload.Chapter).Msg("Sent webhook")
+	}
+	dbErr := s.DbMgr.SaveWebhookResult(hook)
+	if dbErr != nil {
+		log.Error().Err(dbErr).Str("Webhook", hook.Name).Msg("Could not save webhook result")
+	}
+	return err
+}
+
+// deliverWebhook posts body to target up to attempts times and returns the status of the last response
+func deliverWebhook(ctx context.Context, name string, target string, body []byte, attempts int) (int, error) {
+	for attempt := 1; ; attempt++ {
+		status, wait, err := postWebhook(ctx, target, body)
+		// Other client errors mean the receiver does not want this body, sending it again will not change that
+		retry := status == 0 || status == http.StatusTooManyRequests || status >= 500
+		if err == nil || !retry || attempt >= attempts || ctx.Err() != nil {
+			return status, err
+		}
+
+		wait = max(wait, jitter(webhookBackoff<<(attempt-1)))
+		log.Warn().Err(err).Str("Webhook", name).Int("Attempt", attempt).Str("Retry", wait.Round(time.Millisecond).String()).
+			Msg("Could not send webhook")
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// webhookRequest returns where the body of hook is posted to and the body for payload
+func webhookRequest(hook *database.Webhook, payload WebhookPayload) (string, []byte, error) {
+	tmpl, err := webhookTemplate(hook.Style, hook.Template)
+	if err != nil {
+		return "", nil, err
+	}
+
+	target := hook.Url
+	data := webhookData{WebhookPayload: payload}
+	if hook.Style == database.WebhookNtfy {
+		u, err := url.Parse(hook.Url)
+		if err != nil {
+			return "", nil, err
+		}
+		data.Topic = strings.Trim(u.Path, "/")
+		u.Path = "/"
+		target = u.String()
+	}
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, data)
+	if err != nil {
+		return "", nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return "", nil, errors.New("the template does not produce valid json")
+	}
+	return target, buf.Bytes(), nil
+}
+
+// webhookTemplate parses the custom template text, or the one of style if text is empty
+func webhookTemplate(style database.WebhookStyle, text string) (*textTemplate.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		text = webhookTemplates[style]
+	}
+	return textTemplate.New("webhook").Funcs(textTemplate.FuncMap{
+		"json": func(v any) (string, error) {
+			buf, err := json.Marshal(v)
+			return string(buf), err
+		},
+	}).Parse(text)
+}
+
+// postWebhook sends body once and returns the status of the response and how long the receiver asked to wait
+func postWebhook(ctx context.Context, target string, body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	// Read the body, so the connection can be reused
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		wait = min(time.Duration(seconds)*time.Second, webhookMaxWait)
+	}
+	message := strings.TrimSpace(string(answer))
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	return resp.StatusCode, wait, fmt.Errorf("%d: %s", resp.StatusCode, message)
+}
+
+func (s *Server) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	s.viewWebhooks(w, r, "")
+}
+
+func (s *Server) viewWebhooks(w http.ResponseWriter, r *http.Request, message string) {
+	tmpl := template.Must(view.GetViewTemplate(view.Webhooks))
+
+	hooks, err := s.DbMgr.Webhooks()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load webhooks")
+		message = "Could not load webhooks"
+	}
+
+	viewModel := view.WebhooksViewModel{
+		Csrf:     csrfToken(r),
+		Message:  message,
+		Settings: s.Settings(),
+		Webhooks: make([]view.WebhookViewModel, len(hooks)),
+	}
+	for _, style := range database.WebhookStyles {
+		viewModel.Styles = append(viewModel.Styles, string(style))
+	}
+	for i, hook := range hooks {
+		viewModel.Webhooks[i] = view.WebhookViewModel{
+			Id:       hook.Id,
+			Name:     hook.Name,
+			Url:      hook.Url,
+			Style:    string(hook.Style),
+			Custom:   hook.Template != "",
+			Disabled: hook.Disabled,
+			Status:   hook.LastStatus,
+			Error:    hook.LastError,
+		}
+		if hook.LastUnix > 0 {
+			viewModel.Webhooks[i].Last = time.Unix(hook.LastUnix, 0).Format("15:04 (02-01-06)")
+		}
+	}
+
+	err = tmpl.Execute(w, viewModel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not template Webhooks")
+	}
+}
+
+func (s *Server) HandleWebhookCreate(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	target := strings.TrimSpace(r.PostFormValue("url"))
+	if name == "" || target == "" {
+		s.viewWebhooks(w, r, "Name and url are required")
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		s.viewWebhooks(w, r, "The url has to start with http:// or https://")
+		return
+	}
+	style, err := database.ParseWebhookStyle(r.PostFormValue("style"))
+	if err != nil {
+		s.viewWebhooks(w, r, "Unknown style")
+		return
+	}
+
+	hook := database.Webhook{
+		Name:        name,
+		Url:         target,
+		Style:       style,
+		Template:    strings.TrimSpace(r.PostFormValue("template")),
+		CreatedUnix: time.Now().Unix(),
+	}
+	_, _, err = webhookRequest(&hook, webhookTestPayload(&hook))
+	if err != nil {
+		s.viewWebhooks(w, r, "Invalid template: "+err.Error())
+		return
+	}
+	err = s.DbMgr.AddWebhook(&hook)
+	if err != nil {
+		log.Error().Err(err).Str("Webhook", name).Msg("Could not add webhook")
+		s.viewWebhooks(w, r, "Could not add webhook "+name)
+		return
+	}
+	log.Info().Str("Webhook", hook.Name).Str("Style", string(hook.Style)).Str("By", s.user(r).Name).Msg("Added webhook")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+}
+
+// HandleWebhookTest sends an example payload to a webhook once and shows how it went
+func (s *Server) HandleWebhookTest(w http.ResponseWriter, r *http.Request) {
+	hook, ok := s.formWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.sendWebhook(r.Context(), hook, webhookTestPayload(hook), 1)
+	if err != nil {
+		s.viewWebhooks(w, r, fmt.Sprintf("Could not send %s: %v", hook.Name, err))
+		return
+	}
+	s.viewWebhooks(w, r, "Sent a test to "+hook.Name)
+}
+
+func webhookTestPayload(hook *database.Webhook) WebhookPayload {
+	return WebhookPayload{
+		Title:    "MangaGetter",
+		Provider: "test",
+		Chapter:  "1",
+		Chapters: []string{"1"},
+		Message:  fmt.Sprintf("Test of the webhook %s, new chapters will look like this", hook.Name),
+	}
+}
+
+func (s *Server) HandleWebhookDisable(w http.ResponseWriter, r *http.Request) {
+	hook, ok := s.formWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := s.DbMgr.SetWebhookDisabled(hook.Id, !hook.Disabled)
+	if err != nil {
+		log.Error().Err(err).Int("Id", hook.Id).Msg("Could not disable webhook")
+	}
+	http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+}
+
+func (s *Server) HandleWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	hook, ok := s.formWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := s.DbMgr.DeleteWebhook(hook.Id)
+	if err != nil {
+		log.Error().Err(err).Int("Id", hook.Id).Msg("Could not delete webhook")
+	} else {
+		log.Info().Str("Webhook", hook.Name).Str("By", s.user(r).Name).Msg("Deleted webhook")
+	}
+	http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+}
+
+// formWebhook loads the webhook of the webhookId form value, it redirects back to the webhooks if there is none
+func (s *Server) formWebhook(w http.ResponseWriter, r *http.Request) (*database.Webhook, bool) {
+	hookStr := r.PostFormValue("webhookId")
+	hookId, err := strconv.Atoi(hookStr)
+	if err != nil {
+		log.Error().Err(err).Str("Id", hookStr).Msg("Could not convert id to int")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+		return nil, false
+	}
+
+	var hook database.Webhook
+	err = s.DbMgr.Db.First(&hook, hookId).Error
+	if err != nil {
+		log.Error().Err(err).Int("Id", hookId).Msg("Could not find webhook")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusFound)
+		return nil, false
+	}
+	return &hook, true
+}
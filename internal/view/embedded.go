@@ -17,14 +17,59 @@ var viewer string
 //go:embed Views/login.gohtml
 var login string
 
+//go:embed Views/cache.gohtml
+var cacheView string
+
+//go:embed Views/manga.gohtml
+var manga string
+
+//go:embed Views/search.gohtml
+var search string
+
+//go:embed Views/users.gohtml
+var users string
+
+//go:embed Views/sessions.gohtml
+var sessions string
+
+//go:embed Views/audit.gohtml
+var audit string
+
+//go:embed Views/tokens.gohtml
+var tokens string
+
+//go:embed Views/updates.gohtml
+var updates string
+
+//go:embed Views/webhooks.gohtml
+var webhooks string
+
 func GetViewTemplate(view View) (*template.Template, error) {
 	switch view {
 	case Menu:
 		return template.New("menu").Parse(menu)
 	case Viewer:
 		return template.New("viewer").Parse(viewer)
-  case Login:
-    return template.New("login").Parse(login)
+	case Login:
+		return template.New("login").Parse(login)
+	case Cache:
+		return template.New("cache").Parse(cacheView)
+	case Manga:
+		return template.New("manga").Parse(manga)
+	case Search:
+		return template.New("search").Parse(search)
+	case Users:
+		return template.New("users").Parse(users)
+	case Sessions:
+		return template.New("sessions").Parse(sessions)
+	case Audit:
+		return template.New("audit").Parse(audit)
+	case Tokens:
+		return template.New("tokens").Parse(tokens)
+	case Updates:
+		return template.New("updates").Parse(updates)
+	case Webhooks:
+		return template.New("webhooks").Parse(webhooks)
 	}
 	return nil, errors.New("invalid view")
 }
@@ -15,6 +15,24 @@ func GetViewTemplate(view View) (*template.Template, error) {
 		path = "internal/view/Views/viewer.gohtml"
 	case Login:
 		path = "internal/view/Views/login.gohtml"
+	case Cache:
+		path = "internal/view/Views/cache.gohtml"
+	case Manga:
+		path = "internal/view/Views/manga.gohtml"
+	case Search:
+		path = "internal/view/Views/search.gohtml"
+	case Users:
+		path = "internal/view/Views/users.gohtml"
+	case Sessions:
+		path = "internal/view/Views/sessions.gohtml"
+	case Audit:
+		path = "internal/view/Views/audit.gohtml"
+	case Updates:
+		path = "internal/view/Views/updates.gohtml"
+	case Tokens:
+		path = "internal/view/Views/tokens.gohtml"
+	case Webhooks:
+		path = "internal/view/Views/webhooks.gohtml"
 	}
 	return template.ParseFiles(path)
 }
@@ -10,10 +10,18 @@ type Image struct {
 type ImageViewModel struct {
 	Title  string
 	Images []Image
+	SubUrl string
+	// Page is the index of the image to continue reading at
+	Page int
+	// Csrf has to be sent back with every form
+	Csrf string
+	// Edit is false for guests, who can only read
+	Edit bool
 }
 
 type MangaViewModel struct {
 	ID           int
+	Provider     string
 	Title        string
 	Number       string
 	LastNumber   string
@@ -21,10 +29,319 @@ type MangaViewModel struct {
 	Url          string
 	ThumbnailUrl string
 	Enabled      bool
+	ChapterId    int
+	Read         bool
+	Unread       int
+}
+
+type DownloadViewModel struct {
+	Id int
+	// ID is the id of the manga
+	ID      int
+	Title   string
+	Chapter string
+	Status  string
+	Done    int
+	Pages   int
+	Path    string
+	Error   string
 }
 
 type MenuViewModel struct {
-	Archive  bool
+	Archive bool
+	// User is the name of the logged in user, Auth is false if there is no login.
+	// Logout is false if the login is handled by a proxy
+	User   string
+	Admin  bool
+	Auth   bool
+	Logout bool
+	// Edit is false for guests, who can only read
+	Edit      bool
+	Providers []string
+	Settings  map[string]database.Setting
+	Mangas    []MangaViewModel
+	Downloads []DownloadViewModel
+	// Released is the number of chapters found since the user last looked at the updates
+	Released int64
+	// Csrf has to be sent back with every form
+	Csrf string
+}
+
+type CacheMangaViewModel struct {
+	ID      int
+	Title   string
+	Entries int
+	Size    string
+}
+
+type CacheViewModel struct {
+	MemorySize    string
+	MemoryBudget  string
+	MemoryEntries int
+	MemoryPinned  int
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+
+	DiskEnabled bool
+	DiskPath    string
+	DiskSize    string
+	DiskMaxSize string
+	DiskMaxAge  string
+	Mangas      []CacheMangaViewModel
+	// Csrf has to be sent back with every form
+	Csrf string
+	// Admin can purge the cache
+	Admin bool
+}
+
+type ChapterViewModel struct {
+	Id        int
+	Number    string
+	Title     string
+	Volume    string
+	Scanlator string
+	Uploaded  string
+	Url       string
+	Read      bool
+	// Current is the chapter that was opened last
+	Current bool
+	Page    int
+}
+
+type MangaDetailViewModel struct {
+	ID           int
+	Provider     string
+	Title        string
+	ThumbnailUrl string
+	LastNumber   string
+	Unread       int
+	Enabled      bool
+	Downloads    bool
+	Settings     map[string]database.Setting
+	Chapters     []ChapterViewModel
+	Updates      []UpdateResultViewModel
+	Schedule     ScheduleViewModel
+	AutoDownload AutoDownloadViewModel
+	// Csrf has to be sent back with every form
+	Csrf string
+	// Edit is false for guests, who can only read
+	Edit bool
+}
+
+type ScheduleViewModel struct {
+	// Interval is the update interval of the manga, empty if it is learned from its releases
+	Interval  string
+	Paused    bool
+	Completed bool
+	// Next is when the manga is updated next, empty if it is not updated
+	Next string
+	// Cadence is the usual time between releases, empty if there are too few to tell
+	Cadence string
+}
+
+type AutoDownloadViewModel struct {
+	// Target is where released chapters are downloaded to, empty if they are not
+	Target string
+	// KeepUnread and DeleteReadAfter are empty if the downloaded chapters are kept
+	KeepUnread      string
+	DeleteReadAfter string
+}
+
+type GenreViewModel struct {
+	Name     string
+	Selected bool
+}
+
+type SearchResultViewModel struct {
+	ID            int
+	Title         string
+	SubUrl        string
+	CoverKey      string
+	LatestChapter string
+	LatestUrl     string
+	InLibrary     bool
+}
+
+type SearchViewModel struct {
+	Query     string
+	Provider  string
+	Providers []string
+	Genres    []GenreViewModel
+	Page      int
+	Searched  bool
+	HasPrev   bool
+	HasNext   bool
+	PrevPage  int
+	NextPage  int
+	Error     string
+	Settings  map[string]database.Setting
+	Results   []SearchResultViewModel
+	// Csrf has to be sent back with every form
+	Csrf string
+	// Edit is false for guests, who can only read
+	Edit bool
+}
+
+type AuthEventViewModel struct {
+	Time      string
+	Type      string
+	Name      string
+	Address   string
+	UserAgent string
+	Detail    string
+}
+
+type AuditViewModel struct {
+	Events   []AuthEventViewModel
+	Page     int
+	HasPrev  bool
+	HasNext  bool
+	PrevPage int
+	NextPage int
+	Settings map[string]database.Setting
+	// Csrf has to be sent back with every form
+	Csrf string
+}
+
+type TokenViewModel struct {
+	Id       int
+	Name     string
+	ReadOnly bool
+	Created  string
+	// LastUsed is empty if the token was never used
+	LastUsed string
+}
+
+type TokensViewModel struct {
+	Tokens []TokenViewModel
+	// Created is a token that was just created, it can not be shown again
+	Created  string
+	Error    string
+	Settings map[string]database.Setting
+	// Csrf has to be sent back with every form
+	Csrf string
+}
+
+type LoginViewModel struct {
+	Name  string
+	Label string
+	Error string
+	// Csrf has to be sent back with every form
+	Csrf string
+	// Sso shows the button to log in with OpenID Connect
+	Sso bool
+}
+
+type SessionViewModel struct {
+	Id        string
+	Label     string
+	Address   string
+	UserAgent string
+	Created   string
+	LastSeen  string
+	Expires   string
+	// Current is the session of the browser viewing the page
+	Current bool
+}
+
+type SessionsViewModel struct {
+	Sessions []SessionViewModel
+	Settings map[string]database.Setting
+	// Csrf has to be sent back with every form
+	Csrf string
+}
+
+type UserViewModel struct {
+	Id       int
+	Name     string
+	Role     string
+	Disabled bool
+	Created  string
+	// Self is the logged in user, who can not disable themselves or change their role
+	Self bool
+}
+
+type UsersViewModel struct {
+	Users    []UserViewModel
+	Roles    []string
+	Error    string
+	Settings map[string]database.Setting
+	// Csrf has to be sent back with every form
+	Csrf string
+}
+
+type WebhookViewModel struct {
+	Id    int
+	Name  string
+	Url   string
+	Style string
+	// Custom is true if the webhook has its own template instead of the one of Style
+	Custom   bool
+	Disabled bool
+	// Last is when the webhook was last sent, empty if never. Error is empty if that succeeded
+	Last   string
+	Status int
+	Error  string
+}
+
+type WebhooksViewModel struct {
+	Webhooks []WebhookViewModel
+	Styles   []string
+	// Message tells how the last action went
+	Message  string
+	Settings map[string]database.Setting
+	// Csrf has to be sent back with every form
+	Csrf string
+}
+
+type ReleasedChapterViewModel struct {
+	MangaId    int
+	MangaTitle string
+	Provider   string
+	Number     string
+	Title      string
+	Url        string
+	Discovered string
+	// New is true if the chapter was found after the user last looked
+	New bool
+}
+
+type UpdateRunViewModel struct {
+	Started   string
+	Trigger   string
+	Duration  string
+	Mangas    int
+	Updated   int
+	Failed    int
+	Skipped   int
+	Cancelled bool
+	// Running is true if the run has not finished yet
+	Running bool
+}
+
+type UpdateResultViewModel struct {
+	MangaId int
+	Title   string
+	// Next is when the manga is updated next, or why it is not
+	Next        string
+	Time        string
+	Duration    string
+	NewChapters int
+	Error       string
+}
+
+type UpdatesViewModel struct {
+	Released []ReleasedChapterViewModel
+	// Seen is when the user last looked at the updates, empty if never
+	Seen    string
+	Runs    []UpdateRunViewModel
+	Results []UpdateResultViewModel
+	// Never lists the mangas of the library that were not updated yet
+	Never    []UpdateResultViewModel
 	Settings map[string]database.Setting
-	Mangas   []MangaViewModel
+	// Csrf has to be sent back with every form
+	Csrf string
+	// Edit is false for guests, who can not start updates
+	Edit bool
 }
@@ -3,7 +3,16 @@ package view
 type View int
 
 const (
-	Menu   View = iota
-	Viewer View = iota
-	Login  View = iota
+	Menu     View = iota
+	Viewer   View = iota
+	Login    View = iota
+	Cache    View = iota
+	Manga    View = iota
+	Search   View = iota
+	Users    View = iota
+	Sessions View = iota
+	Audit    View = iota
+	Tokens   View = iota
+	Updates  View = iota
+	Webhooks View = iota
 )
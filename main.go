@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -8,7 +11,10 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pablu23/mangaGetter/internal/database"
@@ -23,21 +29,64 @@ var (
 	secretFlag         = flag.String("secret", "", "Secret to use for Auth")
 	authFlag           = flag.Bool("auth", false, "Use Auth, does not need to be set if secret or secret-path is set")
 	secretFilePathFlag = flag.String("secret-path", "", "Path to file with ONLY secret in it")
+	proxyHeaderFlag    = flag.String("proxy-header", "", "Trust the user name in this header, like X-Forwarded-User, instead of logging in")
+	trustedProxiesFlag = flag.String("trusted-proxies", "", "Comma separated CIDRs of the proxies allowed to set proxy-header")
+	oidcIssuerFlag     = flag.String("oidc-issuer", "", "Url of an OpenID Connect issuer to log in at, like https://sso.example.com/realms/home")
+	oidcClientIdFlag   = flag.String("oidc-client-id", "", "Client id registered at the OpenID Connect issuer")
+	oidcSecretFlag     = flag.String("oidc-client-secret", "", "Client secret for the OpenID Connect issuer, empty for public clients")
+	oidcRedirectFlag   = flag.String("oidc-redirect-url", "", "Callback url registered at the issuer, built from the request if empty, ends in /login/oidc/callback")
+	oidcClaimFlag      = flag.String("oidc-username-claim", "preferred_username", "Claim of the id token new users are named after")
 	portFlag           = flag.Int("port", 80, "The port on which to host")
 	serverFlag         = flag.Bool("server", false, "If false dont open Browser with Address")
 	databaseFlag       = flag.String("database", "", "Path to sqlite.db file")
 	certFlag           = flag.String("cert", "", "Path to cert file, has to be used in conjunction with key")
 	keyFlag            = flag.String("key", "", "Path to key file, has to be used in conjunction with cert")
 	updateIntervalFlag = flag.String("update", "0h", "Interval to update Mangas")
+	updateWorkersFlag  = flag.Int("update-workers", 4, "Number of mangas updated at the same time")
+	updateHostFlag     = flag.String("update-host-interval", "2s", "Least time between two updates from the same site, 0s for no limit")
+	updateBackoffFlag  = flag.String("update-max-backoff", "24h", "Longest time a manga that keeps failing to update is skipped")
+	updateMaxFlag      = flag.String("update-max-interval", "72h", "Longest time a manga waits for its next release without being updated")
+	shutdownFlag       = flag.String("shutdown-timeout", "10s", "How long open requests and background jobs get to finish on shutdown")
 	debugFlag          = flag.Bool("debug", false, "Activate debug Logs")
 	prettyLogsFlag     = flag.Bool("pretty", false, "Pretty pring Logs")
 	logPathFlag        = flag.String("log", "", "Path to logfile, stderr if default")
-	maxAgeFlag         = flag.Int("age", 3600, "Max age for login Session")
+	maxAgeFlag         = flag.Int("age", 3600, "Seconds a login session stays valid without being used")
 	secureFlag         = flag.Bool("secure", false, "Cookie secure?")
+	cacheSizeFlag      = flag.Int64("cache", 512, "Size of the image cache in MiB, 0 for unlimited")
+	diskCacheFlag      = flag.Bool("disk-cache", false, "Keep downloaded images in a cache on disk")
+	diskCachePathFlag  = flag.String("disk-cache-path", "", "Path to the disk cache, next to the database if default")
+	diskCacheSizeFlag  = flag.Int64("disk-cache-size", 2048, "Size of the disk cache in MiB, 0 for unlimited")
+	diskCacheAgeFlag   = flag.String("disk-cache-age", "720h", "Remove images from the disk cache after not being read for this long, 0h to keep them")
+	downloadPathFlag   = flag.String("download-path", "", "Path to save downloaded chapters to, next to the database if default")
+	downloadersFlag    = flag.Int("downloaders", 2, "Number of chapters to download at the same time")
+	libraryFlag        = flag.String("library", "", "Path to a directory of mangas as CBZ/ZIP files or image folders")
+	addUserFlag        = flag.String("add-user", "", "Create a user with this name and exit")
+	userPasswordFlag   = flag.String("user-password", "", "Password for add-user, read from stdin if empty")
+	userRoleFlag       = flag.String("user-role", "reader", "Role of the user created with add-user: admin, reader or guest")
+	userAdminFlag      = flag.Bool("user-admin", false, "Same as -user-role admin")
+	defaultRoleFlag    = flag.String("default-role", "reader", "Role of users created on their first login through proxy-header or oidc-issuer")
+	disableUserFlag    = flag.String("disable-user", "", "Disable the user with this name, logging them out, and exit")
+	enableUserFlag     = flag.String("enable-user", "", "Enable the user with this name again and exit")
 )
 
 func main() {
 	flag.Parse()
+	errs := loadConfig()
+	config, invalid := validateConfig()
+	errs = append(errs, invalid...)
+
+	if *printConfigFlag {
+		err := printConfig(os.Stdout)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		log.Fatal().Errs("Errors", errs).Msg("Invalid configuration")
+	}
+	if *printConfigFlag {
+		return
+	}
 
 	setupLogging()
 
@@ -48,19 +97,51 @@ func main() {
 		log.Fatal().Err(err).Str("Path", filePath).Msg("Could not open Database")
 	}
 
+	if runUserCommand(&db, config) {
+		closeDatabase(&db)
+		return
+	}
+
 	mux := http.NewServeMux()
-	s := server.New(&provider.Bato{}, &db, mux, func(o *server.Options) {
-		authOptions := setupAuth()
+	providers := provider.NewRegistry(&provider.Bato{})
+	if *libraryFlag != "" {
+		providers.Register(provider.NewLocal(*libraryFlag))
+	}
+	s := server.New(providers, &db, mux, func(o *server.Options) {
+		authOptions := setupAuth(config)
 		o.Port = *portFlag
+		o.CacheSize = *cacheSizeFlag << 20
 
-		if *secretFlag != "" || *secretFilePathFlag != "" || *authFlag {
+		if *secretFlag != "" || *secretFilePathFlag != "" || *authFlag || *proxyHeaderFlag != "" || *oidcIssuerFlag != "" {
 			o.Auth.Set(authOptions)
 		}
-		interval, err := time.ParseDuration(*updateIntervalFlag)
-		if err != nil {
-			log.Fatal().Err(err).Str("Interval", *updateIntervalFlag).Msg("Could not parse interval")
+		o.UpdateInterval = config.UpdateInterval
+		o.Updates = server.UpdateOptions{
+			Workers:      *updateWorkersFlag,
+			HostInterval: config.UpdateHostInterval,
+			MaxBackoff:   config.UpdateMaxBackoff,
+			MaxInterval:  config.UpdateMaxInterval,
+		}
+		o.ShutdownTimeout = config.ShutdownTimeout
+
+		if *diskCacheFlag {
+			o.DiskCache.Apply(func(do *server.DiskCacheOptions) {
+				do.Path = *diskCachePathFlag
+				if do.Path == "" {
+					do.Path = filepath.Join(filepath.Dir(filePath), "cache")
+				}
+				do.MaxSize = *diskCacheSizeFlag << 20
+				do.MaxAge = config.DiskCacheAge
+			})
 		}
-		o.UpdateInterval = interval
+
+		o.Downloads.Apply(func(do *server.DownloadOptions) {
+			do.Path = *downloadPathFlag
+			if do.Path == "" {
+				do.Path = filepath.Join(filepath.Dir(filePath), "downloads")
+			}
+			do.Workers = *downloadersFlag
+		})
 
 		if *certFlag != "" && *keyFlag != "" {
 			o.Tls.Apply(func(to *server.TlsOptions) {
@@ -70,15 +151,17 @@ func main() {
 		}
 	})
 
+	ctx := setupSignals()
 	setupClient()
-	setupClose(&db)
-	err = s.Start()
-	if err != nil {
+	err = s.Start(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		closeDatabase(&db)
 		log.Fatal().Err(err).Msg("Could not start server")
 	}
+	closeDatabase(&db)
 }
 
-func setupAuth() server.AuthOptions {
+func setupAuth(config parsedConfig) server.AuthOptions {
 	var authOptions server.AuthOptions
 	if *secretFlag != "" {
 		authOptions.LoadType = server.Raw
@@ -96,9 +179,73 @@ func setupAuth() server.AuthOptions {
 	}
 	authOptions.MaxAge = *maxAgeFlag
 	authOptions.Secure = *secureFlag
+	authOptions.DefaultRole = config.DefaultRole
+
+	if *proxyHeaderFlag != "" {
+		authOptions.Mode = server.ProxyAuth
+		authOptions.ProxyHeader = *proxyHeaderFlag
+		authOptions.TrustedProxies = config.TrustedProxies
+	}
+
+	if *oidcIssuerFlag != "" {
+		authOptions.Mode = server.OidcAuth
+		authOptions.Oidc = server.OidcOptions{
+			Issuer:        *oidcIssuerFlag,
+			ClientId:      *oidcClientIdFlag,
+			ClientSecret:  *oidcSecretFlag,
+			RedirectUrl:   *oidcRedirectFlag,
+			UsernameClaim: *oidcClaimFlag,
+		}
+	}
 	return authOptions
 }
 
+// runUserCommand manages users from the command line, it returns false if no user flag was set
+func runUserCommand(db *database.Manager, config parsedConfig) bool {
+	switch {
+	case *addUserFlag != "":
+		password := *userPasswordFlag
+		if password == "" {
+			fmt.Printf("Password for %s: ", *addUserFlag)
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				log.Fatal().Err(err).Msg("Could not read password")
+			}
+			password = strings.TrimSpace(line)
+		}
+		if password == "" {
+			log.Fatal().Msg("Password can not be empty")
+		}
+		role := config.UserRole
+		if *userAdminFlag {
+			role = database.RoleAdmin
+		}
+		user, err := db.CreateUser(*addUserFlag, password, role)
+		if err != nil {
+			log.Fatal().Err(err).Str("User", *addUserFlag).Msg("Could not create user")
+		}
+		log.Info().Str("User", user.Name).Str("Role", string(user.Role)).Msg("Created user")
+	case *disableUserFlag != "" || *enableUserFlag != "":
+		name := *enableUserFlag
+		disabled := *disableUserFlag != ""
+		if disabled {
+			name = *disableUserFlag
+		}
+		user, err := db.UserByName(name)
+		if err != nil {
+			log.Fatal().Err(err).Str("User", name).Msg("Could not find user")
+		}
+		err = db.SetUserDisabled(user.Id, disabled)
+		if err != nil {
+			log.Fatal().Err(err).Str("User", name).Msg("Could not change user")
+		}
+		log.Info().Str("User", user.Name).Bool("Disabled", disabled).Msg("Changed user")
+	default:
+		return false
+	}
+	return true
+}
+
 func setupClient() {
 	if !*serverFlag {
 		go func() {
@@ -111,15 +258,15 @@ func setupClient() {
 	}
 }
 
-func setupClose(db *database.Manager) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-
+// setupSignals returns a context that is done on the first SIGINT or SIGTERM, a second one kills the process
+func setupSignals() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for range c {
-			Close(db)
-		}
+		<-ctx.Done()
+		log.Info().Msg("Received signal, send it again to stop immediately")
+		stop()
 	}()
+	return ctx
 }
 
 func setupDb() string {
@@ -169,12 +316,10 @@ func open(url string) error {
 	return exec.Command(cmd, args...).Start()
 }
 
-func Close(db *database.Manager) {
+func closeDatabase(db *database.Manager) {
 	log.Debug().Msg("Closing Database")
 	err := db.Close()
 	if err != nil {
 		log.Error().Err(err).Msg("Could not close Database")
-		return
 	}
-	os.Exit(0)
 }